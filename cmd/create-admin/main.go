@@ -0,0 +1,105 @@
+// Command create-admin creates the first administrator, or gives an
+// existing user a role:
+//
+//	create-admin -email admin@example.com            # пароль читается из stdin
+//	create-admin -email support@example.com -role support
+//
+// It uses the same DATABASE_URL as the server.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"vpn-backend/config"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/repository"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Тариф, который получают новые пользователи
+const baseTariffID = 1
+
+func main() {
+	email := flag.String("email", "", "email of the user to create or promote")
+	password := flag.String("password", os.Getenv("ADMIN_PASSWORD"), "password for a new user; read from stdin if empty")
+	role := flag.String("role", models.RoleAdmin, "role to give: admin, support, billing, readonly or user")
+	flag.Parse()
+
+	if *email == "" {
+		log.Fatalf("-email is required")
+	}
+	if !models.ValidRole(*role) {
+		log.Fatalf("Unknown role %q", *role)
+	}
+
+	cfg := config.Load()
+	dbConn, err := gorm.Open(postgres.Open(cfg.DbURL), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	if err := dbConn.AutoMigrate(&models.User{}); err != nil {
+		log.Fatalf("Failed to auto-migrate database: %v", err)
+	}
+	userRepo := repository.NewUserRepository(dbConn)
+
+	user, err := userRepo.GetUserByEmail(*email)
+	switch {
+	case err == nil:
+		if err := userRepo.SetRole(int(user.ID), *role); err != nil {
+			log.Fatalf("Failed to set role: %v", err)
+		}
+		fmt.Printf("User %d (%s) now has role %s\n", user.ID, user.Email, *role)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		user, err := createUser(userRepo, *email, *password, *role)
+		if err != nil {
+			log.Fatalf("Failed to create user: %v", err)
+		}
+		fmt.Printf("Created user %d (%s) with role %s\n", user.ID, user.Email, *role)
+	default:
+		log.Fatalf("Failed to look up user: %v", err)
+	}
+}
+
+func createUser(userRepo *repository.UserRepository, email, password, role string) (*models.User, error) {
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("failed to read password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return nil, fmt.Errorf("password is required")
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+	// Адрес задаёт оператор, поэтому подтверждение не требуется
+	user := &models.User{
+		Email:       email,
+		Password:    string(hashedPassword),
+		UUID:        uuid.New().String(),
+		TariffID:    baseTariffID,
+		Role:        role,
+		EmailStatus: models.EmailVerified,
+	}
+	if err := userRepo.CreateUser(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,131 @@
+// Command node-agent runs next to Xray on a VPN server and applies the
+// backend's user and config changes to it.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"vpn-backend/internal/agent"
+	"vpn-backend/internal/services"
+	"vpn-backend/internal/xray"
+)
+
+// envOr returns the environment variable key, or def if it is not set.
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+func main() {
+	listen := flag.String("listen", envOr("AGENT_LISTEN", ":9443"), "address to serve the agent API on")
+	secret := flag.String("secret", os.Getenv("AGENT_SECRET"), "shared key the backend authenticates with")
+	configPath := flag.String("xray-config", envOr("XRAY_CONFIG_PATH", "/etc/xray/config.json"), "Xray config file")
+	apiAddr := flag.String("xray-api", envOr("XRAY_API_ADDR", "127.0.0.1:10085"), "Xray gRPC API address")
+	inboundTags := flag.String("inbound-tags", os.Getenv("XRAY_INBOUND_TAGS"), "comma separated default inbounds; empty means all")
+	certFile := flag.String("tls-cert", os.Getenv("AGENT_TLS_CERT"), "TLS certificate; empty serves plain HTTP")
+	keyFile := flag.String("tls-key", os.Getenv("AGENT_TLS_KEY"), "TLS key")
+	xrayBinary := flag.String("xray-bin", envOr("XRAY_BINARY", "/usr/local/bin/xray"), "Xray binary used to test configs before writing them")
+	controllerKind := flag.String("controller", envOr("XRAY_CONTROLLER", "systemd"), "how Xray is restarted: systemd, docker, process or signal")
+	unit := flag.String("systemd-unit", envOr("XRAY_SYSTEMD_UNIT", "xray"), "systemd unit of Xray")
+	container := flag.String("docker-container", envOr("XRAY_DOCKER_CONTAINER", "xray"), "Docker container of Xray")
+	pidFile := flag.String("pid-file", envOr("XRAY_PID_FILE", "/run/xray.pid"), "PID file for the signal controller")
+	reloadSignal := flag.String("reload-signal", os.Getenv("XRAY_RELOAD_SIGNAL"), "signal on which the supervisor of Xray restarts it, for the signal controller")
+	historyKeep := flag.Int("history", 20, "config versions to keep next to the config; 0 disables the history")
+	clientCA := flag.String("client-ca", os.Getenv("AGENT_CLIENT_CA"), "CA of backend client certificates, enables mTLS")
+	limitsHook := flag.String("limits-hook", os.Getenv("AGENT_LIMITS_HOOK"), "command that applies tariff bandwidth and connection limits; empty ignores them")
+	flag.Parse()
+
+	if *secret == "" {
+		log.Fatalf("AGENT_SECRET (or -secret) is required")
+	}
+
+	xrayService := services.NewXrayService(nil, *configPath, "")
+	if _, err := exec.LookPath(*xrayBinary); err != nil {
+		log.Printf("Warning: Xray binary %s not found, configs are written without `xray run -test`: %v", *xrayBinary, err)
+	} else {
+		xrayService.Validator = xray.NewCommandValidator(*xrayBinary, *configPath, 30*time.Second)
+	}
+	xrayController, err := xray.NewController(xray.ControllerConfig{
+		Kind:       *controllerKind,
+		Unit:       *unit,
+		Container:  *container,
+		Binary:     *xrayBinary,
+		ConfigPath: *configPath,
+		PIDFile:    *pidFile,
+		Signal:     *reloadSignal,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize Xray controller: %v", err)
+	}
+	xrayService.Controller = xrayController
+	if *historyKeep > 0 {
+		xrayService.History = xray.NewHistory(*configPath+".history", *historyKeep)
+	}
+	for _, tag := range strings.Split(*inboundTags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			xrayService.DefaultInboundTags = append(xrayService.DefaultInboundTags, tag)
+		}
+	}
+
+	xrayAPI, err := xray.NewAPIClient(*apiAddr, 5*time.Second)
+	if err != nil {
+		log.Fatalf("Failed to initialize Xray API client: %v", err)
+	}
+	defer xrayAPI.Close()
+	xrayService.API = xrayAPI
+
+	backend := services.NewAgentBackend(xrayService)
+	if *limitsHook != "" {
+		backend.Limits = agent.NewLimitsHook(*limitsHook, 30*time.Second)
+	} else {
+		log.Printf("Warning: no limits hook, tariff bandwidth and connection limits are not enforced")
+	}
+
+	server := &http.Server{
+		Addr:         *listen,
+		Handler:      agent.NewServer(backend, *secret).Handler(),
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if starter, ok := xrayService.Controller.(xray.Starter); ok {
+		if err := starter.Start(ctx); err != nil {
+			log.Fatalf("Failed to start Xray: %v", err)
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if *certFile == "" {
+		log.Printf("Warning: serving the agent API without TLS on %s", *listen)
+		err = server.ListenAndServe()
+	} else {
+		server.TLSConfig, err = agent.LoadServerTLS(*certFile, *keyFile, *clientCA)
+		if err != nil {
+			log.Fatalf("Failed to load TLS config: %v", err)
+		}
+		log.Printf("Node agent listening on %s", *listen)
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Node agent stopped: %v", err)
+	}
+	if process, ok := xrayService.Controller.(*xray.ProcessController); ok {
+		process.Stop()
+	}
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os/exec"
 	"time"
 	"vpn-backend/config"
+	"vpn-backend/internal/agent"
 	"vpn-backend/internal/handlers"
+	"vpn-backend/internal/mail"
 	"vpn-backend/internal/middleware"
 	"vpn-backend/internal/models"
 	"vpn-backend/internal/repository"
 	"vpn-backend/internal/services"
+	"vpn-backend/internal/xray"
 
 	gorillaHandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -32,7 +37,7 @@ func main() {
 	}
 
 	// Auto-migrate database schema
-	err = dbConn.AutoMigrate(&models.User{}, &models.Tariff{}, &models.Payment{})
+	err = dbConn.AutoMigrate(&models.User{}, &models.Tariff{}, &models.Payment{}, &models.TrafficLog{}, &models.AccessEvent{}, &models.Host{}, &models.Node{}, &models.PasswordResetToken{}, &models.TelegramIdentity{})
 	if err != nil {
 		log.Fatalf("Failed to auto-migrate database: %v", err)
 	}
@@ -40,12 +45,39 @@ func main() {
 	// Initialize repositories
 	userRepo := repository.NewUserRepository(dbConn)
 	tariffRepo := repository.NewTariffRepository(dbConn)
+	trafficRepo := repository.NewTrafficRepository(dbConn)
+	hostRepo := repository.NewHostRepository(dbConn)
+	nodeRepo := repository.NewNodeRepository(dbConn)
+	passwordResetRepo := repository.NewPasswordResetRepository(dbConn)
+	telegramRepo := repository.NewTelegramIdentityRepository(dbConn)
+	// telegram_id из таблицы users переезжает в telegram_identities
+	if err := telegramRepo.ImportLegacy(); err != nil {
+		log.Fatalf("Failed to import Telegram IDs: %v", err)
+	}
 
 	// Initialize services
 	authService := services.NewAuthService(userRepo, cfg.JWTSecret)
 	if authService == nil {
 		log.Fatalf("Failed to initialize AuthService")
 	}
+	authService.ResetRepo = passwordResetRepo
+	authService.TelegramRepo = telegramRepo
+	authService.ResetURL = cfg.PasswordResetURL
+	authService.ResetTTL = cfg.PasswordResetTTL
+	authService.VerifySecret = []byte(cfg.EmailVerifySecret)
+	authService.VerifyURL = cfg.EmailVerifyURL
+	authService.VerifyTTL = cfg.EmailVerifyTTL
+	authService.UnverifiedTTL = cfg.UnverifiedUserTTL
+	authService.TelegramBotToken = cfg.TelegramBotToken
+	authService.TelegramAuthMaxAge = cfg.TelegramAuthMaxAge
+	switch {
+	case cfg.SMTPHost != "":
+		authService.Mailer = mail.NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+	case cfg.MailDir != "":
+		authService.Mailer = mail.NewFileMailer(cfg.MailDir, cfg.MailFrom)
+	default:
+		log.Printf("Warning: SMTP_HOST and MAIL_DIR not set, emails are only logged")
+	}
 
 	paymentService := services.NewPaymentService(userRepo, tariffRepo)
 	if paymentService == nil {
@@ -56,27 +88,101 @@ func main() {
 	if xrayService == nil {
 		log.Fatalf("Failed to initialize XrayService")
 	}
+	xrayService.DefaultInboundTags = cfg.XrayInboundTags
+	xrayService.History = xray.NewHistory(cfg.XrayHistoryDir, cfg.XrayHistoryKeep)
+	if _, err := exec.LookPath(cfg.XrayBinary); err != nil {
+		log.Printf("Warning: Xray binary %s not found, configs are written without `xray run -test`: %v", cfg.XrayBinary, err)
+	} else {
+		xrayService.Validator = xray.NewCommandValidator(cfg.XrayBinary, cfg.XrayConfigPath, 30*time.Second)
+	}
+	xrayService.Controller, err = xray.NewController(xray.ControllerConfig{
+		Kind:       cfg.XrayController,
+		Unit:       cfg.XraySystemdUnit,
+		Container:  cfg.XrayContainer,
+		Binary:     cfg.XrayBinary,
+		ConfigPath: cfg.XrayConfigPath,
+		PIDFile:    cfg.XrayPIDFile,
+		Signal:     cfg.XrayReloadSignal,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize Xray controller: %v", err)
+	}
+	xrayService.Restarts.Window = cfg.XrayRestartWindow
+	xrayService.Restarts.MaxBackoff = cfg.XrayRestartMaxBackoff
+
+	xrayAPI, err := xray.NewAPIClient(cfg.XrayAPIAddr, cfg.XrayAPITimeout)
+	if err != nil {
+		log.Fatalf("Failed to initialize Xray API client: %v", err)
+	}
+	defer xrayAPI.Close()
+	xrayService.API = xrayAPI
+
+	// Уровни policy в конфиге Xray берутся из тарифов
+	if tariffs, err := tariffRepo.GetAll(); err != nil {
+		log.Printf("Failed to load tariffs for Xray policy levels: %v", err)
+	} else if err := xrayService.SyncPolicyLevels(tariffs); err != nil {
+		log.Printf("Failed to sync Xray policy levels: %v", err)
+	}
+
+	nodeService := services.NewNodeService(nodeRepo, xrayService, cfg.XrayAPITimeout)
+	nodeService.AgentTLS, err = agent.LoadClientTLS(cfg.AgentTLSCert, cfg.AgentTLSKey, cfg.AgentTLSCA)
+	if err != nil {
+		log.Fatalf("Failed to load agent TLS config: %v", err)
+	}
 
 	trafficService := services.NewTrafficService(userRepo, paymentService)
 	if trafficService == nil {
 		log.Fatalf("Failed to initialize TrafficService")
 	}
+	trafficService.Stats = nodeService
+	trafficService.TrafficRepo = trafficRepo
 
 	// Attach Xray service to payment service
 	paymentService.AttachXrayService(xrayService)
 
-	// Generate subscription file
-	err = handlers.GenerateSubscriptionFile("/root/xray/config.json", "subscription.txt")
-	if err != nil {
-		log.Fatalf("Failed to generate subscription.txt: %v", err)
+	// Background workers
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Xray как дочерний процесс бэкенда запускается вместе с ним
+	if starter, ok := xrayService.Controller.(xray.Starter); ok {
+		if err := starter.Start(ctx); err != nil {
+			log.Fatalf("Failed to start Xray: %v", err)
+		}
 	}
 
+	trafficCollector := services.NewTrafficCollector(nodeService, userRepo, trafficRepo, cfg.TrafficInterval)
+	trafficCollector.Start(ctx)
+
+	quotaEnforcer := services.NewQuotaEnforcer(userRepo, nodeService, cfg.QuotaInterval, cfg.QuotaThrottleLevel)
+	paymentService.AttachQuotaEnforcer(quotaEnforcer)
+	quotaEnforcer.Start(ctx)
+
+	nodeService.Start(ctx, cfg.NodeCheckInterval)
+
+	reconciler := services.NewReconciler(userRepo, nodeService, quotaEnforcer, cfg.ReconcileInterval)
+	reconciler.Start(ctx)
+
+	authService.StartPurge(ctx, cfg.UnverifiedPurgeInterval)
+
+	subscriptionService := services.NewSubscriptionService(userRepo, hostRepo, nodeService, cfg.PublicURL)
+	subscriptionService.Title = cfg.SubscriptionTitle
+	subscriptionService.UpdateInterval = cfg.SubscriptionUpdateInterval
+	subscriptionService.SupportURL = cfg.SupportURL
+	subscriptionService.DefaultHost = cfg.SubscriptionDefaultHost
+
 	// Initialize handlers
 	userHandler := handlers.NewUserHandler(authService, paymentService, xrayService, trafficService) // Pass TrafficService
+	userHandler.Nodes = nodeService
 	adminHandler := handlers.NewAdminHandler(userRepo)
 	xrayHandler := handlers.NewXrayHandler(xrayService)
+	xrayHandler.Reconciler = reconciler
 	trafficHandler := handlers.NewTrafficHandler(trafficService) // Initialize TrafficHandler
 	paymentHandler := handlers.NewPaymentHandler(paymentService)
+	tariffHandler := handlers.NewTariffHandler(tariffRepo, nodeRepo, xrayService, quotaEnforcer)
+	subscriptionHandler := handlers.NewSubscriptionHandler(subscriptionService)
+	hostHandler := handlers.NewHostHandler(hostRepo, xrayService)
+	nodeHandler := handlers.NewNodeHandler(nodeRepo, nodeService, quotaEnforcer)
 
 	// Initialize router
 	r := mux.NewRouter()
@@ -88,51 +194,85 @@ func main() {
 	// Public routes
 	r.HandleFunc("/register", userHandler.Register).Methods("POST")
 	r.HandleFunc("/login", userHandler.Login).Methods("POST")
+	r.HandleFunc("/login/telegram", userHandler.TelegramLogin).Methods("POST")
+	r.HandleFunc("/login/telegram/webapp", userHandler.TelegramLogin).Methods("POST")
+	r.HandleFunc("/register/telegram", userHandler.TelegramRegister).Methods("POST")
+	r.HandleFunc("/password-reset/request", userHandler.RequestPasswordReset).Methods("POST")
+	r.HandleFunc("/password-reset/confirm", userHandler.ConfirmPasswordReset).Methods("POST")
+	r.HandleFunc("/email/verify", userHandler.VerifyEmail).Methods("GET")
+	r.HandleFunc("/email/resend", userHandler.ResendVerification).Methods("POST")
 
-	// Путь к файлу подписки
-	subscriptionFilePath := "subscription.txt" // или относительный путь, если сервер запускается из этой папки
-
-	// HTTP endpoint для отдачи файла подписки
-	r.HandleFunc("/subscription.txt", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, subscriptionFilePath)
-	}).Methods("GET")
+	// Подписка по токену: клиенты (v2rayNG, Hiddify) обновляют ее без JWT
+	r.HandleFunc("/sub/{token}", subscriptionHandler.GetSubscription).Methods("GET")
 
 	// User routes
 	userRouter := r.PathPrefix("/user").Subrouter()
-	userRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret))
+	userRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret, authService.TokenVersion))
 	userRouter.HandleFunc("/me", userHandler.GetMe).Methods("GET")
 	userRouter.HandleFunc("/change-tariff", userHandler.ChangeTariff).Methods("POST")
-	userRouter.HandleFunc("/traffic", trafficHandler.GetTraffic).Methods("GET")                        // Add traffic route
-	userRouter.HandleFunc("/delete-account", userHandler.DeleteAccount).Methods("POST")                // Add delete account route
-	userRouter.HandleFunc("/request-password-reset", userHandler.RequestPasswordReset).Methods("POST") // Add request password reset route
+	userRouter.HandleFunc("/traffic", trafficHandler.GetTraffic).Methods("GET") // Add traffic route
+	userRouter.HandleFunc("/traffic/history", trafficHandler.GetHistory).Methods("GET")
+	userRouter.HandleFunc("/telegram", userHandler.GetTelegramIdentities).Methods("GET")
+	userRouter.HandleFunc("/telegram", userHandler.LinkTelegram).Methods("POST")
+	userRouter.HandleFunc("/telegram/{telegram_id:[0-9]+}", userHandler.UnlinkTelegram).Methods("DELETE")
+	userRouter.HandleFunc("/delete-account", userHandler.DeleteAccount).Methods("POST") // Add delete account route
 	userRouter.HandleFunc("/payments", paymentHandler.CreatePayment).Methods("POST")
 	userRouter.HandleFunc("/payments", paymentHandler.GetUserPayments).Methods("GET")
 	userRouter.HandleFunc("/payments/{id}", paymentHandler.GetPaymentByID).Methods("GET")
 	userRouter.HandleFunc("/payments/{id}", paymentHandler.UpdatePaymentStatus).Methods("PUT")
-	userRouter.HandleFunc("/subscription", userHandler.GetSubscription).Methods("GET")
-	userRouter.HandleFunc("/hiddify-config", userHandler.GetHiddifyConfig).Methods("GET")
+	userRouter.HandleFunc("/subscription", subscriptionHandler.GetOwnSubscription).Methods("GET")
+	userRouter.HandleFunc("/hiddify-config", subscriptionHandler.GetHiddifyConfig).Methods("GET")
+	userRouter.HandleFunc("/subscription/token", subscriptionHandler.GetToken).Methods("GET")
+	userRouter.HandleFunc("/subscription/token", subscriptionHandler.RotateToken).Methods("POST")
+	userRouter.HandleFunc("/subscription/token", subscriptionHandler.RevokeToken).Methods("DELETE")
 
 	// Xray config route
 	userRouter.HandleFunc("/config", handlers.NewConfigHandler(xrayService).GetConfig).Methods("GET")
 
-	// Admin routes
+	// Admin routes: каждый маршрут требует своё право из JWT (см. models.RolePermissions)
+	can := func(permission string, handler http.HandlerFunc) http.Handler {
+		return middleware.RequirePermission(permission)(handler)
+	}
 	adminRouter := r.PathPrefix("/admin").Subrouter()
-	adminRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret))
-	adminRouter.Use(middleware.AdminOnlyMiddleware(cfg.AdminToken))
-	adminRouter.HandleFunc("/users", adminHandler.GetAllUsers).Methods("GET")
-	adminRouter.HandleFunc("/ban/{id}", adminHandler.BanUser).Methods("POST")
+	adminRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret, authService.TokenVersion))
+	adminRouter.Handle("/users", can(models.PermUsersRead, adminHandler.GetAllUsers)).Methods("GET")
+	adminRouter.Handle("/ban/{id}", can(models.PermUsersWrite, adminHandler.BanUser)).Methods("POST")
+	adminRouter.Handle("/users/{id}/role", can(models.PermRolesWrite, adminHandler.SetRole)).Methods("PUT")
+	adminRouter.Handle("/payments/{id}/status", can(models.PermPaymentsWrite, paymentHandler.SetPaymentStatus)).Methods("PUT")
+	adminRouter.Handle("/users/{id}/traffic/history", can(models.PermTrafficRead, trafficHandler.GetUserHistory)).Methods("GET")
+	adminRouter.Handle("/traffic/history", can(models.PermTrafficRead, trafficHandler.GetServerHistory)).Methods("GET")
+	adminRouter.Handle("/tariffs", can(models.PermTariffsRead, tariffHandler.GetAllTariffs)).Methods("GET")
+	adminRouter.Handle("/tariffs/{id}/inbounds", can(models.PermTariffsWrite, tariffHandler.UpdateInboundTags)).Methods("PUT")
+	adminRouter.Handle("/tariffs/{id}/nodes", can(models.PermTariffsWrite, tariffHandler.UpdateNodes)).Methods("PUT")
+	adminRouter.Handle("/tariffs/{id}/policy", can(models.PermTariffsWrite, tariffHandler.UpdatePolicy)).Methods("PUT")
+	adminRouter.Handle("/nodes", can(models.PermNodesRead, nodeHandler.GetAllNodes)).Methods("GET")
+	adminRouter.Handle("/nodes", can(models.PermNodesWrite, nodeHandler.CreateNode)).Methods("POST")
+	adminRouter.Handle("/nodes/{id}", can(models.PermNodesWrite, nodeHandler.UpdateNode)).Methods("PUT")
+	adminRouter.Handle("/nodes/{id}", can(models.PermNodesWrite, nodeHandler.DeleteNode)).Methods("DELETE")
+	adminRouter.Handle("/nodes/{id}/check", can(models.PermNodesRead, nodeHandler.CheckNode)).Methods("POST")
+	adminRouter.Handle("/nodes/{id}/sync", can(models.PermNodesWrite, nodeHandler.SyncNode)).Methods("POST")
+	adminRouter.Handle("/hosts", can(models.PermNodesRead, hostHandler.GetAllHosts)).Methods("GET")
+	adminRouter.Handle("/hosts", can(models.PermNodesWrite, hostHandler.CreateHost)).Methods("POST")
+	adminRouter.Handle("/hosts/{id}", can(models.PermNodesWrite, hostHandler.UpdateHost)).Methods("PUT")
+	adminRouter.Handle("/hosts/{id}", can(models.PermNodesWrite, hostHandler.DeleteHost)).Methods("DELETE")
+	adminRouter.Handle("/xray/drift", can(models.PermXrayRead, xrayHandler.GetDrift)).Methods("GET")
+	adminRouter.Handle("/xray/reconcile", can(models.PermXrayWrite, xrayHandler.Reconcile)).Methods("POST")
+	adminRouter.Handle("/xray/configs", can(models.PermXrayRead, xrayHandler.GetConfigVersions)).Methods("GET")
+	adminRouter.Handle("/xray/configs/diff", can(models.PermXrayRead, xrayHandler.DiffConfigVersions)).Methods("GET")
+	adminRouter.Handle("/xray/configs/{version:[0-9]+}", can(models.PermXrayRead, xrayHandler.GetConfigVersion)).Methods("GET")
+	adminRouter.Handle("/xray/configs/{version:[0-9]+}/rollback", can(models.PermXrayWrite, xrayHandler.RollbackConfig)).Methods("POST")
 
 	// Xray routes
 	xrayRouter := r.PathPrefix("/xray").Subrouter()
-	xrayRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret))
-	xrayRouter.Use(middleware.AdminOnlyMiddleware(cfg.AdminToken))
-	xrayRouter.HandleFunc("/reload", xrayHandler.ReloadConfig).Methods("POST")
-	xrayRouter.HandleFunc("/restart", xrayHandler.Restart).Methods("POST")
+	xrayRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret, authService.TokenVersion))
+	xrayRouter.Handle("/reload", can(models.PermXrayWrite, xrayHandler.ReloadConfig)).Methods("POST")
+	xrayRouter.Handle("/restart", can(models.PermXrayWrite, xrayHandler.Restart)).Methods("POST")
+	xrayRouter.Handle("/status", can(models.PermXrayRead, xrayHandler.Status)).Methods("GET")
 
 	// CORS setup
 	headersOk := gorillaHandlers.AllowedHeaders([]string{"Content-Type", "Authorization"})
 	originsOk := gorillaHandlers.AllowedOrigins([]string{"*"})
-	methodsOk := gorillaHandlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
+	methodsOk := gorillaHandlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"})
 	// HTTP Server configuration
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%s", cfg.ServerPort),
@@ -0,0 +1,191 @@
+// Package agent is the protocol between the backend and the node agent that
+// runs next to Xray on every VPN server. It is plain JSON over HTTP; the
+// backend authenticates with a shared key, optionally on top of mutual TLS.
+package agent
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"vpn-backend/internal/xray"
+)
+
+// UserRequest describes a user for SyncUser and RemoveUser.
+type UserRequest struct {
+	UUID  string `json:"uuid"`
+	Email string `json:"email"`
+	Level int    `json:"level"`
+	// InboundTags are the inbounds to put the user in; empty means the
+	// agent's default set.
+	InboundTags []string `json:"inbound_tags,omitempty"`
+	// BandwidthLimit (bytes per second) and ConnectionLimit (simultaneous
+	// connections) come from the user's tariff; 0 means no limit. Xray can't
+	// enforce them, so the agent passes them to its LimitsHook.
+	BandwidthLimit  int64 `json:"bandwidth_limit,omitempty"`
+	ConnectionLimit int   `json:"connection_limit,omitempty"`
+}
+
+// SyncRequest replaces the whole Xray config of the node: Config is the
+// layout without clients, Users are the clients to put into it.
+type SyncRequest struct {
+	Config json.RawMessage `json:"config"`
+	Users  []UserRequest   `json:"users"`
+}
+
+// Health is the agent's report about itself and its Xray.
+type Health struct {
+	Status    string `json:"status"`
+	XrayError string `json:"xray_error,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Backend does the actual work on the node.
+type Backend interface {
+	SyncUser(req UserRequest) error
+	RemoveUser(req UserRequest) error
+	Config() ([]byte, error)
+	Sync(req SyncRequest) error
+	QueryStats(ctx context.Context, query xray.StatsQuery) ([]xray.Stat, error)
+	// Health returns nil if Xray is up.
+	Health(ctx context.Context) error
+	Restart() error
+}
+
+// Server exposes a Backend over HTTP.
+type Server struct {
+	Backend Backend
+	// Secret is the shared key the backend must send as a bearer token.
+	Secret string
+}
+
+func NewServer(backend Backend, secret string) *Server {
+	return &Server{Backend: backend, Secret: secret}
+}
+
+// Handler returns the HTTP handler of the agent API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/users/sync", s.syncUser)
+	mux.HandleFunc("POST /v1/users/remove", s.removeUser)
+	mux.HandleFunc("GET /v1/config", s.getConfig)
+	mux.HandleFunc("PUT /v1/config", s.sync)
+	mux.HandleFunc("POST /v1/stats/query", s.queryStats)
+	mux.HandleFunc("GET /v1/health", s.health)
+	mux.HandleFunc("POST /v1/restart", s.restart)
+	return s.authenticate(mux)
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.Secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Secret)) != 1 {
+			respondError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func respond(w http.ResponseWriter, code int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if payload != nil {
+		json.NewEncoder(w).Encode(payload)
+	}
+}
+
+func respondError(w http.ResponseWriter, code int, err error) {
+	respond(w, code, errorResponse{Error: err.Error()})
+}
+
+// decode reads a JSON request body, answering 400 itself on failure.
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 16<<20)).Decode(v); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func (s *Server) syncUser(w http.ResponseWriter, r *http.Request) {
+	var req UserRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if err := s.Backend.SyncUser(req); err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respond(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) removeUser(w http.ResponseWriter, r *http.Request) {
+	var req UserRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if err := s.Backend.RemoveUser(req); err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respond(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) getConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := s.Backend.Config()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respond(w, http.StatusOK, json.RawMessage(data))
+}
+
+func (s *Server) sync(w http.ResponseWriter, r *http.Request) {
+	var req SyncRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if err := s.Backend.Sync(req); err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respond(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) queryStats(w http.ResponseWriter, r *http.Request) {
+	var query xray.StatsQuery
+	if !decode(w, r, &query) {
+		return
+	}
+	stats, err := s.Backend.QueryStats(r.Context(), query)
+	if err != nil {
+		respondError(w, http.StatusBadGateway, err)
+		return
+	}
+	respond(w, http.StatusOK, stats)
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	health := Health{Status: "ok"}
+	if err := s.Backend.Health(r.Context()); err != nil {
+		health = Health{Status: "degraded", XrayError: err.Error()}
+	}
+	respond(w, http.StatusOK, health)
+}
+
+func (s *Server) restart(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Restart requested by backend")
+	if err := s.Backend.Restart(); err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respond(w, http.StatusNoContent, nil)
+}
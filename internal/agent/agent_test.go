@@ -0,0 +1,113 @@
+package agent_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"vpn-backend/internal/agent"
+	"vpn-backend/internal/xray"
+)
+
+type fakeBackend struct {
+	users    map[string]agent.UserRequest
+	synced   *agent.SyncRequest
+	restarts int
+}
+
+func (b *fakeBackend) SyncUser(req agent.UserRequest) error {
+	b.users[req.UUID] = req
+	return nil
+}
+
+func (b *fakeBackend) RemoveUser(req agent.UserRequest) error {
+	if _, ok := b.users[req.UUID]; !ok {
+		return errors.New("user not found")
+	}
+	delete(b.users, req.UUID)
+	return nil
+}
+
+func (b *fakeBackend) Config() ([]byte, error) {
+	return []byte(`{"inbounds":[]}`), nil
+}
+
+func (b *fakeBackend) Sync(req agent.SyncRequest) error {
+	b.synced = &req
+	return nil
+}
+
+func (b *fakeBackend) QueryStats(ctx context.Context, query xray.StatsQuery) ([]xray.Stat, error) {
+	return []xray.Stat{{Name: "user>>>a@example.com>>>traffic>>>uplink", Value: 42}}, nil
+}
+
+func (b *fakeBackend) Health(ctx context.Context) error {
+	return errors.New("xray is down")
+}
+
+func (b *fakeBackend) Restart() error {
+	b.restarts++
+	return nil
+}
+
+func TestClientServer(t *testing.T) {
+	backend := &fakeBackend{users: make(map[string]agent.UserRequest)}
+	server := httptest.NewServer(agent.NewServer(backend, "s3cret").Handler())
+	defer server.Close()
+
+	ctx := context.Background()
+	client := agent.NewClient(server.URL, "s3cret", 5*time.Second, nil)
+
+	user := agent.UserRequest{UUID: "uuid-1", Email: "a@example.com", Level: 2, InboundTags: []string{"vless-ws"}}
+	if err := client.SyncUser(ctx, user); err != nil {
+		t.Fatalf("SyncUser failed: %v", err)
+	}
+	if got := backend.users["uuid-1"]; got.Level != 2 || got.InboundTags[0] != "vless-ws" {
+		t.Fatalf("Backend got %+v", got)
+	}
+	if err := client.RemoveUser(ctx, user); err != nil {
+		t.Fatalf("RemoveUser failed: %v", err)
+	}
+	if err := client.RemoveUser(ctx, user); err == nil || !strings.Contains(err.Error(), "user not found") {
+		t.Fatalf("Expected backend error to reach the client, got %v", err)
+	}
+
+	stats, err := client.QueryStats(ctx, xray.StatsQuery{Patterns: []string{"user>>>"}, Reset: true})
+	if err != nil || len(stats) != 1 || stats[0].Value != 42 {
+		t.Fatalf("QueryStats = %+v, %v", stats, err)
+	}
+
+	health, err := client.Health(ctx)
+	if err != nil || health.Status != "degraded" || health.XrayError != "xray is down" {
+		t.Fatalf("Health = %+v, %v", health, err)
+	}
+
+	if err := client.Sync(ctx, agent.SyncRequest{Config: json.RawMessage(`{"inbounds":[]}`), Users: []agent.UserRequest{user}}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if backend.synced == nil || len(backend.synced.Users) != 1 {
+		t.Fatalf("Backend got sync %+v", backend.synced)
+	}
+
+	if err := client.Restart(ctx); err != nil || backend.restarts != 1 {
+		t.Fatalf("Restart = %v, restarts %d", err, backend.restarts)
+	}
+}
+
+func TestServerRejectsWrongSecret(t *testing.T) {
+	backend := &fakeBackend{users: make(map[string]agent.UserRequest)}
+	server := httptest.NewServer(agent.NewServer(backend, "s3cret").Handler())
+	defer server.Close()
+
+	client := agent.NewClient(server.URL, "wrong", 5*time.Second, nil)
+	err := client.SyncUser(context.Background(), agent.UserRequest{UUID: "uuid-1"})
+	if err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Fatalf("Expected unauthorized, got %v", err)
+	}
+	if len(backend.users) != 0 {
+		t.Fatal("Backend must not be called without a valid secret")
+	}
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"vpn-backend/internal/xray"
+)
+
+// Client calls the agent API of one node.
+type Client struct {
+	BaseURL string
+	Secret  string
+	HTTP    *http.Client
+}
+
+// NewClient returns a client for the agent at baseURL. tlsConfig may be nil;
+// it is used for https URLs, e.g. to present a client certificate.
+func NewClient(baseURL, secret string, timeout time.Duration, tlsConfig *tls.Config) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Secret:  secret,
+		HTTP:    &http.Client{Timeout: timeout, Transport: transport},
+	}
+}
+
+// do sends a request and decodes the JSON response into out, if given.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Secret)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("agent %s: %w", c.BaseURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e errorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		return fmt.Errorf("agent %s %s: %s", method, path, e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) SyncUser(ctx context.Context, req UserRequest) error {
+	return c.do(ctx, http.MethodPost, "/v1/users/sync", req, nil)
+}
+
+func (c *Client) RemoveUser(ctx context.Context, req UserRequest) error {
+	return c.do(ctx, http.MethodPost, "/v1/users/remove", req, nil)
+}
+
+// Config returns the Xray config currently on the node.
+func (c *Client) Config(ctx context.Context) ([]byte, error) {
+	var config json.RawMessage
+	if err := c.do(ctx, http.MethodGet, "/v1/config", nil, &config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Sync replaces the node's Xray config and restarts its Xray.
+func (c *Client) Sync(ctx context.Context, req SyncRequest) error {
+	return c.do(ctx, http.MethodPut, "/v1/config", req, nil)
+}
+
+func (c *Client) QueryStats(ctx context.Context, query xray.StatsQuery) ([]xray.Stat, error) {
+	var stats []xray.Stat
+	if err := c.do(ctx, http.MethodPost, "/v1/stats/query", query, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (c *Client) Health(ctx context.Context) (Health, error) {
+	var health Health
+	err := c.do(ctx, http.MethodGet, "/v1/health", nil, &health)
+	return health, err
+}
+
+func (c *Client) Restart(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/v1/restart", nil, nil)
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LimitsHook enforces the per-user limits of UserRequest outside Xray by
+// running an operator-provided command, e.g. a script around tc and
+// iptables. The command is called as
+//
+//	hook set <email> <uuid> <bandwidth bytes/s> <connections>
+//	hook remove <email> <uuid>
+//	hook reset
+//
+// "set" follows every user sync, with 0 for no limit; "remove" follows the
+// removal of the user; "reset" drops all limits before a full sync sets
+// them again. A non-zero exit fails the request.
+type LimitsHook struct {
+	Command string
+	Timeout time.Duration
+}
+
+func NewLimitsHook(command string, timeout time.Duration) *LimitsHook {
+	return &LimitsHook{Command: command, Timeout: timeout}
+}
+
+func (h *LimitsHook) Set(req UserRequest) error {
+	return h.run("set", req.Email, req.UUID, strconv.FormatInt(req.BandwidthLimit, 10), strconv.Itoa(req.ConnectionLimit))
+}
+
+func (h *LimitsHook) Remove(req UserRequest) error {
+	return h.run("remove", req.Email, req.UUID)
+}
+
+func (h *LimitsHook) Reset() error {
+	return h.run("reset")
+}
+
+func (h *LimitsHook) run(args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, h.Command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("limits hook %s: %w: %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package agent_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"vpn-backend/internal/agent"
+)
+
+func TestLimitsHook(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "calls")
+	script := filepath.Join(dir, "hook.sh")
+	err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+logPath+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook := agent.NewLimitsHook(script, 5*time.Second)
+	user := agent.UserRequest{UUID: "uuid-1", Email: "a@example.com", BandwidthLimit: 1 << 20, ConnectionLimit: 3}
+	if err := hook.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.Set(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.Remove(user); err != nil {
+		t.Fatal(err)
+	}
+
+	calls, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "reset\nset a@example.com uuid-1 1048576 3\nremove a@example.com uuid-1\n"
+	if string(calls) != want {
+		t.Fatalf("Expected hook calls\n%s\ngot\n%s", want, calls)
+	}
+
+	failing := agent.NewLimitsHook("false", 5*time.Second)
+	if err := failing.Set(user); err == nil || !strings.Contains(err.Error(), "limits hook set") {
+		t.Fatalf("Expected the hook failure to be reported, got %v", err)
+	}
+}
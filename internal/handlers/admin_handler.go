@@ -2,9 +2,12 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"vpn-backend/internal/middleware"
+	"vpn-backend/internal/models"
 	"vpn-backend/internal/repository"
 	"vpn-backend/internal/utils"
 
@@ -52,3 +55,39 @@ func (h *AdminHandler) BanUser(w http.ResponseWriter, r *http.Request) {
 	}
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "user ban status updated"})
 }
+
+// PUT /admin/users/{id}/role
+func (h *AdminHandler) SetRole(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if !models.ValidRole(body.Role) {
+		utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown role %q", body.Role))
+		return
+	}
+	// Свою роль не меняем, чтобы последний администратор не лишился доступа
+	if userID, ok := middleware.GetUserID(r); ok && userID == id {
+		utils.RespondWithError(w, http.StatusBadRequest, "Cannot change your own role")
+		return
+	}
+
+	if err := h.Repo.SetRole(id, body.Role); err != nil {
+		if errors.Is(err, repository.ErrLastAdmin) {
+			utils.RespondWithError(w, http.StatusConflict, "Cannot remove the last administrator")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update role: %v", err))
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "role updated"})
+}
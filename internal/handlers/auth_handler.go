@@ -52,15 +52,13 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var token string
-	var err error
-
+	// Одного telegram_id недостаточно: его знает кто угодно
 	if data.TelegramID != 0 {
-		token, err = h.Auth.AuthenticateByTelegramID(data.TelegramID)
-	} else {
-		token, err = h.Auth.AuthenticateUser(data.Email, data.Password)
+		utils.RespondWithError(w, http.StatusBadRequest, "Login by telegram_id is not supported, use /login/telegram")
+		return
 	}
 
+	token, err := h.Auth.AuthenticateUser(data.Email, data.Password)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid credentials")
 		return
@@ -16,8 +16,8 @@ func NewConfigHandler(x *services.XrayService) *ConfigHandler {
 }
 
 func (h *ConfigHandler) RegenerateConfig(w http.ResponseWriter, r *http.Request) {
-	if err := h.Xray.RegenerateConfig(); err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to regenerate config: "+err.Error())
+	if err := h.Xray.RegenerateConfig(author(r)); err != nil {
+		utils.RespondWithError(w, configErrorStatus(err), "Failed to regenerate config: "+err.Error())
 		return
 	}
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "config regenerated"})
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/repository"
+	"vpn-backend/internal/services"
+	"vpn-backend/internal/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type HostHandler struct {
+	Repo *repository.HostRepository
+	Xray *services.XrayService
+}
+
+func NewHostHandler(repo *repository.HostRepository, xray *services.XrayService) *HostHandler {
+	return &HostHandler{Repo: repo, Xray: xray}
+}
+
+// validate checks a host before it is saved.
+func (h *HostHandler) validate(host *models.Host) error {
+	if host.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	if host.Port < 0 || host.Port > 65535 {
+		return fmt.Errorf("invalid port %d", host.Port)
+	}
+	switch host.Security {
+	case "", "none", "tls", "reality":
+	default:
+		return fmt.Errorf("unknown security %q", host.Security)
+	}
+	if host.InboundTag == "" {
+		return fmt.Errorf("inbound_tag is required")
+	}
+	return h.Xray.ValidateInboundTags([]string{host.InboundTag})
+}
+
+// GET /admin/hosts
+func (h *HostHandler) GetAllHosts(w http.ResponseWriter, r *http.Request) {
+	hosts, err := h.Repo.GetAll()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get hosts: %v", err))
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, hosts)
+}
+
+// POST /admin/hosts
+func (h *HostHandler) CreateHost(w http.ResponseWriter, r *http.Request) {
+	var host models.Host
+	if err := json.NewDecoder(r.Body).Decode(&host); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	host.ID = 0
+
+	if err := h.validate(&host); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid host: %v", err))
+		return
+	}
+	if err := h.Repo.Create(&host); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create host: %v", err))
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusCreated, host)
+}
+
+// PUT /admin/hosts/{id}
+func (h *HostHandler) UpdateHost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+
+	existing, err := h.Repo.FindByID(id)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Host not found")
+		return
+	}
+
+	var host models.Host
+	if err := json.NewDecoder(r.Body).Decode(&host); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	host.Model = existing.Model
+
+	if err := h.validate(&host); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid host: %v", err))
+		return
+	}
+	if err := h.Repo.Update(&host); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update host: %v", err))
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, host)
+}
+
+// DELETE /admin/hosts/{id}
+func (h *HostHandler) DeleteHost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+
+	if _, err := h.Repo.FindByID(id); err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Host not found")
+		return
+	}
+	if err := h.Repo.Delete(id); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete host: %v", err))
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "host deleted"})
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/repository"
+	"vpn-backend/internal/services"
+	"vpn-backend/internal/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type NodeHandler struct {
+	Repo     *repository.NodeRepository
+	Nodes    *services.NodeService
+	Enforcer *services.QuotaEnforcer
+}
+
+func NewNodeHandler(repo *repository.NodeRepository, nodes *services.NodeService, enforcer *services.QuotaEnforcer) *NodeHandler {
+	return &NodeHandler{Repo: repo, Nodes: nodes, Enforcer: enforcer}
+}
+
+// nodeRequest is the editable part of a node. Secret is write-only.
+type nodeRequest struct {
+	Name     string  `json:"name"`
+	Country  string  `json:"country"`
+	Address  string  `json:"address"`
+	Driver   string  `json:"driver"`
+	APIAddr  string  `json:"api_addr"`
+	Secret   *string `json:"secret"`
+	Capacity int     `json:"capacity"`
+	Enabled  *bool   `json:"enabled"`
+}
+
+func (req nodeRequest) apply(node *models.Node) error {
+	if req.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if req.Capacity < 0 {
+		return fmt.Errorf("capacity must not be negative")
+	}
+	if req.Driver == "" {
+		req.Driver = models.NodeDriverLocal
+	}
+	switch req.Driver {
+	case models.NodeDriverLocal:
+	case models.NodeDriverXrayAPI, models.NodeDriverAgent:
+		if req.APIAddr == "" {
+			return fmt.Errorf("api_addr is required for driver %s", req.Driver)
+		}
+	default:
+		return fmt.Errorf("unknown driver %q", req.Driver)
+	}
+
+	node.Name = req.Name
+	node.Country = req.Country
+	node.Address = req.Address
+	node.Driver = req.Driver
+	node.APIAddr = req.APIAddr
+	node.Capacity = req.Capacity
+	if req.Secret != nil {
+		node.Secret = *req.Secret
+	}
+	if node.Driver == models.NodeDriverAgent && node.Secret == "" {
+		return fmt.Errorf("secret is required for driver %s", node.Driver)
+	}
+	if req.Enabled != nil {
+		node.Enabled = *req.Enabled
+	}
+	return nil
+}
+
+// resync puts every user on the nodes they are now entitled to. It runs in
+// the background, as it touches every user on every node.
+func (h *NodeHandler) resync() {
+	go func() {
+		if err := h.Enforcer.EvaluateAll(); err != nil {
+			log.Printf("Failed to resync users after node change: %v", err)
+		}
+	}()
+}
+
+// GET /admin/nodes
+func (h *NodeHandler) GetAllNodes(w http.ResponseWriter, r *http.Request) {
+	nodes, err := h.Repo.GetAll()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get nodes: %v", err))
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, nodes)
+}
+
+// POST /admin/nodes
+func (h *NodeHandler) CreateNode(w http.ResponseWriter, r *http.Request) {
+	var req nodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	node := models.Node{Enabled: true, Status: models.NodeStatusUnknown}
+	if err := req.apply(&node); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid node: %v", err))
+		return
+	}
+	if err := h.Repo.Create(&node); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create node: %v", err))
+		return
+	}
+
+	h.Nodes.Check(context.Background(), &node)
+	h.resync()
+	utils.RespondWithJSON(w, http.StatusCreated, node)
+}
+
+// PUT /admin/nodes/{id}
+func (h *NodeHandler) UpdateNode(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid node ID")
+		return
+	}
+
+	node, err := h.Repo.FindByID(id)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+
+	var req nodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := req.apply(node); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid node: %v", err))
+		return
+	}
+	if err := h.Repo.Update(node); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update node: %v", err))
+		return
+	}
+
+	h.Nodes.Forget(node.ID)
+	h.Nodes.Check(context.Background(), node)
+	h.resync()
+	utils.RespondWithJSON(w, http.StatusOK, node)
+}
+
+// DELETE /admin/nodes/{id}
+func (h *NodeHandler) DeleteNode(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid node ID")
+		return
+	}
+
+	node, err := h.Repo.FindByID(id)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+	if err := h.Repo.Delete(id); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete node: %v", err))
+		return
+	}
+
+	h.Nodes.Forget(node.ID)
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "node deleted"})
+}
+
+// POST /admin/nodes/{id}/check
+func (h *NodeHandler) CheckNode(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid node ID")
+		return
+	}
+
+	node, err := h.Repo.FindByID(id)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+
+	h.Nodes.Check(r.Context(), node)
+	utils.RespondWithJSON(w, http.StatusOK, node)
+}
+
+// POST /admin/nodes/{id}/sync — полная перезапись конфига ноды
+func (h *NodeHandler) SyncNode(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid node ID")
+		return
+	}
+
+	node, err := h.Repo.FindByID(id)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+
+	if err := h.Enforcer.SyncNode(r.Context(), node); err != nil {
+		utils.RespondWithError(w, http.StatusBadGateway, fmt.Sprintf("Failed to sync node: %v", err))
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "node synced"})
+}
@@ -2,8 +2,10 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"vpn-backend/internal/middleware"
+	"vpn-backend/internal/models"
 	"vpn-backend/internal/services"
 	"vpn-backend/internal/utils"
 
@@ -79,6 +81,7 @@ func (h *PaymentHandler) GetPaymentByID(w http.ResponseWriter, r *http.Request)
 	utils.RespondWithJSON(w, http.StatusOK, payment)
 }
 
+// PUT /user/payments/{id}: пользователь может только отменить свой платёж
 func (h *PaymentHandler) UpdatePaymentStatus(w http.ResponseWriter, r *http.Request) {
 	userID, ok := middleware.GetUserID(r)
 	if !ok {
@@ -96,12 +99,49 @@ func (h *PaymentHandler) UpdatePaymentStatus(w http.ResponseWriter, r *http.Requ
 		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
+	if data.Status != models.PaymentCancelled {
+		utils.RespondWithError(w, http.StatusForbidden, "Payments can only be cancelled")
+		return
+	}
 
-	err := h.PaymentService.UpdatePaymentStatus(userID, paymentID, data.Status)
-	if err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update payment status")
+	if err := h.PaymentService.CancelPayment(userID, paymentID); err != nil {
+		respondPaymentError(w, err)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "payment status updated"})
+}
+
+// PUT /admin/payments/{id}/status: результат оплаты от биллинга
+func (h *PaymentHandler) SetPaymentStatus(w http.ResponseWriter, r *http.Request) {
+	paymentID := mux.Vars(r)["id"]
+
+	var data struct {
+		Status string `json:"status"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := h.PaymentService.SetPaymentStatus(paymentID, data.Status); err != nil {
+		respondPaymentError(w, err)
 		return
 	}
 
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "payment status updated"})
 }
+
+func respondPaymentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrPaymentNotFound):
+		utils.RespondWithError(w, http.StatusNotFound, "Payment not found")
+	case errors.Is(err, services.ErrPaymentNotPending):
+		utils.RespondWithError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, services.ErrInvalidPaymentStatus):
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+	default:
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update payment status")
+	}
+}
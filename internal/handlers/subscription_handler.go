@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"net/http"
+	"vpn-backend/internal/middleware"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/services"
+	"vpn-backend/internal/subscription"
+	"vpn-backend/internal/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type SubscriptionHandler struct {
+	Subscription *services.SubscriptionService
+}
+
+func NewSubscriptionHandler(subscription *services.SubscriptionService) *SubscriptionHandler {
+	return &SubscriptionHandler{Subscription: subscription}
+}
+
+// GET /user/subscription/token
+func (h *SubscriptionHandler) GetToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	user, err := h.Subscription.UserRepo.FindByID(userID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	// Отозванная ссылка не выдается заново сама по себе, только через POST
+	if user.SubscriptionToken == nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Subscription link is not issued")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"url": h.Subscription.URL(*user.SubscriptionToken)})
+}
+
+// POST /user/subscription/token
+func (h *SubscriptionHandler) RotateToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	token, err := h.Subscription.RotateToken(userID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to issue subscription link")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"url": h.Subscription.URL(token)})
+}
+
+// DELETE /user/subscription/token
+func (h *SubscriptionHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := h.Subscription.RevokeToken(userID); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to revoke subscription link")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "subscription link revoked"})
+}
+
+// GET /sub/{token} — публичная ссылка для v2rayNG, Hiddify и других клиентов
+func (h *SubscriptionHandler) GetSubscription(w http.ResponseWriter, r *http.Request) {
+	user, err := h.Subscription.UserByToken(mux.Vars(r)["token"])
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	h.render(w, r, user, "")
+}
+
+// GET /user/subscription
+func (h *SubscriptionHandler) GetOwnSubscription(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+	h.render(w, r, user, "")
+}
+
+// GET /user/hiddify-config — Clash Meta профиль, понимают Hiddify и Clash
+func (h *SubscriptionHandler) GetHiddifyConfig(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+	h.render(w, r, user, subscription.FormatClash)
+}
+
+func (h *SubscriptionHandler) currentUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	user, err := h.Subscription.UserRepo.FindByID(userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+	return user, true
+}
+
+// render writes the subscription in format, or in the format asked for by
+// ?format= or the User-Agent when format is empty.
+func (h *SubscriptionHandler) render(w http.ResponseWriter, r *http.Request, user *models.User, format subscription.Format) {
+	if format == "" {
+		var err error
+		format, err = subscription.Negotiate(r.URL.Query().Get("format"), r.UserAgent())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	doc, err := h.Subscription.Render(user, format)
+	if err != nil {
+		http.Error(w, "Failed to build subscription", http.StatusInternalServerError)
+		return
+	}
+
+	for key, value := range h.Subscription.Headers(user) {
+		w.Header().Set(key, value)
+	}
+	w.Header().Set("Content-Type", doc.ContentType)
+	w.Write(doc.Body)
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/repository"
+	"vpn-backend/internal/services"
+	"vpn-backend/internal/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type TariffHandler struct {
+	Repo     *repository.TariffRepository
+	NodeRepo *repository.NodeRepository
+	Xray     *services.XrayService
+	Enforcer *services.QuotaEnforcer
+}
+
+func NewTariffHandler(repo *repository.TariffRepository, nodeRepo *repository.NodeRepository, xray *services.XrayService, enforcer *services.QuotaEnforcer) *TariffHandler {
+	return &TariffHandler{Repo: repo, NodeRepo: nodeRepo, Xray: xray, Enforcer: enforcer}
+}
+
+func (h *TariffHandler) GetAllTariffs(w http.ResponseWriter, r *http.Request) {
+	tariffs, err := h.Repo.GetAll()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get tariffs: %v", err))
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, tariffs)
+}
+
+// PUT /admin/tariffs/{id}/inbounds
+func (h *TariffHandler) UpdateInboundTags(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid tariff ID")
+		return
+	}
+
+	var body struct {
+		InboundTags []string `json:"inbound_tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	tariff, err := h.Repo.FindByID(id)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Tariff not found")
+		return
+	}
+
+	if err := h.Xray.ValidateInboundTags(body.InboundTags); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid inbound tags: %v", err))
+		return
+	}
+
+	tariff.InboundTags = body.InboundTags
+	if err := h.Repo.Update(tariff); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update tariff: %v", err))
+		return
+	}
+
+	if err := h.Enforcer.EvaluateTariff(id); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update Xray config: %v", err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, tariff)
+}
+
+// PUT /admin/tariffs/{id}/nodes
+func (h *TariffHandler) UpdateNodes(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid tariff ID")
+		return
+	}
+
+	var body struct {
+		NodeIDs []uint `json:"node_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	tariff, err := h.Repo.FindByID(id)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Tariff not found")
+		return
+	}
+
+	if err := h.NodeRepo.SetTariffNodes(tariff, body.NodeIDs); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Failed to update tariff nodes: %v", err))
+		return
+	}
+
+	if err := h.Enforcer.EvaluateTariff(id); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update nodes: %v", err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, tariff)
+}
+
+// PUT /admin/tariffs/{id}/policy
+func (h *TariffHandler) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid tariff ID")
+		return
+	}
+
+	var body struct {
+		XrayLevel         int   `json:"xray_level"`
+		HandshakeTimeout  *int  `json:"handshake_timeout"`
+		ConnIdleTimeout   *int  `json:"conn_idle_timeout"`
+		BufferSize        *int  `json:"buffer_size"`
+		StatsUserUplink   *bool `json:"stats_user_uplink"`
+		StatsUserDownlink *bool `json:"stats_user_downlink"`
+		BandwidthLimit    int64 `json:"bandwidth_limit"`
+		ConnectionLimit   int   `json:"connection_limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	for _, value := range []*int{body.HandshakeTimeout, body.ConnIdleTimeout, body.BufferSize} {
+		if value != nil && *value < 0 {
+			utils.RespondWithError(w, http.StatusBadRequest, "Timeouts and buffer size can't be negative")
+			return
+		}
+	}
+	if body.XrayLevel < 0 || body.BandwidthLimit < 0 || body.ConnectionLimit < 0 {
+		utils.RespondWithError(w, http.StatusBadRequest, "Level, bandwidth and connection limits can't be negative")
+		return
+	}
+	if h.Enforcer.ThrottleLevel >= 0 && body.XrayLevel == h.Enforcer.ThrottleLevel {
+		utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Level %d is reserved for throttled users", body.XrayLevel))
+		return
+	}
+
+	tariffs, err := h.Repo.GetAll()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get tariffs: %v", err))
+		return
+	}
+	var tariff *models.Tariff
+	for i := range tariffs {
+		if int(tariffs[i].ID) == id {
+			tariff = &tariffs[i]
+		}
+	}
+	if tariff == nil {
+		utils.RespondWithError(w, http.StatusNotFound, "Tariff not found")
+		return
+	}
+
+	tariff.XrayLevel = body.XrayLevel
+	tariff.HandshakeTimeout = body.HandshakeTimeout
+	tariff.ConnIdleTimeout = body.ConnIdleTimeout
+	tariff.BufferSize = body.BufferSize
+	tariff.StatsUserUplink = body.StatsUserUplink
+	tariff.StatsUserDownlink = body.StatsUserDownlink
+	tariff.BandwidthLimit = body.BandwidthLimit
+	tariff.ConnectionLimit = body.ConnectionLimit
+	if err := services.CheckPolicyLevels(tariffs); err != nil {
+		utils.RespondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	if err := h.Repo.Update(tariff); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update tariff: %v", err))
+		return
+	}
+	if err := h.Xray.SyncPolicyLevels(tariffs); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update Xray policy: %v", err))
+		return
+	}
+	// Пользователи тарифа переходят на новый уровень
+	if err := h.Enforcer.EvaluateTariff(id); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update Xray config: %v", err))
+		return
+	}
+	go func() {
+		if err := h.Enforcer.SyncAgentNodes(context.Background()); err != nil {
+			log.Printf("Failed to push policy levels to nodes: %v", err)
+		}
+	}()
+
+	utils.RespondWithJSON(w, http.StatusOK, tariff)
+}
@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 	"vpn-backend/internal/middleware"
+	"vpn-backend/internal/models"
 	"vpn-backend/internal/services"
 	"vpn-backend/internal/utils"
+
+	"github.com/gorilla/mux"
 )
 
 type TrafficHandler struct {
@@ -28,11 +34,84 @@ func (h *TrafficHandler) GetTraffic(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	traffic, err := h.Traffic.GetUserTraffic(user.UUID)
+	traffic, err := h.Traffic.GetUserTraffic(user)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to get traffic")
 		return
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, map[string]int64{"traffic": traffic})
+	utils.RespondWithJSON(w, http.StatusOK, map[string]int64{
+		"uplink":   traffic.Uplink,
+		"downlink": traffic.Downlink,
+		"traffic":  traffic.Total(),
+	})
+}
+
+// parseTime accepts RFC 3339 timestamps and plain dates. A plain date is
+// midnight UTC, and since "to" is exclusive, to=2024-05-31 stops before
+// that day: pass the next day to include it.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func (h *TrafficHandler) respondHistory(w http.ResponseWriter, r *http.Request, userID *int) {
+	query := r.URL.Query()
+	from, err := parseTime(query.Get("from"))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid 'from' time")
+		return
+	}
+	to, err := parseTime(query.Get("to"))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid 'to' time")
+		return
+	}
+
+	points, err := h.Traffic.History(userID, from, to, query.Get("bucket"))
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidHistoryQuery) {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to get traffic history")
+		return
+	}
+	if points == nil {
+		points = []models.TrafficPoint{}
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, points)
+}
+
+// GET /user/traffic/history?from=&to=&bucket=hour|day|month
+// Points cover [from, to); to defaults to now, from to a range that depends
+// on the bucket.
+func (h *TrafficHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	h.respondHistory(w, r, &userID)
+}
+
+// GET /admin/users/{id}/traffic/history
+func (h *TrafficHandler) GetUserHistory(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	h.respondHistory(w, r, &userID)
+}
+
+// GET /admin/traffic/history
+func (h *TrafficHandler) GetServerHistory(w http.ResponseWriter, r *http.Request) {
+	h.respondHistory(w, r, nil)
 }
@@ -2,16 +2,26 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 	"vpn-backend/internal/middleware"
+	"vpn-backend/internal/models"
 	"vpn-backend/internal/services"
+	"vpn-backend/internal/telegram"
 	"vpn-backend/internal/utils"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Новые пользователи получают базовый тариф и трафик
+const (
+	baseTariffID = 1        // Базовый тариф
+	baseTraffic  = 10485760 // 10 МБ в байтах
 )
 
 type UserHandler struct {
@@ -19,6 +29,7 @@ type UserHandler struct {
 	Payment *services.PaymentService
 	Xray    *services.XrayService
 	Traffic *services.TrafficService
+	Nodes   *services.NodeService
 }
 
 func NewUserHandler(auth *services.AuthService, payment *services.PaymentService, xray *services.XrayService, traffic *services.TrafficService) *UserHandler {
@@ -42,8 +53,6 @@ func (h *UserHandler) Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	uuidStr := uuid.New().String()
-	const baseTariffID = 1       // Базовый тариф
-	const baseTraffic = 10485760 // 10 МБ в байтах
 
 	user, err := h.Auth.Register(data.Email, data.Password, uuidStr, baseTariffID)
 	if err != nil {
@@ -55,29 +64,50 @@ func (h *UserHandler) Register(w http.ResponseWriter, r *http.Request) {
 	_ = h.Auth.UserRepo.UpdateUserTariff(int(user.ID), baseTariffID)
 	_ = h.Auth.UserRepo.UpdateUsedTraffic(int(user.ID), baseTraffic)
 
-	// Добавление пользователя в конфигурацию Xray
-	if err := h.Xray.AddUserToConfig(user); err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update Xray config")
+	// В Xray пользователь попадёт после подтверждения email (VerifyEmail)
+	utils.RespondWithJSON(w, http.StatusCreated, user)
+}
+
+// GET /email/verify?token=
+func (h *UserHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := h.Auth.VerifyEmail(r.URL.Query().Get("token"))
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidVerifyToken) {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to verify email")
 		return
 	}
 
-	// Перезапуск Xray
-	h.Xray.ScheduleRestart()
+	// Добавление пользователя на все ноды тарифа (применяется на лету через API)
+	if user.CanConnect() {
+		if err := h.Nodes.ProvisionUser(user, user.Tariff.XrayLevel); err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update Xray config")
+			return
+		}
+	}
 
-	// --- ДОБАВЛЕНИЕ В ОБЩИЙ subscription.txt ---
-	subLine := fmt.Sprintf(
-		"vless://%s@193.124.182.210:10000?encryption=none&security=tls&type=ws&path=%%2F#VPNClient\n",
-		user.UUID,
-	)
-	subFilePath := "/path/to/subscription.txt" // Укажите тот же путь, что и в main.go
-	f, err := os.OpenFile(subFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err == nil {
-		_, _ = f.WriteString(subLine)
-		f.Close()
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "email verified"})
+}
+
+// POST /email/resend
+func (h *UserHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email string `json:"email"`
 	}
-	// --- КОНЕЦ ДОБАВЛЕНИЯ ---
 
-	utils.RespondWithJSON(w, http.StatusCreated, user)
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Email == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := h.Auth.ResendVerification(data.Email); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to send verification email")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "if the account is awaiting confirmation, a new link has been sent"})
 }
 
 func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
@@ -92,15 +122,13 @@ func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var token string
-	var err error
-
+	// Одного telegram_id недостаточно: его знает кто угодно
 	if data.TelegramID != 0 {
-		token, err = h.Auth.AuthenticateByTelegramID(data.TelegramID)
-	} else {
-		token, err = h.Auth.AuthenticateUser(data.Email, data.Password)
+		utils.RespondWithError(w, http.StatusBadRequest, "Login by telegram_id is not supported, use /login/telegram")
+		return
 	}
 
+	token, err := h.Auth.AuthenticateUser(data.Email, data.Password)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid credentials")
 		return
@@ -109,39 +137,181 @@ func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"token": token})
 }
 
-func (h *UserHandler) ChangeTariff(w http.ResponseWriter, r *http.Request) {
+// readTelegram verifies the Telegram data in the request body: the object
+// the Login Widget passes to its callback, or {"init_data": ...} from a
+// Mini App. On failure it writes the response and returns false.
+func (h *UserHandler) readTelegram(w http.ResponseWriter, r *http.Request) (*telegram.User, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return nil, false
+	}
+	fields, err := telegram.WidgetFields(body)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return nil, false
+	}
+
+	tgUser, err := h.Auth.VerifyTelegram(fields)
+	if err != nil {
+		respondTelegramError(w, err)
+		return nil, false
+	}
+	return tgUser, true
+}
+
+// POST /login/telegram, POST /login/telegram/webapp
+func (h *UserHandler) TelegramLogin(w http.ResponseWriter, r *http.Request) {
+	tgUser, ok := h.readTelegram(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := h.Auth.AuthenticateTelegram(tgUser)
+	if err != nil {
+		respondTelegramError(w, err)
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+// POST /register/telegram
+// Регистрация только через Telegram: адрес-заглушка, без пароля.
+func (h *UserHandler) TelegramRegister(w http.ResponseWriter, r *http.Request) {
+	tgUser, ok := h.readTelegram(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := h.Auth.RegisterTelegram(tgUser, uuid.New().String(), baseTariffID)
+	if err != nil {
+		if errors.Is(err, services.ErrTelegramLinked) {
+			utils.RespondWithError(w, http.StatusConflict, "Telegram account is already registered, log in instead")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, "Registration failed")
+		return
+	}
+	_ = h.Auth.UserRepo.UpdateUsedTraffic(int(user.ID), baseTraffic)
+
+	// Перечитываем пользователя вместе с тарифом: от него зависит набор inbound'ов
+	if fullUser, err := h.Auth.UserRepo.FindByID(int(user.ID)); err == nil {
+		user = fullUser
+	}
+
+	// Telegram уже подтвердил владельца, поэтому пользователь сразу попадает в Xray
+	if err := h.Nodes.ProvisionUser(user, user.Tariff.XrayLevel); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update Xray config")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusCreated, user)
+}
+
+// GET /user/telegram
+func (h *UserHandler) GetTelegramIdentities(w http.ResponseWriter, r *http.Request) {
 	userID, ok := middleware.GetUserID(r)
 	if !ok {
 		utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	var data struct {
-		TariffID int `json:"tariff_id"`
+	identities, err := h.Auth.TelegramIdentities(userID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to get Telegram accounts")
+		return
 	}
+	utils.RespondWithJSON(w, http.StatusOK, identities)
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+// POST /user/telegram
+func (h *UserHandler) LinkTelegram(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	tgUser, ok := h.readTelegram(w, r)
+	if !ok {
 		return
 	}
 
-	if err := h.Payment.ChangeTariff(userID, data.TariffID); err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to change tariff")
+	identity, err := h.Auth.LinkTelegram(userID, tgUser)
+	if err != nil {
+		if errors.Is(err, services.ErrTelegramLinked) {
+			utils.RespondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to link Telegram account")
 		return
 	}
+	utils.RespondWithJSON(w, http.StatusOK, identity)
+}
 
-	user, err := h.Auth.UserRepo.FindByID(userID)
+// DELETE /user/telegram/{telegram_id}
+func (h *UserHandler) UnlinkTelegram(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	telegramID, err := strconv.ParseInt(mux.Vars(r)["telegram_id"], 10, 64)
 	if err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to find user")
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid Telegram ID")
 		return
 	}
 
-	if err := h.Xray.UpdateUserTariff(user.UUID, data.TariffID); err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update Xray config")
+	if err := h.Auth.UnlinkTelegram(userID, telegramID); err != nil {
+		switch {
+		case errors.Is(err, services.ErrLastSignInMethod):
+			utils.RespondWithError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, services.ErrTelegramNotLinked):
+			utils.RespondWithError(w, http.StatusNotFound, "Telegram account not linked")
+		default:
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to unlink Telegram account")
+		}
 		return
 	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "telegram account unlinked"})
+}
 
-	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "tariff changed"})
+func respondTelegramError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrTelegramDisabled):
+		utils.RespondWithError(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, telegram.ErrInvalidAuth), errors.Is(err, telegram.ErrAuthExpired):
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+	default:
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid credentials")
+	}
+}
+
+// ChangeTariff orders a tariff: the response is the pending payment, and
+// the tariff takes effect once billing completes it.
+func (h *UserHandler) ChangeTariff(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var data struct {
+		TariffID      int    `json:"tariff_id"`
+		PaymentMethod string `json:"payment_method"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	payment, err := h.Payment.ChangeTariff(userID, data.TariffID, data.PaymentMethod)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to change tariff")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusAccepted, payment)
 }
 
 func (h *UserHandler) UpgradeTariff(w http.ResponseWriter, r *http.Request) {
@@ -157,11 +327,11 @@ func (h *UserHandler) UpgradeTariff(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	if err := h.Payment.ChangeTariff(userID, data.TariffID); err != nil {
+	if _, err := h.Payment.ChangeTariff(userID, data.TariffID, ""); err != nil {
 		http.Error(w, "Failed to change tariff", http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(http.StatusAccepted)
 }
 
 func (h *UserHandler) GetMe(w http.ResponseWriter, r *http.Request) {
@@ -177,11 +347,8 @@ func (h *UserHandler) GetMe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	traffic, err := h.Traffic.GetUserTraffic(user.UUID)
-	if err != nil {
-		// Если не удалось получить трафик — возвращаем 0 вместо ошибки
-		traffic = 0
-	}
+	// Если не удалось получить трафик — возвращаем 0 вместо ошибки
+	traffic, _ := h.Traffic.GetUserTraffic(user)
 
 	expiry, err := h.Payment.GetTariffExpiry(userID)
 	if err != nil {
@@ -189,20 +356,41 @@ func (h *UserHandler) GetMe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// История ограничений доступа: почему VPN был отключён или снова включён
+	accessHistory, err := h.Auth.UserRepo.GetAccessEvents(userID, 10)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to get access history")
+		return
+	}
+
 	resp := struct {
-		ID        int       `json:"id"`
-		Email     string    `json:"email"`
-		UUID      string    `json:"uuid"`
-		TariffID  int       `json:"tariff_id"`
-		Traffic   int64     `json:"traffic"`
-		ExpiresAt time.Time `json:"expires_at"`
+		ID            int                  `json:"id"`
+		Email         string               `json:"email"`
+		EmailStatus   string               `json:"email_status"`
+		Role          string               `json:"role"`
+		UUID          string               `json:"uuid"`
+		TariffID      int                  `json:"tariff_id"`
+		Traffic       int64                `json:"traffic"`
+		UsedTraffic   int64                `json:"used_traffic"`
+		TrafficLimit  int64                `json:"traffic_limit"`
+		ExpiresAt     time.Time            `json:"expires_at"`
+		AccessState   string               `json:"access_state"`
+		AccessReason  string               `json:"access_reason"`
+		AccessHistory []models.AccessEvent `json:"access_history"`
 	}{
-		ID:        int(user.ID),
-		Email:     user.Email,
-		UUID:      user.UUID,
-		TariffID:  user.TariffID,
-		Traffic:   traffic,
-		ExpiresAt: expiry,
+		ID:            int(user.ID),
+		Email:         user.Email,
+		EmailStatus:   user.EmailStatus,
+		Role:          user.Role,
+		UUID:          user.UUID,
+		TariffID:      user.TariffID,
+		Traffic:       traffic.Total(),
+		UsedTraffic:   user.UsedTraffic,
+		TrafficLimit:  user.Tariff.TrafficLimit,
+		ExpiresAt:     expiry,
+		AccessState:   user.AccessState,
+		AccessReason:  user.AccessReason,
+		AccessHistory: accessHistory,
 	}
 
 	utils.RespondWithJSON(w, http.StatusOK, resp)
@@ -229,7 +417,7 @@ func (h *UserHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.Xray.RemoveUserFromConfig(user.UUID); err != nil {
+	if err := h.Nodes.DeprovisionUser(user); err != nil {
 		tx.Rollback()
 		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to update Xray config")
 		return
@@ -241,169 +429,66 @@ func (h *UserHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := h.Auth.TelegramRepo.UnlinkAll(userID); err != nil {
+		tx.Rollback()
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to unlink Telegram accounts")
+		return
+	}
+
 	tx.Commit()
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "account deleted"})
 }
 
-// New method to handle password reset request
+// POST /password-reset/request
+// Ответ одинаковый для существующих и неизвестных адресов.
 func (h *UserHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email string `json:"email"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Email == "" {
 		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	// TODO: Implement password reset request logic (e.g., send email with reset link)
-	// For now, just return a success message
-	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "password reset initiated"})
-}
-
-func (h *UserHandler) CheckToken(w http.ResponseWriter, r *http.Request) {
-	userID, ok := middleware.GetUserID(r)
-	if !ok {
-		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid token")
+	if err := h.Auth.RequestPasswordReset(data.Email); err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to request password reset")
 		return
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, map[string]int{"user_id": userID})
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "if the account exists, a reset link has been sent"})
 }
 
-func (h *UserHandler) GetSubscription(w http.ResponseWriter, r *http.Request) {
-	userID, ok := middleware.GetUserID(r)
-	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+// POST /password-reset/confirm
+func (h *UserHandler) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Token == "" || data.Password == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
-	user, err := h.Auth.UserRepo.FindByID(userID)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+
+	if err := h.Auth.ResetPassword(data.Token, data.Password); err != nil {
+		if errors.Is(err, services.ErrInvalidResetToken) {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to reset password")
 		return
 	}
-	// Формируем строку подписки для пользователя
-	sub := fmt.Sprintf(
-		"vless://%s@193.124.182.210:10000?encryption=none&security=tls&type=ws&path=%%2F#VPNClient",
-		user.UUID,
-	)
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(sub))
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "password changed"})
 }
 
-func (h *UserHandler) GetHiddifyConfig(w http.ResponseWriter, r *http.Request) {
+func (h *UserHandler) CheckToken(w http.ResponseWriter, r *http.Request) {
 	userID, ok := middleware.GetUserID(r)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		utils.RespondWithError(w, http.StatusUnauthorized, "Invalid token")
 		return
 	}
-	user, err := h.Auth.UserRepo.FindByID(userID)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	}
-	// Генерируем полноценный YAML-конфиг для Clash/Hiddify Core (VLESS через WS+TLS)
-	yaml := fmt.Sprintf(`
-port: 7890
-socks-port: 7891
-allow-lan: true
-mode: rule
-log-level: info
-external-controller: 127.0.0.1:9090
-
-proxies:
-  - name: "%s"
-    type: vless
-    server: 193.124.182.210
-    port: 10000
-    uuid: %s
-    network: ws
-    tls: true
-    ws-opts:
-      path: /
-
-proxy-groups:
-  - name: "auto"
-    type: select
-    proxies:
-      - "%s"
-
-rules:
-  - MATCH,auto
-
-tun:
-  enable: true
-  stack: system
-  auto-route: true
-  auto-detect-interface: true
-`, user.Email, user.UUID, user.Email)
-	w.Header().Set("Content-Type", "text/yaml")
-	w.Write([]byte(yaml))
-}
-
-func GenerateSubscriptionFile(configPath, outputPath string) error {
-	// Структуры для парсинга только нужных частей
-	type Client struct {
-		Email string `json:"email"`
-		ID    string `json:"id"`
-	}
-	type Inbound struct {
-		Port     int    `json:"port"`
-		Protocol string `json:"protocol"`
-		Settings struct {
-			Clients []Client `json:"clients"`
-		} `json:"settings"`
-		StreamSettings struct {
-			Network    string `json:"network"`
-			Security   string `json:"security"`
-			WsSettings struct {
-				Path string `json:"path"`
-			} `json:"wsSettings"`
-		} `json:"streamSettings"`
-	}
-	type Config struct {
-		Inbounds []Inbound `json:"inbounds"`
-	}
-
-	// Читаем config.json
-	data, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		return err
-	}
-	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return err
-	}
-
-	// Ищем inbound с protocol == "vless"
-	var vlessInbound *Inbound
-	for _, inb := range cfg.Inbounds {
-		if inb.Protocol == "vless" {
-			vlessInbound = &inb
-			break
-		}
-	}
-	if vlessInbound == nil {
-		return fmt.Errorf("no vless inbound found")
-	}
 
-	// Формируем строки подписки
-	host := "193.124.182.210"
-	port := vlessInbound.Port
-	network := vlessInbound.StreamSettings.Network
-	security := vlessInbound.StreamSettings.Security
-	path := vlessInbound.StreamSettings.WsSettings.Path
-	if path == "" {
-		path = "/"
-	}
-	subLines := ""
-	for _, client := range vlessInbound.Settings.Clients {
-		subLines += fmt.Sprintf(
-			"vless://%s@%s:%d?encryption=none&security=%s&type=%s&path=%%2F#%s\n",
-			client.ID, host, port, security, network, client.Email,
-		)
-	}
-
-	// Записываем в subscription.txt
-	return ioutil.WriteFile(outputPath, []byte(subLines), 0644)
+	utils.RespondWithJSON(w, http.StatusOK, map[string]int{"user_id": userID})
 }
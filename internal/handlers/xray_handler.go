@@ -1,23 +1,38 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"vpn-backend/internal/middleware"
 	"vpn-backend/internal/services"
 	"vpn-backend/internal/utils"
+	"vpn-backend/internal/xray"
+
+	"github.com/gorilla/mux"
 )
 
 type XrayHandler struct {
-	Service *services.XrayService
+	Service    *services.XrayService
+	Reconciler *services.Reconciler
 }
 
 func NewXrayHandler(s *services.XrayService) *XrayHandler {
 	return &XrayHandler{Service: s}
 }
 
+// author names the administrator behind a config change in its history.
+func author(r *http.Request) string {
+	if userID, ok := middleware.GetUserID(r); ok {
+		return fmt.Sprintf("user %d", userID)
+	}
+	return "admin"
+}
+
 func (h *XrayHandler) ReloadConfig(w http.ResponseWriter, r *http.Request) {
-	if err := h.Service.RegenerateConfig(); err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Config reload failed: %v", err))
+	if err := h.Service.RegenerateConfig(author(r)); err != nil {
+		utils.RespondWithError(w, configErrorStatus(err), fmt.Sprintf("Config reload failed: %v", err))
 		return
 	}
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "config reloaded"})
@@ -30,3 +45,109 @@ func (h *XrayHandler) Restart(w http.ResponseWriter, r *http.Request) {
 	}
 	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "xray restarted"})
 }
+
+// GET /xray/status
+func (h *XrayHandler) Status(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{}
+	if process, err := h.Service.XrayStatus(r.Context()); err != nil {
+		response["process_error"] = err.Error()
+	} else {
+		response["process"] = process
+	}
+	if h.Service.Restarts != nil {
+		response["restarts"] = h.Service.Restarts.Status()
+	}
+	utils.RespondWithJSON(w, http.StatusOK, response)
+}
+
+// GetDrift shows what the reconciler would change on each node.
+func (h *XrayHandler) GetDrift(w http.ResponseWriter, r *http.Request) {
+	drifts, err := h.Reconciler.Plan(r.Context())
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Drift check failed: %v", err))
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, drifts)
+}
+
+// Reconcile fixes the drift right away instead of waiting for the next run.
+func (h *XrayHandler) Reconcile(w http.ResponseWriter, r *http.Request) {
+	drifts, err := h.Reconciler.Reconcile(r.Context())
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Reconciliation failed: %v", err))
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, drifts)
+}
+
+// GET /admin/xray/configs
+func (h *XrayHandler) GetConfigVersions(w http.ResponseWriter, r *http.Request) {
+	versions, err := h.Service.ConfigVersions()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to list config versions: %v", err))
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, versions)
+}
+
+// configErrorStatus maps a config that failed validation to 422 and a
+// missing version to 404.
+func configErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, xray.ErrInvalidConfig):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, xray.ErrSnapshotNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func respondVersionError(w http.ResponseWriter, err error) {
+	utils.RespondWithError(w, configErrorStatus(err), err.Error())
+}
+
+// GET /admin/xray/configs/{version}
+func (h *XrayHandler) GetConfigVersion(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid version")
+		return
+	}
+	snapshot, err := h.Service.ConfigVersion(version)
+	if err != nil {
+		respondVersionError(w, err)
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, snapshot)
+}
+
+// GET /admin/xray/configs/diff?from=1&to=2
+func (h *XrayHandler) DiffConfigVersions(w http.ResponseWriter, r *http.Request) {
+	from, errFrom := strconv.Atoi(r.URL.Query().Get("from"))
+	to, errTo := strconv.Atoi(r.URL.Query().Get("to"))
+	if errFrom != nil || errTo != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "from and to must be config versions")
+		return
+	}
+	diff, err := h.Service.DiffConfigVersions(from, to)
+	if err != nil {
+		respondVersionError(w, err)
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, diff)
+}
+
+// POST /admin/xray/configs/{version}/rollback
+func (h *XrayHandler) RollbackConfig(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Invalid version")
+		return
+	}
+	if _, err := h.Service.Rollback(version, author(r)); err != nil {
+		respondVersionError(w, err)
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"status": "config rolled back", "version": version})
+}
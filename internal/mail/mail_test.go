@@ -0,0 +1,48 @@
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailerWritesMessage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer := NewFileMailer(dir, "noreply@example.com")
+
+	msg := Message{To: "user@example.com", Subject: "Сброс пароля", Body: "line 1\nline 2"}
+	if err := mailer.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 messages, got %v, %v", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	for _, want := range []string{
+		"From: noreply@example.com\r\n",
+		"To: user@example.com\r\n",
+		"Subject: =?utf-8?q?",
+		"\r\n\r\nline 1\r\nline 2",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %q in message:\n%s", want, text)
+		}
+	}
+}
+
+func TestSendRejectsHeaderInjection(t *testing.T) {
+	mailer := NewFileMailer(t.TempDir(), "noreply@example.com")
+	if err := mailer.Send(Message{To: "user@example.com\r\nBcc: other@example.com"}); err == nil {
+		t.Error("Expected a recipient with a line break to be rejected")
+	}
+}
@@ -11,10 +11,19 @@ import (
 
 type contextKey string
 
-const UserIDKey = contextKey("userID")
+const (
+	UserIDKey      = contextKey("userID")
+	RoleKey        = contextKey("role")
+	PermissionsKey = contextKey("permissions")
+)
+
+// TokenVersionFunc returns the user's current token version; tokens issued
+// with another version, e.g. before a password change, are rejected.
+type TokenVersionFunc func(userID int) (int, error)
 
 // AuthMiddleware аутентифицирует пользователя по JWT токену.
-func AuthMiddleware(jwtSecret string) func(http.Handler) http.Handler {
+// versions may be nil, then the token version is not checked.
+func AuthMiddleware(jwtSecret string, versions TokenVersionFunc) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
@@ -52,9 +61,31 @@ func AuthMiddleware(jwtSecret string) func(http.Handler) http.Handler {
 				return
 			}
 
-			// Добавляем user_id в контекст
 			userID := int(userIDFloat)
+
+			// Токены, выданные до смены пароля, больше не действуют
+			if versions != nil {
+				tokenVersion, _ := claims["tv"].(float64) // нет в старых токенах — версия 0
+				current, err := versions(userID)
+				if err != nil || int(tokenVersion) != current {
+					http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
+					return
+				}
+			}
+
+			// Добавляем user_id, роль и права в контекст
+			role, _ := claims["role"].(string)
+			var permissions []string
+			if list, ok := claims["perms"].([]interface{}); ok {
+				for _, item := range list {
+					if permission, ok := item.(string); ok {
+						permissions = append(permissions, permission)
+					}
+				}
+			}
 			ctx := context.WithValue(r.Context(), UserIDKey, userID)
+			ctx = context.WithValue(ctx, RoleKey, role)
+			ctx = context.WithValue(ctx, PermissionsKey, permissions)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
@@ -66,23 +97,30 @@ func GetUserID(r *http.Request) (int, bool) {
 	return userID, ok
 }
 
-// AdminOnlyMiddleware проверяет, является ли пользователь администратором.
-func AdminOnlyMiddleware(adminToken string) func(http.Handler) http.Handler {
+// HasPermission reports whether the token of the request grants permission.
+func HasPermission(r *http.Request, permission string) bool {
+	permissions, _ := r.Context().Value(PermissionsKey).([]string)
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission пропускает запрос, только если в JWT есть право permission.
+// Должен стоять после AuthMiddleware.
+func RequirePermission(permission string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			if _, ok := GetUserID(r); !ok {
+				http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
 				return
 			}
-
-			tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
-
-			if tokenString != adminToken {
-				http.Error(w, "Forbidden", http.StatusForbidden)
+			if !HasPermission(r, permission) {
+				http.Error(w, `{"error":"Forbidden"}`, http.StatusForbidden)
 				return
 			}
-
 			next.ServeHTTP(w, r)
 		})
 	}
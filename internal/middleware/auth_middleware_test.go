@@ -0,0 +1,60 @@
+package middleware_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"vpn-backend/internal/middleware"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/services"
+)
+
+func TestRequirePermission(t *testing.T) {
+	const secret = "test-secret"
+	auth := services.NewAuthService(nil, secret)
+	versions := map[int]int{1: 0, 2: 0, 3: 1}
+	tokenVersion := func(userID int) (int, error) {
+		version, ok := versions[userID]
+		if !ok {
+			return 0, fmt.Errorf("user not found")
+		}
+		return version, nil
+	}
+
+	handler := middleware.AuthMiddleware(secret, tokenVersion)(
+		middleware.RequirePermission(models.PermUsersWrite)(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })))
+
+	token := func(id uint, role string, version int) string {
+		user := &models.User{Role: role, TokenVersion: version}
+		user.ID = id
+		token, err := auth.GenerateJWT(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"support may ban", token(1, models.RoleSupport, 0), http.StatusOK},
+		{"read-only may not", token(2, models.RoleReadOnly, 0), http.StatusForbidden},
+		{"plain user may not", token(2, "", 0), http.StatusForbidden},
+		{"token from before a password or role change", token(3, models.RoleAdmin, 0), http.StatusUnauthorized},
+		{"no token", "", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("POST", "/admin/ban/5", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, rr.Code)
+		}
+	}
+}
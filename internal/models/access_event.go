@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// Состояния доступа пользователя к VPN
+const (
+	AccessActive    = "active"
+	AccessSuspended = "suspended" // удалён из Xray
+	AccessThrottled = "throttled" // переведён на ограниченный уровень Xray
+)
+
+// AccessEvent records a change of a user's access state and why it happened.
+type AccessEvent struct {
+	ID        int       `gorm:"primaryKey" json:"id"`
+	UserID    int       `gorm:"index" json:"user_id"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
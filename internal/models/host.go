@@ -0,0 +1,28 @@
+package models
+
+import (
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// Host is an address clients dial to reach an inbound, e.g. the server
+// itself or a CDN front domain. Empty fields fall back to the inbound's own
+// settings.
+type Host struct {
+	gorm.Model
+	InboundTag  string         `gorm:"index;not null" json:"inbound_tag"`
+	NodeID      *uint          `gorm:"index" json:"node_id"` // nil — локальный Xray
+	Remark      string         `json:"remark"`
+	Address     string         `gorm:"not null" json:"address"`
+	Port        int            `json:"port"` // 0 — порт inbound'а
+	SNI         string         `json:"sni"`
+	HostHeader  string         `json:"host_header"`
+	Path        string         `json:"path"`
+	Security    string         `json:"security"` // "", "none", "tls", "reality"
+	ALPN        pq.StringArray `gorm:"type:text[]" json:"alpn"`
+	Fingerprint string         `json:"fingerprint"`
+	// Ключи REALITY, если на ноде они не такие, как в локальном конфиге
+	PublicKey string `json:"public_key"`
+	ShortID   string `json:"short_id"`
+	Disabled  bool   `json:"disabled"`
+}
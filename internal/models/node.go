@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Способы управления Xray на ноде
+const (
+	NodeDriverLocal   = "local"    // Xray на этом же сервере, через XrayService
+	NodeDriverXrayAPI = "xray-api" // удаленный Xray, напрямую через его gRPC API
+	NodeDriverAgent   = "agent"    // удаленный сервер с cmd/node-agent
+)
+
+// Состояния ноды по последней проверке
+const (
+	NodeStatusUnknown = "unknown"
+	NodeStatusOnline  = "online"
+	NodeStatusOffline = "offline"
+)
+
+// Node is an Xray server users can be provisioned on.
+type Node struct {
+	gorm.Model
+	Name    string `gorm:"uniqueIndex;not null" json:"name"`
+	Country string `json:"country"`
+	// Address is what clients dial when the node has no hosts of its own.
+	Address string `json:"address"`
+	Driver  string `gorm:"default:local" json:"driver"`
+	// APIAddr is the node's control endpoint: the Xray API host:port or the
+	// agent URL.
+	APIAddr string `json:"api_addr"`
+	// Secret authenticates the backend to the node, for drivers that need it.
+	Secret string `json:"-"`
+	// Capacity is the number of users the node takes, in order of
+	// registration; 0 — no limit.
+	Capacity int `json:"capacity"`
+	// Без default: gorm не записал бы false при создании
+	Enabled bool `json:"enabled"`
+
+	Status     string     `gorm:"default:unknown" json:"status"`
+	LastError  string     `json:"last_error"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+}
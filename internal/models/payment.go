@@ -2,6 +2,15 @@ package models
 
 import "time"
 
+// Статусы платежа. Завершённым платёж отмечает только биллинг или
+// платёжный провайдер, пользователь может лишь отменить свой.
+const (
+	PaymentPending   = "pending"
+	PaymentCompleted = "completed"
+	PaymentFailed    = "failed"
+	PaymentCancelled = "cancelled"
+)
+
 type Payment struct {
 	ID            int       `gorm:"primaryKey" json:"id"`
 	UserID        int       `json:"user_id"`
@@ -0,0 +1,49 @@
+package models
+
+// Роли пользователей. Обычные пользователи не имеют прав в /admin и /xray.
+const (
+	RoleUser     = "user"
+	RoleAdmin    = "admin"
+	RoleSupport  = "support"
+	RoleBilling  = "billing"
+	RoleReadOnly = "readonly"
+)
+
+// Права, которые проверяются на маршрутах
+const (
+	PermUsersRead     = "users:read"
+	PermUsersWrite    = "users:write" // бан и разбан
+	PermRolesWrite    = "roles:write"
+	PermTrafficRead   = "traffic:read"
+	PermTariffsRead   = "tariffs:read"
+	PermTariffsWrite  = "tariffs:write"
+	PermPaymentsWrite = "payments:write" // отметка платежа оплаченным
+	PermNodesRead     = "nodes:read"     // ноды и хосты
+	PermNodesWrite    = "nodes:write"
+	PermXrayRead      = "xray:read"
+	PermXrayWrite     = "xray:write" // перезапуск, перегенерация и откат конфига
+)
+
+// RolePermissions lists what each role may do.
+var RolePermissions = map[string][]string{
+	RoleUser: {},
+	RoleAdmin: {
+		PermUsersRead, PermUsersWrite, PermRolesWrite, PermTrafficRead, PermTariffsRead, PermTariffsWrite,
+		PermPaymentsWrite, PermNodesRead, PermNodesWrite, PermXrayRead, PermXrayWrite,
+	},
+	RoleSupport: {
+		PermUsersRead, PermUsersWrite, PermTrafficRead, PermTariffsRead, PermNodesRead, PermXrayRead,
+	},
+	RoleBilling: {
+		PermUsersRead, PermTrafficRead, PermTariffsRead, PermTariffsWrite, PermPaymentsWrite,
+	},
+	RoleReadOnly: {
+		PermUsersRead, PermTrafficRead, PermTariffsRead, PermNodesRead, PermXrayRead,
+	},
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
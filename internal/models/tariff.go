@@ -1,11 +1,31 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
 
 type Tariff struct {
 	gorm.Model
 	Name         string
 	Description  string
 	Price        float64
-	TrafficLimit int64 // in bytes
+	TrafficLimit int64          // in bytes
+	InboundTags  pq.StringArray `gorm:"type:text[]"`            // Xray inbound'ы тарифа; пусто — набор по умолчанию
+	Nodes        []Node         `gorm:"many2many:tariff_nodes"` // ноды тарифа; пусто — все включенные
+
+	// Политика Xray для клиентов тарифа: policy.levels[XrayLevel]. Тарифы с
+	// одним уровнем должны иметь одинаковую политику.
+	XrayLevel        int
+	HandshakeTimeout *int // секунды; nil — значение Xray по умолчанию
+	ConnIdleTimeout  *int // секунды
+	BufferSize       *int // КБ на соединение
+	// Статистика по пользователю; nil — включена, без нее не считается трафик
+	StatsUserUplink   *bool
+	StatsUserDownlink *bool
+	// Ограничения, которых нет в Xray: их получает node-agent вместе с
+	// пользователем и применяет через свой hook (agent.LimitsHook). На
+	// нодах без агента они не действуют. 0 — без ограничения.
+	BandwidthLimit  int64 // байт в секунду
+	ConnectionLimit int   // одновременных соединений
 }
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// TelegramIdentity links a Telegram account to a user. A Telegram account
+// belongs to at most one user.
+type TelegramIdentity struct {
+	ID         int       `gorm:"primaryKey" json:"id"`
+	UserID     int       `gorm:"index" json:"user_id"`
+	TelegramID int64     `gorm:"uniqueIndex" json:"telegram_id"`
+	Username   string    `json:"username"`
+	FirstName  string    `json:"first_name"`
+	LastName   string    `json:"last_name"`
+	PhotoURL   string    `json:"photo_url"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
@@ -2,9 +2,18 @@ package models
 
 import "time"
 
+// TrafficLog is the traffic a user made between two collector runs.
 type TrafficLog struct {
-	ID        int       `json:"id"`
-	UserID    int       `json:"user_id"`
-	UsedMB    int64     `json:"used_mb"`   // Использовано мегабайт
-	Timestamp time.Time `json:"timestamp"` // Время логирования
+	ID        int       `gorm:"primaryKey" json:"id"`
+	UserID    int       `gorm:"index" json:"user_id"`
+	Uplink    int64     `json:"uplink"`                 // Отправлено байт
+	Downlink  int64     `json:"downlink"`               // Получено байт
+	Timestamp time.Time `gorm:"index" json:"timestamp"` // Время логирования
+}
+
+// TrafficPoint is the traffic summed over one time bucket.
+type TrafficPoint struct {
+	Time     time.Time `json:"time"`
+	Uplink   int64     `json:"uplink"`
+	Downlink int64     `json:"downlink"`
 }
@@ -6,6 +6,13 @@ import (
 	"gorm.io/gorm"
 )
 
+// Состояния адреса электронной почты
+const (
+	EmailPending  = "pending" // ждёт подтверждения, в Xray не добавляется
+	EmailVerified = "verified"
+	EmailNone     = "none" // аккаунт создан через Telegram, адрес-заглушка
+)
+
 type User struct {
 	gorm.Model
 	Email           string    `gorm:"uniqueIndex" json:"email"`
@@ -14,8 +21,28 @@ type User struct {
 	TariffID        int       `json:"tariff_id"`               // ID тарифа
 	CreatedAt       time.Time `json:"created_at"`
 	IsBanned        bool      `json:"is_banned"`
-	TelegramID      int64     `json:"telegram_id"`
+	Role            string    `gorm:"not null;default:user" json:"role"`
 	TariffExpiresAt time.Time `json:"tariff_expires_at"`
 	UsedTraffic     int64     `json:"used_traffic"`
-	Tariff          Tariff    // Add Tariff relation
+	// Трафик за период по направлениям, для Subscription-Userinfo
+	UsedUplink   int64  `json:"used_uplink"`
+	UsedDownlink int64  `json:"used_downlink"`
+	AccessState  string `gorm:"default:active" json:"access_state"` // active, suspended, throttled
+	AccessReason string `json:"access_reason"`
+	// SubscriptionToken открывает /sub/{token} без JWT; nil — ссылка отозвана
+	SubscriptionToken *string `gorm:"uniqueIndex" json:"-"`
+	// TokenVersion растёт при смене пароля; JWT со старой версией недействительны
+	TokenVersion int `gorm:"not null;default:0" json:"-"`
+	// EmailStatus по умолчанию verified, чтобы существующие аккаунты
+	// пережили миграцию; новые регистрируются как pending
+	EmailStatus        string     `gorm:"default:verified;index" json:"email_status"`
+	EmailVerifiedAt    *time.Time `json:"email_verified_at,omitempty"`
+	VerificationSentAt *time.Time `json:"-"`
+	Tariff             Tariff     // Add Tariff relation
+}
+
+// CanConnect reports whether the user may be present in Xray: not banned
+// and not waiting for email confirmation.
+func (u *User) CanConnect() bool {
+	return !u.IsBanned && u.EmailStatus != EmailPending
 }
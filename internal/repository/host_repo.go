@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"fmt"
+	"vpn-backend/internal/models"
+
+	"gorm.io/gorm"
+)
+
+type HostRepository struct {
+	DB *gorm.DB
+}
+
+func NewHostRepository(db *gorm.DB) *HostRepository {
+	return &HostRepository{DB: db}
+}
+
+func (r *HostRepository) Create(host *models.Host) error {
+	result := r.DB.Create(host)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create host: %w", result.Error)
+	}
+	return nil
+}
+
+func (r *HostRepository) FindByID(id int) (*models.Host, error) {
+	var host models.Host
+	result := r.DB.First(&host, id)
+	if result.Error != nil {
+		return nil, fmt.Errorf("host not found: %w", result.Error)
+	}
+	return &host, nil
+}
+
+func (r *HostRepository) GetAll() ([]models.Host, error) {
+	var hosts []models.Host
+	result := r.DB.Order("id").Find(&hosts)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get hosts: %w", result.Error)
+	}
+	return hosts, nil
+}
+
+// GetEnabled returns the hosts offered to clients, in a stable order.
+func (r *HostRepository) GetEnabled() ([]models.Host, error) {
+	var hosts []models.Host
+	result := r.DB.Where("disabled = ?", false).Order("id").Find(&hosts)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get hosts: %w", result.Error)
+	}
+	return hosts, nil
+}
+
+func (r *HostRepository) Update(host *models.Host) error {
+	result := r.DB.Save(host)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update host: %w", result.Error)
+	}
+	return nil
+}
+
+func (r *HostRepository) Delete(id int) error {
+	result := r.DB.Delete(&models.Host{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete host: %w", result.Error)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+	"vpn-backend/internal/models"
+
+	"gorm.io/gorm"
+)
+
+type NodeRepository struct {
+	DB *gorm.DB
+}
+
+func NewNodeRepository(db *gorm.DB) *NodeRepository {
+	return &NodeRepository{DB: db}
+}
+
+func (r *NodeRepository) Create(node *models.Node) error {
+	result := r.DB.Create(node)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create node: %w", result.Error)
+	}
+	return nil
+}
+
+func (r *NodeRepository) FindByID(id int) (*models.Node, error) {
+	var node models.Node
+	result := r.DB.First(&node, id)
+	if result.Error != nil {
+		return nil, fmt.Errorf("node not found: %w", result.Error)
+	}
+	return &node, nil
+}
+
+func (r *NodeRepository) GetAll() ([]models.Node, error) {
+	var nodes []models.Node
+	result := r.DB.Order("id").Find(&nodes)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", result.Error)
+	}
+	return nodes, nil
+}
+
+func (r *NodeRepository) GetEnabled() ([]models.Node, error) {
+	var nodes []models.Node
+	result := r.DB.Where("enabled = ?", true).Order("id").Find(&nodes)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", result.Error)
+	}
+	return nodes, nil
+}
+
+// GetByTariff returns the nodes the tariff grants access to.
+func (r *NodeRepository) GetByTariff(tariffID int) ([]models.Node, error) {
+	var nodes []models.Node
+	result := r.DB.Joins("JOIN tariff_nodes ON tariff_nodes.node_id = nodes.id").
+		Where("tariff_nodes.tariff_id = ?", tariffID).Order("nodes.id").Find(&nodes)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get tariff nodes: %w", result.Error)
+	}
+	return nodes, nil
+}
+
+// CountUsersBefore counts the users registered before userID who may
+// connect and whose tariff grants the node, explicitly or by granting no
+// nodes at all.
+func (r *NodeRepository) CountUsersBefore(nodeID uint, userID uint) (int64, error) {
+	var count int64
+	result := r.DB.Model(&models.User{}).
+		Where("id < ? AND is_banned = ? AND email_status <> ?", userID, false, models.EmailPending).
+		Where("(EXISTS (SELECT 1 FROM tariff_nodes WHERE tariff_nodes.tariff_id = users.tariff_id AND tariff_nodes.node_id = ?)"+
+			" OR NOT EXISTS (SELECT 1 FROM tariff_nodes WHERE tariff_nodes.tariff_id = users.tariff_id))", nodeID).
+		Count(&count)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to count node users: %w", result.Error)
+	}
+	return count, nil
+}
+
+// SetTariffNodes replaces the set of nodes the tariff grants access to.
+func (r *NodeRepository) SetTariffNodes(tariff *models.Tariff, nodeIDs []uint) error {
+	nodes := make([]models.Node, 0, len(nodeIDs))
+	if len(nodeIDs) > 0 {
+		if err := r.DB.Where("id IN ?", nodeIDs).Find(&nodes).Error; err != nil {
+			return fmt.Errorf("failed to get nodes: %w", err)
+		}
+		if len(nodes) != len(nodeIDs) {
+			return fmt.Errorf("node not found")
+		}
+	}
+	if err := r.DB.Model(tariff).Association("Nodes").Replace(nodes); err != nil {
+		return fmt.Errorf("failed to update tariff nodes: %w", err)
+	}
+	tariff.Nodes = nodes
+	return nil
+}
+
+func (r *NodeRepository) Update(node *models.Node) error {
+	result := r.DB.Save(node)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update node: %w", result.Error)
+	}
+	return nil
+}
+
+// UpdateStatus records the outcome of the last contact with the node.
+func (r *NodeRepository) UpdateStatus(id uint, status string, lastError string, seenAt *time.Time) error {
+	updates := map[string]interface{}{"status": status, "last_error": lastError}
+	if seenAt != nil {
+		updates["last_seen_at"] = *seenAt
+	}
+	result := r.DB.Model(&models.Node{}).Where("id = ?", id).Updates(updates)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update node status: %w", result.Error)
+	}
+	return nil
+}
+
+func (r *NodeRepository) Delete(id int) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM tariff_nodes WHERE node_id = ?", id).Error; err != nil {
+			return fmt.Errorf("failed to detach node from tariffs: %w", err)
+		}
+		if err := tx.Delete(&models.Node{}, id).Error; err != nil {
+			return fmt.Errorf("failed to delete node: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"vpn-backend/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// ErrResetTokenUsed is returned when a reset token has already been redeemed.
+var ErrResetTokenUsed = errors.New("password reset token already used")
+
+type PasswordResetRepository struct {
+	DB *gorm.DB
+}
+
+func NewPasswordResetRepository(db *gorm.DB) *PasswordResetRepository {
+	return &PasswordResetRepository{DB: db}
+}
+
+// Create stores a new token and drops expired ones.
+func (r *PasswordResetRepository) Create(token *models.PasswordResetToken) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("expires_at < ?", time.Now()).Delete(&models.PasswordResetToken{}).Error; err != nil {
+			return fmt.Errorf("failed to delete expired reset tokens: %w", err)
+		}
+		if err := tx.Create(token).Error; err != nil {
+			return fmt.Errorf("failed to create reset token: %w", err)
+		}
+		return nil
+	})
+}
+
+func (r *PasswordResetRepository) FindByHash(hash string) (*models.PasswordResetToken, error) {
+	var token models.PasswordResetToken
+	result := r.DB.Where("token_hash = ?", hash).First(&token)
+	if result.Error != nil {
+		return nil, fmt.Errorf("reset token not found: %w", result.Error)
+	}
+	return &token, nil
+}
+
+// Redeem marks the token used, sets the new password hash and bumps the
+// user's token version, all in one transaction. Other outstanding tokens of
+// the user are spent as well.
+func (r *PasswordResetRepository) Redeem(token *models.PasswordResetToken, passwordHash string) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		// Условие used_at IS NULL не даёт погасить токен дважды при гонке
+		result := tx.Model(&models.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).Update("used_at", now)
+		if result.Error != nil {
+			return fmt.Errorf("failed to redeem reset token: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrResetTokenUsed
+		}
+
+		result = tx.Model(&models.User{}).Where("id = ?", token.UserID).Updates(map[string]interface{}{
+			"password":      passwordHash,
+			"token_version": gorm.Expr("token_version + 1"),
+		})
+		if result.Error != nil {
+			return fmt.Errorf("failed to update password: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("user not found")
+		}
+
+		if err := tx.Model(&models.PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", token.UserID).Update("used_at", now).Error; err != nil {
+			return fmt.Errorf("failed to revoke reset tokens: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"vpn-backend/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// ErrTelegramLinked is returned when a Telegram account is already linked
+// to another user.
+var ErrTelegramLinked = errors.New("telegram account is linked to another user")
+
+// ErrTelegramNotLinked is returned when unlinking an account the user does not have.
+var ErrTelegramNotLinked = errors.New("telegram account not linked")
+
+type TelegramIdentityRepository struct {
+	DB *gorm.DB
+}
+
+func NewTelegramIdentityRepository(db *gorm.DB) *TelegramIdentityRepository {
+	return &TelegramIdentityRepository{DB: db}
+}
+
+// Link attaches the Telegram account to the user. Linking an account the
+// user already has refreshes its profile fields.
+func (r *TelegramIdentityRepository) Link(identity *models.TelegramIdentity) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		return link(tx, identity)
+	})
+}
+
+func link(tx *gorm.DB, identity *models.TelegramIdentity) error {
+	var existing models.TelegramIdentity
+	err := tx.Where("telegram_id = ?", identity.TelegramID).First(&existing).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		// Параллельную привязку того же аккаунта остановит уникальный индекс
+		if err := tx.Create(identity).Error; err != nil {
+			return fmt.Errorf("failed to link telegram account: %w", err)
+		}
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to find telegram account: %w", err)
+	case existing.UserID != identity.UserID:
+		return ErrTelegramLinked
+	}
+
+	identity.ID = existing.ID
+	identity.CreatedAt = existing.CreatedAt
+	if err := tx.Save(identity).Error; err != nil {
+		return fmt.Errorf("failed to update telegram account: %w", err)
+	}
+	return nil
+}
+
+// CreateUser creates a user together with their Telegram account.
+func (r *TelegramIdentityRepository) CreateUser(user *models.User, identity *models.TelegramIdentity) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return fmt.Errorf("failed to create user: %w", err)
+		}
+		identity.UserID = int(user.ID)
+		return link(tx, identity)
+	})
+}
+
+// FindUser returns the user the Telegram account is linked to.
+func (r *TelegramIdentityRepository) FindUser(telegramID int64) (*models.User, error) {
+	var identity models.TelegramIdentity
+	if err := r.DB.Where("telegram_id = ?", telegramID).First(&identity).Error; err != nil {
+		return nil, fmt.Errorf("telegram account not linked: %w", err)
+	}
+	var user models.User
+	if err := r.DB.Preload("Tariff").First(&user, identity.UserID).Error; err != nil {
+		return nil, fmt.Errorf("user not found: %w", err)
+	}
+	return &user, nil
+}
+
+func (r *TelegramIdentityRepository) ListByUser(userID int) ([]models.TelegramIdentity, error) {
+	var identities []models.TelegramIdentity
+	result := r.DB.Where("user_id = ?", userID).Order("id").Find(&identities)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get telegram accounts: %w", result.Error)
+	}
+	return identities, nil
+}
+
+func (r *TelegramIdentityRepository) Unlink(userID int, telegramID int64) error {
+	result := r.DB.Where("user_id = ? AND telegram_id = ?", userID, telegramID).Delete(&models.TelegramIdentity{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to unlink telegram account: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrTelegramNotLinked
+	}
+	return nil
+}
+
+// UnlinkAll removes every Telegram account of the user, e.g. when the
+// account is deleted, so that they can be used to register again.
+func (r *TelegramIdentityRepository) UnlinkAll(userID int) error {
+	if err := r.DB.Where("user_id = ?", userID).Delete(&models.TelegramIdentity{}).Error; err != nil {
+		return fmt.Errorf("failed to unlink telegram accounts: %w", err)
+	}
+	return nil
+}
+
+// ImportLegacy moves IDs from the old users.telegram_id column into
+// telegram_identities and clears the column, so it runs once per user.
+func (r *TelegramIdentityRepository) ImportLegacy() error {
+	if !r.DB.Migrator().HasColumn("users", "telegram_id") {
+		return nil
+	}
+	var legacy []struct {
+		ID         int
+		TelegramID int64
+	}
+	if err := r.DB.Table("users").Select("id, telegram_id").
+		Where("telegram_id <> 0 AND deleted_at IS NULL").Scan(&legacy).Error; err != nil {
+		return fmt.Errorf("failed to read legacy telegram ids: %w", err)
+	}
+	for _, row := range legacy {
+		err := r.DB.Transaction(func(tx *gorm.DB) error {
+			err := link(tx, &models.TelegramIdentity{UserID: row.ID, TelegramID: row.TelegramID})
+			if errors.Is(err, ErrTelegramLinked) {
+				log.Printf("Telegram ID %d of user %d is already linked to another user, dropping it", row.TelegramID, row.ID)
+			} else if err != nil {
+				return err
+			}
+			return tx.Table("users").Where("id = ?", row.ID).Update("telegram_id", 0).Error
+		})
+		if err != nil {
+			return fmt.Errorf("failed to import telegram id of user %d: %w", row.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+	"vpn-backend/internal/models"
+
+	"gorm.io/gorm"
+)
+
+type TrafficRepository struct {
+	DB *gorm.DB
+}
+
+func NewTrafficRepository(db *gorm.DB) *TrafficRepository {
+	return &TrafficRepository{DB: db}
+}
+
+// RecordUsage stores the logs and adds each delta to the user's
+// used_traffic and per-direction counters in one transaction.
+func (r *TrafficRepository) RecordUsage(logs []models.TrafficLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&logs).Error; err != nil {
+			return fmt.Errorf("failed to create traffic logs: %w", err)
+		}
+		for _, log := range logs {
+			result := tx.Model(&models.User{}).Where("id = ?", log.UserID).
+				Updates(map[string]interface{}{
+					"used_traffic":  gorm.Expr("used_traffic + ?", log.Uplink+log.Downlink),
+					"used_uplink":   gorm.Expr("used_uplink + ?", log.Uplink),
+					"used_downlink": gorm.Expr("used_downlink + ?", log.Downlink),
+				})
+			if result.Error != nil {
+				return fmt.Errorf("failed to update used traffic: %w", result.Error)
+			}
+		}
+		return nil
+	})
+}
+
+// UserTotals sums the stored uplink and downlink of a user.
+func (r *TrafficRepository) UserTotals(userID int) (uplink, downlink int64, err error) {
+	var totals struct {
+		Uplink   int64
+		Downlink int64
+	}
+	result := r.DB.Model(&models.TrafficLog{}).
+		Select("COALESCE(SUM(uplink), 0) AS uplink, COALESCE(SUM(downlink), 0) AS downlink").
+		Where("user_id = ?", userID).
+		Scan(&totals)
+	if result.Error != nil {
+		return 0, 0, fmt.Errorf("failed to sum traffic logs: %w", result.Error)
+	}
+	return totals.Uplink, totals.Downlink, nil
+}
+
+// History sums traffic logs in [from, to) per bucket, which must be a
+// Postgres date_trunc unit ("hour", "day", "month"). A nil userID sums over
+// all users.
+func (r *TrafficRepository) History(userID *int, from, to time.Time, bucket string) ([]models.TrafficPoint, error) {
+	query := r.DB.Model(&models.TrafficLog{}).
+		Select("date_trunc(?, timestamp) AS time, SUM(uplink) AS uplink, SUM(downlink) AS downlink", bucket).
+		Where("timestamp >= ? AND timestamp < ?", from, to)
+	if userID != nil {
+		query = query.Where("user_id = ?", *userID)
+	}
+
+	var points []models.TrafficPoint
+	result := query.Group("1").Order("1").Scan(&points)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get traffic history: %w", result.Error)
+	}
+	return points, nil
+}
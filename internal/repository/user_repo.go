@@ -1,13 +1,26 @@
 package repository
 
 import (
+	"errors"
 	"fmt"
 	"time"
 	"vpn-backend/internal/models"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// ErrPaymentNotPending is returned when a payment was already completed or
+// cancelled.
+var ErrPaymentNotPending = errors.New("payment is not pending")
+
+// ErrPaymentNotFound is returned for payments that do not exist or belong to
+// another user.
+var ErrPaymentNotFound = errors.New("payment not found")
+
+// ErrLastAdmin is returned when a role change would leave no administrators.
+var ErrLastAdmin = errors.New("cannot remove the last administrator")
+
 type UserRepository struct {
 	DB *gorm.DB
 }
@@ -62,6 +75,27 @@ func (r *UserRepository) GetUserByUUID(uuid string) (*models.User, error) {
 	return &user, nil
 }
 
+func (r *UserRepository) GetUserBySubscriptionToken(token string) (*models.User, error) {
+	var user models.User
+	result := r.DB.Preload("Tariff").Where("subscription_token = ?", token).First(&user)
+	if result.Error != nil {
+		return nil, fmt.Errorf("user not found: %w", result.Error)
+	}
+	return &user, nil
+}
+
+// UpdateSubscriptionToken sets the token; nil revokes it.
+func (r *UserRepository) UpdateSubscriptionToken(userID int, token *string) error {
+	result := r.DB.Model(&models.User{}).Where("id = ?", userID).Update("subscription_token", token)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update subscription token: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
 func (r *UserRepository) UpdateUserTariff(userID int, tariffID int) error {
 	result := r.DB.Model(&models.User{}).Where("id = ?", userID).Update("tariff_id", tariffID)
 	if result.Error != nil {
@@ -75,37 +109,26 @@ func (r *UserRepository) UpdateUserTariff(userID int, tariffID int) error {
 
 func (r *UserRepository) GetAllUsers() ([]models.User, error) {
 	var users []models.User
-	result := r.DB.Find(&users)
+	result := r.DB.Preload("Tariff").Order("id").Find(&users)
 	if result.Error != nil {
 		return nil, fmt.Errorf("failed to get all users: %w", result.Error)
 	}
 	return users, nil
 }
 
-func (r *UserRepository) BanUser(userID int, ban bool) error {
-	result := r.DB.Model(&models.User{}).Where("id = ?", userID).Update("is_banned", ban)
-	if result.Error != nil {
-		return fmt.Errorf("failed to ban user: %w", result.Error)
-	}
-	if result.RowsAffected == 0 {
-		return fmt.Errorf("user not found")
-	}
-	return nil
-}
-
-func (r *UserRepository) GetUserByTelegramID(telegramID int64) (*models.User, error) {
-	var user models.User
-	result := r.DB.Where("telegram_id = ?", telegramID).First(&user)
+func (r *UserRepository) GetUsersByTariff(tariffID int) ([]models.User, error) {
+	var users []models.User
+	result := r.DB.Preload("Tariff").Where("tariff_id = ?", tariffID).Find(&users)
 	if result.Error != nil {
-		return nil, fmt.Errorf("user not found: %w", result.Error)
+		return nil, fmt.Errorf("failed to get users by tariff: %w", result.Error)
 	}
-	return &user, nil
+	return users, nil
 }
 
-func (r *UserRepository) UpdateUserTelegramID(userID int, telegramID int64) error {
-	result := r.DB.Model(&models.User{}).Where("id = ?", userID).Update("telegram_id", telegramID)
+func (r *UserRepository) BanUser(userID int, ban bool) error {
+	result := r.DB.Model(&models.User{}).Where("id = ?", userID).Update("is_banned", ban)
 	if result.Error != nil {
-		return fmt.Errorf("failed to update user telegram_id: %w", result.Error)
+		return fmt.Errorf("failed to ban user: %w", result.Error)
 	}
 	if result.RowsAffected == 0 {
 		return fmt.Errorf("user not found")
@@ -130,8 +153,11 @@ func (r *UserRepository) GetTariffExpiry(userID int) (time.Time, error) {
 	return user.TariffExpiresAt, nil
 }
 
+// UpdateUsedTraffic sets the used traffic and starts the per-direction
+// counters over.
 func (r *UserRepository) UpdateUsedTraffic(userID int, traffic int64) error {
-	result := r.DB.Model(&models.User{}).Where("id = ?", userID).Update("used_traffic", traffic)
+	result := r.DB.Model(&models.User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"used_traffic": traffic, "used_uplink": 0, "used_downlink": 0})
 	if result.Error != nil {
 		return fmt.Errorf("failed to update used traffic: %w", result.Error)
 	}
@@ -141,6 +167,34 @@ func (r *UserRepository) UpdateUsedTraffic(userID int, traffic int64) error {
 	return nil
 }
 
+// SetAccessState changes the user's access state and records the transition.
+func (r *UserRepository) SetAccessState(userID int, state string, reason string) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.User{}).Where("id = ?", userID).
+			Updates(map[string]interface{}{"access_state": state, "access_reason": reason})
+		if result.Error != nil {
+			return fmt.Errorf("failed to update access state: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("user not found")
+		}
+		event := &models.AccessEvent{UserID: userID, State: state, Reason: reason, CreatedAt: time.Now()}
+		if err := tx.Create(event).Error; err != nil {
+			return fmt.Errorf("failed to record access event: %w", err)
+		}
+		return nil
+	})
+}
+
+func (r *UserRepository) GetAccessEvents(userID int, limit int) ([]models.AccessEvent, error) {
+	var events []models.AccessEvent
+	result := r.DB.Where("user_id = ?", userID).Order("created_at DESC").Limit(limit).Find(&events)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get access events: %w", result.Error)
+	}
+	return events, nil
+}
+
 func (r *UserRepository) GetPaymentsByUserID(userID int) ([]models.Payment, error) {
 	var payments []models.Payment
 	result := r.DB.Where("user_id = ?", userID).Find(&payments)
@@ -153,8 +207,11 @@ func (r *UserRepository) GetPaymentsByUserID(userID int) ([]models.Payment, erro
 func (r *UserRepository) GetPaymentByID(userID int, paymentID string) (*models.Payment, error) {
 	var payment models.Payment
 	result := r.DB.Where("id = ? AND user_id = ?", paymentID, userID).First(&payment)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrPaymentNotFound
+	}
 	if result.Error != nil {
-		return nil, fmt.Errorf("payment not found: %w", result.Error)
+		return nil, fmt.Errorf("failed to get payment: %w", result.Error)
 	}
 	return &payment, nil
 }
@@ -167,13 +224,129 @@ func (r *UserRepository) CreatePayment(payment *models.Payment) error {
 	return nil
 }
 
-func (r *UserRepository) UpdatePaymentStatus(userID int, paymentID string, status string) error {
-	result := r.DB.Model(&models.Payment{}).Where("id = ? AND user_id = ?", paymentID, userID).Update("status", status)
+func (r *UserRepository) GetPayment(paymentID string) (*models.Payment, error) {
+	var payment models.Payment
+	result := r.DB.Where("id = ?", paymentID).First(&payment)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrPaymentNotFound
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get payment: %w", result.Error)
+	}
+	return &payment, nil
+}
+
+// FinishPayment moves a pending payment to status. A payment that is no
+// longer pending is left as is, so it cannot be completed twice.
+func (r *UserRepository) FinishPayment(paymentID int, status string) error {
+	result := r.DB.Model(&models.Payment{}).
+		Where("id = ? AND status = ?", paymentID, models.PaymentPending).Update("status", status)
 	if result.Error != nil {
 		return fmt.Errorf("failed to update payment status: %w", result.Error)
 	}
 	if result.RowsAffected == 0 {
-		return fmt.Errorf("payment not found")
+		return ErrPaymentNotPending
+	}
+	return nil
+}
+
+func (r *UserRepository) GetTokenVersion(userID int) (int, error) {
+	var user models.User
+	result := r.DB.Select("token_version").First(&user, userID)
+	if result.Error != nil {
+		return 0, fmt.Errorf("user not found: %w", result.Error)
+	}
+	return user.TokenVersion, nil
+}
+
+func (r *UserRepository) MarkEmailVerified(userID int, at time.Time) error {
+	result := r.DB.Model(&models.User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"email_status": models.EmailVerified, "email_verified_at": at})
+	if result.Error != nil {
+		return fmt.Errorf("failed to mark email verified: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("user not found")
 	}
 	return nil
 }
+
+func (r *UserRepository) UpdateVerificationSentAt(userID int, at time.Time) error {
+	result := r.DB.Model(&models.User{}).Where("id = ?", userID).Update("verification_sent_at", at)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update verification time: %w", result.Error)
+	}
+	return nil
+}
+
+// DeleteUnverified removes accounts registered before the given time that
+// never confirmed their email. The rows are deleted for good so that the
+// address can be registered again, together with everything that refers to
+// the user, so nothing matches a new account later.
+func (r *UserRepository) DeleteUnverified(before time.Time) (int64, error) {
+	var deleted int64
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		// Блокируем строки, чтобы пользователь не подтвердил почту посреди удаления
+		err := tx.Unscoped().Model(&models.User{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("email_status = ? AND created_at < ?", models.EmailPending, before).Pluck("id", &ids).Error
+		if err != nil {
+			return fmt.Errorf("failed to find unverified users: %w", err)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		for _, dependent := range []interface{}{
+			&models.PasswordResetToken{},
+			&models.TelegramIdentity{},
+			&models.AccessEvent{},
+			&models.Payment{},
+			&models.TrafficLog{},
+		} {
+			if err := tx.Unscoped().Where("user_id IN ?", ids).Delete(dependent).Error; err != nil {
+				return fmt.Errorf("failed to delete data of unverified users: %w", err)
+			}
+		}
+
+		result := tx.Unscoped().Where("id IN ?", ids).Delete(&models.User{})
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete unverified users: %w", result.Error)
+		}
+		deleted = result.RowsAffected
+		return nil
+	})
+	return deleted, err
+}
+
+// SetRole changes the user's role and bumps the token version, so tokens
+// with the old role's permissions stop working. Taking the role away from
+// the last administrator fails with ErrLastAdmin.
+func (r *UserRepository) SetRole(userID int, role string) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		if role != models.RoleAdmin {
+			// Блокируем строки администраторов, чтобы два встречных понижения
+			// не оставили систему без них
+			var adminIDs []int
+			if err := tx.Model(&models.User{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("role = ?", models.RoleAdmin).Pluck("id", &adminIDs).Error; err != nil {
+				return fmt.Errorf("failed to count admins: %w", err)
+			}
+			if len(adminIDs) == 1 && adminIDs[0] == userID {
+				return ErrLastAdmin
+			}
+		}
+
+		result := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"role":          role,
+			"token_version": gorm.Expr("token_version + 1"),
+		})
+		if result.Error != nil {
+			return fmt.Errorf("failed to update role: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("user not found")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"vpn-backend/internal/agent"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/xray"
+)
+
+// AgentBackend serves the node agent API on a VPN server, applying the
+// backend's requests to the local Xray through XrayService.
+type AgentBackend struct {
+	Xray *XrayService
+	// Limits enforces the tariff's bandwidth and connection limits; when
+	// nil, they are ignored.
+	Limits *agent.LimitsHook
+}
+
+func NewAgentBackend(xrayService *XrayService) *AgentBackend {
+	return &AgentBackend{Xray: xrayService}
+}
+
+func agentUser(req agent.UserRequest) *models.User {
+	user := &models.User{UUID: req.UUID, Email: req.Email}
+	user.Tariff.InboundTags = req.InboundTags
+	return user
+}
+
+func (b *AgentBackend) SyncUser(req agent.UserRequest) error {
+	if err := b.Xray.UpdateUserTariff(agentUser(req), req.Level); err != nil {
+		return err
+	}
+	if b.Limits != nil {
+		return b.Limits.Set(req)
+	}
+	return nil
+}
+
+func (b *AgentBackend) RemoveUser(req agent.UserRequest) error {
+	if err := b.Xray.RemoveUserFromConfig(req.UUID); err != nil {
+		return err
+	}
+	if b.Limits != nil {
+		return b.Limits.Remove(req)
+	}
+	return nil
+}
+
+func (b *AgentBackend) Config() ([]byte, error) {
+	config, err := b.Xray.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return config.Marshal()
+}
+
+// Sync writes the layout from the backend with exactly the given users in
+// it and restarts Xray to load it.
+func (b *AgentBackend) Sync(req agent.SyncRequest) error {
+	config, err := xray.ParseConfig(req.Config)
+	if err != nil {
+		return err
+	}
+	for _, inbound := range config.ClientInbounds() {
+		inbound.ClearClients()
+	}
+	for _, userReq := range req.Users {
+		user := agentUser(userReq)
+		if _, err := syncClient(config, user, b.Xray.InboundTagsFor(user), userReq.Level); err != nil {
+			return fmt.Errorf("failed to add user %s: %w", user.UUID, err)
+		}
+	}
+
+	if err := b.Xray.saveConfig(config, fmt.Sprintf("sync %d users from the backend", len(req.Users))); err != nil {
+		return err
+	}
+	if err := b.Xray.RestartXray(); err != nil {
+		return err
+	}
+	return b.syncLimits(req.Users)
+}
+
+// syncLimits replaces the limits of every user with those of users.
+func (b *AgentBackend) syncLimits(users []agent.UserRequest) error {
+	if b.Limits == nil {
+		return nil
+	}
+	if err := b.Limits.Reset(); err != nil {
+		return err
+	}
+	for _, userReq := range users {
+		if err := b.Limits.Set(userReq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *AgentBackend) QueryStats(ctx context.Context, query xray.StatsQuery) ([]xray.Stat, error) {
+	if b.Xray.API == nil {
+		return nil, fmt.Errorf("xray api is not configured")
+	}
+	return b.Xray.API.QueryStats(ctx, query)
+}
+
+func (b *AgentBackend) Health(ctx context.Context) error {
+	_, err := b.QueryStats(ctx, xray.StatsQuery{Patterns: []string{"inbound>>>"}})
+	return err
+}
+
+func (b *AgentBackend) Restart() error {
+	return b.Xray.RestartXray()
+}
+
+// agentDriver manages a node through its agent.
+type agentDriver struct {
+	client *agent.Client
+}
+
+func agentUserRequest(user *models.User, level int) agent.UserRequest {
+	return agent.UserRequest{
+		UUID:            user.UUID,
+		Email:           user.Email,
+		Level:           level,
+		InboundTags:     user.Tariff.InboundTags,
+		BandwidthLimit:  user.Tariff.BandwidthLimit,
+		ConnectionLimit: user.Tariff.ConnectionLimit,
+	}
+}
+
+func (d *agentDriver) SyncUser(user *models.User, level int) error {
+	return d.client.SyncUser(context.Background(), agentUserRequest(user, level))
+}
+
+func (d *agentDriver) RemoveUser(user *models.User) error {
+	return d.client.RemoveUser(context.Background(), agentUserRequest(user, 0))
+}
+
+func (d *agentDriver) QueryStats(ctx context.Context, query xray.StatsQuery) ([]xray.Stat, error) {
+	return d.client.QueryStats(ctx, query)
+}
+
+func (d *agentDriver) Ping(ctx context.Context) error {
+	health, err := d.client.Health(ctx)
+	if err != nil {
+		return err
+	}
+	if health.Status != "ok" {
+		return fmt.Errorf("agent is %s: %s", health.Status, health.XrayError)
+	}
+	return nil
+}
+
+func (d *agentDriver) Sync(ctx context.Context, req agent.SyncRequest) error {
+	return d.client.Sync(ctx, req)
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"vpn-backend/internal/agent"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/xray"
+	"vpn-backend/internal/xray/xraytest"
+)
+
+// Бэкенд и агент в одном процессе: agentDriver -> HTTP -> AgentBackend -> Xray API
+func TestAgentDriverThroughAgent(t *testing.T) {
+	xrayServer := xraytest.NewServer("vless-ws")
+	defer xrayServer.Close()
+
+	api, err := xray.NewAPIClient(xrayServer.Addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	err = os.WriteFile(configPath, []byte(`{
+		"inbounds": [
+			{"tag": "vless-ws", "port": 10000, "protocol": "vless", "settings": {"clients": [], "decryption": "none"}}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeXray := &XrayService{ConfigPath: configPath, API: api, Controller: &countingController{}}
+	server := httptest.NewServer(agent.NewServer(NewAgentBackend(nodeXray), "s3cret").Handler())
+	defer server.Close()
+
+	driver := &agentDriver{client: agent.NewClient(server.URL, "s3cret", 5*time.Second, nil)}
+	user := &models.User{Email: "remote@example.com", UUID: "remote-uuid"}
+
+	if err := driver.SyncUser(user, 1); err != nil {
+		t.Fatalf("Failed to sync user: %v", err)
+	}
+	config, err := xray.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client := config.Inbounds[0].Client(user.UUID); client == nil || client.Level != 1 {
+		t.Fatalf("Expected user in the node config with level 1, got %+v", client)
+	}
+	if users := xrayServer.Users("vless-ws"); len(users) != 1 || users[0].Email != user.Email {
+		t.Fatalf("Expected user to be added live on the node, got %+v", users)
+	}
+
+	xrayServer.AddTraffic(user.Email, 100, 200)
+	stats, err := driver.QueryStats(context.Background(), xray.StatsQuery{Patterns: []string{"user>>>"}, Reset: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if traffic := userTraffic(stats)[user.Email]; traffic.Uplink != 100 || traffic.Downlink != 200 {
+		t.Fatalf("Unexpected traffic %+v", traffic)
+	}
+
+	if err := driver.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	if err := driver.RemoveUser(user); err != nil {
+		t.Fatalf("Failed to remove user: %v", err)
+	}
+	if users := xrayServer.Users("vless-ws"); len(users) != 0 {
+		t.Fatalf("Expected user to be removed on the node, got %+v", users)
+	}
+}
+
+func TestAgentSyncInboundWithoutSettings(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	controller := &countingController{}
+	backend := NewAgentBackend(&XrayService{ConfigPath: configPath, Controller: controller})
+
+	// У inbound'а из layout нет блока settings
+	err := backend.Sync(agent.SyncRequest{
+		Config: []byte(`{"inbounds": [{"tag": "vless-ws", "port": 10000, "protocol": "vless"}]}`),
+		Users:  []agent.UserRequest{{UUID: "remote-uuid", Email: "remote@example.com", Level: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	config, err := xray.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client := config.Inbounds[0].Client("remote-uuid"); client == nil || client.Level != 1 {
+		t.Fatalf("Expected user in the node config with level 1, got %+v", client)
+	}
+	if controller.restarts != 1 {
+		t.Errorf("Expected one restart, got %d", controller.restarts)
+	}
+}
@@ -1,8 +1,17 @@
 package services
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	netmail "net/mail"
+	"net/url"
 	"time"
+	"vpn-backend/internal/mail"
 	"vpn-backend/internal/models"
 	"vpn-backend/internal/repository"
 
@@ -10,36 +19,82 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrInvalidResetToken covers unknown, expired and already used reset tokens.
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
 type AuthService struct {
 	UserRepo  *repository.UserRepository
 	jwtSecret string
+
+	// Сброс пароля: токены в ResetRepo, письма через Mailer
+	ResetRepo *repository.PasswordResetRepository
+	// Привязанные аккаунты Telegram
+	TelegramRepo *repository.TelegramIdentityRepository
+	Mailer       mail.Mailer
+	// ResetURL is the page that takes ?token=; ResetTTL is how long a token lives.
+	ResetURL string
+	ResetTTL time.Duration
+
+	// Подтверждение email: ссылки подписываются VerifySecret и ведут на VerifyURL
+	VerifySecret []byte
+	VerifyURL    string
+	VerifyTTL    time.Duration
+	// UnverifiedTTL is how long an account may stay unconfirmed before it is purged.
+	UnverifiedTTL time.Duration
+
+	// Вход через Telegram проверяется подписью бота; пустой токен отключает его
+	TelegramBotToken string
+	// TelegramAuthMaxAge bounds the age of auth_date in Telegram login data.
+	TelegramAuthMaxAge time.Duration
 }
 
 func NewAuthService(userRepo *repository.UserRepository, jwtSecret string) *AuthService {
 	return &AuthService{
 		UserRepo:  userRepo,
 		jwtSecret: jwtSecret,
+		Mailer:    mail.LogMailer{},
+		ResetTTL:  time.Hour,
+
+		VerifySecret:  []byte(jwtSecret),
+		VerifyTTL:     24 * time.Hour,
+		UnverifiedTTL: 72 * time.Hour,
+
+		TelegramAuthMaxAge: 24 * time.Hour,
 	}
 }
 
+// Register creates an account with an unconfirmed email and sends the
+// confirmation link. The user is not added to Xray until they confirm.
 func (a *AuthService) Register(email, password, uuid string, tariffID int) (*models.User, error) {
+	if address, err := netmail.ParseAddress(email); err != nil || address.Address != email {
+		return nil, fmt.Errorf("invalid email address")
+	}
+	if password == "" {
+		return nil, fmt.Errorf("password is required")
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash password: %w", err)
 	}
 
 	user := &models.User{
-		Email:    email,
-		Password: string(hashedPassword),
-		UUID:     uuid,
-		TariffID: tariffID,
-		IsBanned: false,
+		Email:       email,
+		Password:    string(hashedPassword),
+		UUID:        uuid,
+		TariffID:    tariffID,
+		IsBanned:    false,
+		EmailStatus: models.EmailPending,
 	}
 
 	if err := a.UserRepo.CreateUser(user); err != nil {
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
+	if err := a.SendVerification(user); err != nil {
+		log.Printf("Failed to send verification to user %d: %v", user.ID, err)
+	}
+
 	return user, nil
 }
 
@@ -53,7 +108,7 @@ func (a *AuthService) AuthenticateUser(email, password string) (string, error) {
 		return "", fmt.Errorf("invalid credentials")
 	}
 
-	token, err := a.GenerateJWT(int(user.ID))
+	token, err := a.GenerateJWT(user)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate token: %w", err)
 	}
@@ -61,10 +116,20 @@ func (a *AuthService) AuthenticateUser(email, password string) (string, error) {
 	return token, nil
 }
 
-func (a *AuthService) GenerateJWT(userID int) (string, error) {
+// GenerateJWT issues a session token. It carries the user's token version
+// ("tv"), so changing the password or role invalidates it, and the role
+// with its permissions for route checks.
+func (a *AuthService) GenerateJWT(user *models.User) (string, error) {
+	role := user.Role
+	if role == "" {
+		role = models.RoleUser
+	}
 	expirationTime := time.Now().Add(24 * time.Hour)
 	claims := &jwt.MapClaims{
-		"user_id": userID,
+		"user_id": int(user.ID),
+		"tv":      user.TokenVersion,
+		"role":    role,
+		"perms":   models.RolePermissions[role],
 		"exp":     expirationTime.Unix(),
 	}
 
@@ -100,15 +165,108 @@ func ParseJWT(tokenString string, jwtSecret string) (int, error) {
 	return userID, nil
 }
 
-func (a *AuthService) AuthenticateByTelegramID(telegramID int64) (string, error) {
-	user, err := a.UserRepo.GetUserByTelegramID(telegramID)
+// TokenVersion is used by AuthMiddleware to reject sessions issued before
+// the last password change.
+func (a *AuthService) TokenVersion(userID int) (int, error) {
+	return a.UserRepo.GetTokenVersion(userID)
+}
+
+// RequestPasswordReset emails a reset link if the address belongs to a user.
+// It reports no error for unknown addresses, so callers can't probe for
+// accounts.
+func (a *AuthService) RequestPasswordReset(email string) error {
+	user, err := a.UserRepo.GetUserByEmail(email)
+	if err != nil || user.EmailStatus == models.EmailNone {
+		log.Printf("Password reset requested for unknown email %q", email)
+		return nil
+	}
+
+	token, hash, err := newResetToken()
 	if err != nil {
-		return "", fmt.Errorf("invalid credentials")
+		return err
+	}
+	record := &models.PasswordResetToken{
+		UserID:    int(user.ID),
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(a.ResetTTL),
+	}
+	if err := a.ResetRepo.Create(record); err != nil {
+		return err
+	}
+
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Password reset",
+		Body: fmt.Sprintf("To set a new password, open the link below. It is valid for %s and works once.\n\n%s\n\n"+
+			"If you did not ask for a password reset, ignore this email.\n", a.ResetTTL, tokenLink(a.ResetURL, token)),
 	}
-	token, err := a.GenerateJWT(int(user.ID))
+	// Письмо отправляется в фоне: время ответа не должно выдавать, есть ли аккаунт
+	go func() {
+		if err := a.Mailer.Send(msg); err != nil {
+			log.Printf("Failed to send password reset email to user %d: %v", user.ID, err)
+		}
+	}()
+	return nil
+}
+
+// ResetPassword redeems a reset token and sets the new password. The token
+// and every other outstanding token of the user become unusable, and
+// existing sessions are invalidated.
+func (a *AuthService) ResetPassword(token, password string) error {
+	if password == "" {
+		return fmt.Errorf("password is required")
+	}
+	record, err := a.ResetRepo.FindByHash(hashResetToken(token))
 	if err != nil {
-		return "", fmt.Errorf("failed to generate token: %w", err)
+		return ErrInvalidResetToken
+	}
+	if err := checkResetToken(record, time.Now()); err != nil {
+		return err
 	}
 
-	return token, nil
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	if err := a.ResetRepo.Redeem(record, string(hashedPassword)); err != nil {
+		if errors.Is(err, repository.ErrResetTokenUsed) {
+			return ErrInvalidResetToken
+		}
+		return err
+	}
+	return nil
+}
+
+func checkResetToken(record *models.PasswordResetToken, now time.Time) error {
+	if record.UsedAt != nil || !now.Before(record.ExpiresAt) {
+		return ErrInvalidResetToken
+	}
+	return nil
+}
+
+// newResetToken returns a random token for the user and its hash for the DB.
+func newResetToken() (token, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("failed to generate reset token: %w", err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashResetToken(token), nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenLink adds ?token= to a link, keeping its other query parameters.
+func tokenLink(base, token string) string {
+	link, err := url.Parse(base)
+	if err != nil {
+		return base + "?token=" + url.QueryEscape(token)
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	return link.String()
 }
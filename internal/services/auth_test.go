@@ -0,0 +1,78 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"vpn-backend/internal/models"
+)
+
+func TestResetTokens(t *testing.T) {
+	token, hash, err := newResetToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := newResetToken()
+	if token == other {
+		t.Error("Expected tokens to be random")
+	}
+	if hash == token || hash != hashResetToken(token) {
+		t.Errorf("Expected the stored hash to be derived from the token, got %q", hash)
+	}
+
+	link, err := url.Parse(tokenLink("https://vpn.example.com/reset-password?lang=ru", token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Query().Get("token") != token || link.Query().Get("lang") != "ru" {
+		t.Errorf("Unexpected reset link %s", link)
+	}
+
+	now := time.Now()
+	used := now.Add(-time.Minute)
+	for name, tc := range map[string]struct {
+		record models.PasswordResetToken
+		valid  bool
+	}{
+		"valid":   {models.PasswordResetToken{ExpiresAt: now.Add(time.Hour)}, true},
+		"expired": {models.PasswordResetToken{ExpiresAt: now}, false},
+		"used":    {models.PasswordResetToken{ExpiresAt: now.Add(time.Hour), UsedAt: &used}, false},
+	} {
+		err := checkResetToken(&tc.record, now)
+		if tc.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidResetToken) {
+			t.Errorf("%s: expected ErrInvalidResetToken, got %v", name, err)
+		}
+	}
+}
+
+func TestEmailTokens(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+	token := signEmailToken(secret, 42, "user@example.com", now.Add(time.Hour))
+
+	if userID, err := emailTokenUser(token); err != nil || userID != 42 {
+		t.Fatalf("Expected user 42, got %d, %v", userID, err)
+	}
+	if err := checkEmailToken(secret, token, "user@example.com", now); err != nil {
+		t.Errorf("Expected a valid token, got %v", err)
+	}
+
+	for name, check := range map[string]error{
+		"expired":         checkEmailToken(secret, token, "user@example.com", now.Add(2*time.Hour)),
+		"other address":   checkEmailToken(secret, token, "other@example.com", now),
+		"other secret":    checkEmailToken([]byte("other"), token, "user@example.com", now),
+		"other user":      checkEmailToken(secret, "43"+token[2:], "user@example.com", now),
+		"malformed":       checkEmailToken(secret, "42.abc", "user@example.com", now),
+		"extended expiry": checkEmailToken(secret, fmt.Sprintf("42.%d.%s", now.Add(48*time.Hour).Unix(), token[strings.LastIndex(token, ".")+1:]), "user@example.com", now),
+	} {
+		if !errors.Is(check, ErrInvalidVerifyToken) {
+			t.Errorf("%s: expected ErrInvalidVerifyToken, got %v", name, check)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"vpn-backend/internal/agent"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/repository"
+	"vpn-backend/internal/xray"
+)
+
+// NodeDriver controls the Xray of one node.
+type NodeDriver interface {
+	// SyncUser makes the user present with the given level in the inbounds
+	// of their tariff.
+	SyncUser(user *models.User, level int) error
+	// RemoveUser drops the user from every inbound. Removing a user that is
+	// not there is not an error.
+	RemoveUser(user *models.User) error
+	StatsQuerier
+	// Ping checks that the node answers.
+	Ping(ctx context.Context) error
+}
+
+// localDriver is the Xray on this server, managed through XrayService.
+type localDriver struct {
+	xray *XrayService
+}
+
+func (d localDriver) SyncUser(user *models.User, level int) error {
+	return d.xray.UpdateUserTariff(user, level)
+}
+
+func (d localDriver) RemoveUser(user *models.User) error {
+	return d.xray.RemoveUserFromConfig(user.UUID)
+}
+
+func (d localDriver) QueryStats(ctx context.Context, query xray.StatsQuery) ([]xray.Stat, error) {
+	if d.xray.API == nil {
+		return nil, fmt.Errorf("xray api is not configured")
+	}
+	return d.xray.API.QueryStats(ctx, query)
+}
+
+func (d localDriver) Ping(ctx context.Context) error {
+	_, err := d.QueryStats(ctx, xray.StatsQuery{Patterns: []string{"inbound>>>"}})
+	return err
+}
+
+// apiDriver manages a remote Xray only through its gRPC API. The remote
+// config is expected to have the same inbounds as the local config file,
+// which is used as the layout. Changes live only in the running process:
+// after a restart of the remote Xray its users have to be synced again.
+type apiDriver struct {
+	client *xray.APIClient
+	layout *XrayService
+}
+
+func (d *apiDriver) SyncUser(user *models.User, level int) error {
+	config, err := d.layout.loadConfig()
+	if err != nil {
+		return err
+	}
+	targets, err := targetInbounds(config, d.layout.InboundTagsFor(user))
+	if err != nil {
+		return err
+	}
+	wanted := make(map[*xray.Inbound]bool, len(targets))
+	for _, inbound := range targets {
+		wanted[inbound] = true
+	}
+
+	ctx := context.Background()
+	for _, inbound := range config.ClientInbounds() {
+		// Уровень живого пользователя не поменять, поэтому всегда
+		// удаляем и добавляем заново
+		err := d.client.RemoveUser(ctx, inbound.Tag, user.Email)
+		if err != nil && !errors.Is(err, xray.ErrClientNotFound) {
+			return err
+		}
+		if !wanted[inbound] {
+			continue
+		}
+		client := inbound.NewClient(user.UUID, user.Email, level)
+		if existing := inbound.Client(user.UUID); existing != nil {
+			if existing.Password != "" {
+				client.Password = existing.Password
+			}
+			client.Flow = existing.Flow
+		}
+		if err := d.client.AddUser(ctx, inbound.Tag, xray.NewUser(inbound, client)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *apiDriver) RemoveUser(user *models.User) error {
+	config, err := d.layout.loadConfig()
+	if err != nil {
+		return err
+	}
+	for _, inbound := range config.ClientInbounds() {
+		err := d.client.RemoveUser(context.Background(), inbound.Tag, user.Email)
+		if err != nil && !errors.Is(err, xray.ErrClientNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *apiDriver) QueryStats(ctx context.Context, query xray.StatsQuery) ([]xray.Stat, error) {
+	return d.client.QueryStats(ctx, query)
+}
+
+func (d *apiDriver) Ping(ctx context.Context) error {
+	_, err := d.client.QueryStats(ctx, xray.StatsQuery{Patterns: []string{"inbound>>>"}})
+	return err
+}
+
+// localNode stands in for the node registry while it is empty, so a single
+// server setup keeps working without registering anything.
+var localNode = models.Node{Name: "local", Driver: models.NodeDriverLocal, Enabled: true}
+
+// NodeService fans user provisioning, traffic collection and subscriptions
+// out over all nodes a user is entitled to.
+type NodeService struct {
+	Repo       *repository.NodeRepository
+	Xray       *XrayService
+	APITimeout time.Duration
+	// AgentTLS is used to connect to https agents, e.g. for mTLS.
+	AgentTLS *tls.Config
+
+	mu      sync.Mutex
+	drivers map[uint]cachedDriver
+}
+
+type cachedDriver struct {
+	node   models.Node
+	driver NodeDriver
+}
+
+func NewNodeService(repo *repository.NodeRepository, xrayService *XrayService, apiTimeout time.Duration) *NodeService {
+	return &NodeService{
+		Repo:       repo,
+		Xray:       xrayService,
+		APITimeout: apiTimeout,
+		drivers:    make(map[uint]cachedDriver),
+	}
+}
+
+// Driver returns the driver for node, reusing it while the node's control
+// settings stay the same.
+func (s *NodeService) Driver(node *models.Node) (NodeDriver, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cached, ok := s.drivers[node.ID]; ok {
+		if cached.node.Driver == node.Driver && cached.node.APIAddr == node.APIAddr && cached.node.Secret == node.Secret {
+			return cached.driver, nil
+		}
+		closeDriver(cached.driver)
+		delete(s.drivers, node.ID)
+	}
+
+	var driver NodeDriver
+	switch node.Driver {
+	case models.NodeDriverLocal, "":
+		driver = localDriver{xray: s.Xray}
+	case models.NodeDriverXrayAPI:
+		client, err := xray.NewAPIClient(node.APIAddr, s.APITimeout)
+		if err != nil {
+			return nil, err
+		}
+		driver = &apiDriver{client: client, layout: s.Xray}
+	case models.NodeDriverAgent:
+		driver = &agentDriver{client: agent.NewClient(node.APIAddr, node.Secret, s.APITimeout, s.AgentTLS)}
+	default:
+		return nil, fmt.Errorf("unknown node driver %q", node.Driver)
+	}
+	s.drivers[node.ID] = cachedDriver{node: *node, driver: driver}
+	return driver, nil
+}
+
+// Forget drops the cached driver of a deleted or changed node.
+func (s *NodeService) Forget(nodeID uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cached, ok := s.drivers[nodeID]; ok {
+		closeDriver(cached.driver)
+		delete(s.drivers, nodeID)
+	}
+}
+
+func closeDriver(driver NodeDriver) {
+	switch d := driver.(type) {
+	case *apiDriver:
+		d.client.Close()
+	case *agentDriver:
+		d.client.HTTP.CloseIdleConnections()
+	}
+}
+
+// Nodes returns the enabled nodes, or the implicit local node if none are
+// registered at all.
+func (s *NodeService) Nodes() ([]models.Node, error) {
+	all, err := s.Repo.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(all) == 0 {
+		return []models.Node{localNode}, nil
+	}
+	var enabled []models.Node
+	for _, node := range all {
+		if node.Enabled {
+			enabled = append(enabled, node)
+		}
+	}
+	return enabled, nil
+}
+
+// NodesFor returns the enabled nodes the user's tariff grants and that have
+// room for the user.
+func (s *NodeService) NodesFor(user *models.User) ([]models.Node, error) {
+	nodes, err := s.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	return s.nodesFor(user, nodes)
+}
+
+func (s *NodeService) nodesFor(user *models.User, nodes []models.Node) ([]models.Node, error) {
+	granted, err := s.grantedNodes(user, nodes)
+	if err != nil {
+		return nil, err
+	}
+	return s.withinCapacity(user, granted)
+}
+
+// GrantedNodes returns the enabled nodes the user's tariff grants, whether
+// or not they are full. A tariff without nodes grants all of them.
+func (s *NodeService) GrantedNodes(user *models.User) ([]models.Node, error) {
+	nodes, err := s.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	return s.grantedNodes(user, nodes)
+}
+
+func (s *NodeService) grantedNodes(user *models.User, nodes []models.Node) ([]models.Node, error) {
+	granted, err := s.Repo.GetByTariff(user.TariffID)
+	if err != nil {
+		return nil, err
+	}
+	return entitledNodes(nodes, granted), nil
+}
+
+// withinCapacity drops the nodes that are full for the user. A node with a
+// capacity takes the users it is granted to in order of registration, so
+// users already on it keep their place when it fills up.
+func (s *NodeService) withinCapacity(user *models.User, nodes []models.Node) ([]models.Node, error) {
+	var result []models.Node
+	for _, node := range nodes {
+		if node.Capacity > 0 {
+			ahead, err := s.Repo.CountUsersBefore(node.ID, user.ID)
+			if err != nil {
+				return nil, err
+			}
+			if ahead >= int64(node.Capacity) {
+				continue
+			}
+		}
+		result = append(result, node)
+	}
+	return result, nil
+}
+
+// nodePlacement gives many users their nodes, with the same result as
+// NodesFor for each of them but without queries per user. Every user who
+// may connect must be passed, in order of ID.
+type nodePlacement struct {
+	nodes    *NodeService
+	byTariff map[int][]models.Node
+	placed   map[uint]int
+}
+
+func (s *NodeService) placement() *nodePlacement {
+	return &nodePlacement{nodes: s, byTariff: make(map[int][]models.Node), placed: make(map[uint]int)}
+}
+
+func (p *nodePlacement) nodesFor(user *models.User) ([]models.Node, error) {
+	granted, ok := p.byTariff[user.TariffID]
+	if !ok {
+		var err error
+		if granted, err = p.nodes.GrantedNodes(user); err != nil {
+			return nil, err
+		}
+		p.byTariff[user.TariffID] = granted
+	}
+	var result []models.Node
+	for _, node := range granted {
+		if node.Capacity > 0 && p.placed[node.ID] >= node.Capacity {
+			continue
+		}
+		p.placed[node.ID]++
+		result = append(result, node)
+	}
+	return result, nil
+}
+
+func entitledNodes(nodes, granted []models.Node) []models.Node {
+	if len(granted) == 0 {
+		return nodes
+	}
+	ids := make(map[uint]bool, len(granted))
+	for _, node := range granted {
+		ids[node.ID] = true
+	}
+	var result []models.Node
+	for _, node := range nodes {
+		if ids[node.ID] {
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// ProvisionUser puts the user with the given level on every node they are
+// entitled to and removes them from the others. Every node is tried; the
+// errors of all failed nodes are returned together.
+func (s *NodeService) ProvisionUser(user *models.User, level int) error {
+	nodes, err := s.Nodes()
+	if err != nil {
+		return err
+	}
+	targets, err := s.nodesFor(user, nodes)
+	if err != nil {
+		return err
+	}
+	entitled := make(map[uint]bool)
+	for _, node := range targets {
+		entitled[node.ID] = true
+	}
+
+	return s.each(nodes, func(node *models.Node, driver NodeDriver) error {
+		if entitled[node.ID] {
+			return driver.SyncUser(user, level)
+		}
+		return driver.RemoveUser(user)
+	})
+}
+
+// DeprovisionUser removes the user from every node.
+func (s *NodeService) DeprovisionUser(user *models.User) error {
+	nodes, err := s.Nodes()
+	if err != nil {
+		return err
+	}
+	return s.each(nodes, func(node *models.Node, driver NodeDriver) error {
+		return driver.RemoveUser(user)
+	})
+}
+
+func (s *NodeService) each(nodes []models.Node, fn func(node *models.Node, driver NodeDriver) error) error {
+	var errs []error
+	for i := range nodes {
+		node := &nodes[i]
+		driver, err := s.Driver(node)
+		if err == nil {
+			err = fn(node, driver)
+		}
+		if err != nil {
+			s.markFailed(node, err)
+			errs = append(errs, fmt.Errorf("node %s: %w", node.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// configSyncer is implemented by drivers that can replace the whole config
+// of their node.
+type configSyncer interface {
+	Sync(ctx context.Context, req agent.SyncRequest) error
+}
+
+// SyncNode replaces the node's config with the local layout holding exactly
+// the given users, and restarts its Xray.
+func (s *NodeService) SyncNode(ctx context.Context, node *models.Node, users []agent.UserRequest) error {
+	driver, err := s.Driver(node)
+	if err != nil {
+		return err
+	}
+	syncer, ok := driver.(configSyncer)
+	if !ok {
+		return fmt.Errorf("driver %s of node %s does not support config sync", node.Driver, node.Name)
+	}
+
+	config, err := s.Xray.loadConfig()
+	if err != nil {
+		return err
+	}
+	for _, inbound := range config.ClientInbounds() {
+		inbound.ClearClients()
+	}
+	layout, err := config.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := syncer.Sync(ctx, agent.SyncRequest{Config: layout, Users: users}); err != nil {
+		s.markFailed(node, err)
+		return err
+	}
+	return nil
+}
+
+// QueryStats runs the query on every enabled node and sums counters with
+// the same name. Nodes that fail are skipped, so with Reset their counters
+// stay in place for the next run; an error is returned only if no node
+// answered.
+func (s *NodeService) QueryStats(ctx context.Context, query xray.StatsQuery) ([]xray.Stat, error) {
+	nodes, err := s.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]int64)
+	var order []string
+	var lastErr error
+	answered := 0
+	for i := range nodes {
+		node := &nodes[i]
+		driver, err := s.Driver(node)
+		var stats []xray.Stat
+		if err == nil {
+			stats, err = driver.QueryStats(ctx, query)
+		}
+		if err != nil {
+			s.markFailed(node, err)
+			lastErr = fmt.Errorf("node %s: %w", node.Name, err)
+			continue
+		}
+		answered++
+		for _, stat := range stats {
+			if _, ok := totals[stat.Name]; !ok {
+				order = append(order, stat.Name)
+			}
+			totals[stat.Name] += stat.Value
+		}
+	}
+	if answered == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	stats := make([]xray.Stat, 0, len(order))
+	for _, name := range order {
+		stats = append(stats, xray.Stat{Name: name, Value: totals[name]})
+	}
+	return stats, nil
+}
+
+// Start checks the health of all nodes every interval until ctx is cancelled.
+func (s *NodeService) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.CheckAll(ctx); err != nil {
+					log.Printf("Node health check failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// CheckAll pings every registered node, disabled ones included, and stores
+// the result.
+func (s *NodeService) CheckAll(ctx context.Context) error {
+	nodes, err := s.Repo.GetAll()
+	if err != nil {
+		return err
+	}
+	for i := range nodes {
+		s.Check(ctx, &nodes[i])
+	}
+	return nil
+}
+
+// Check pings one node and stores its status.
+func (s *NodeService) Check(ctx context.Context, node *models.Node) {
+	driver, err := s.Driver(node)
+	if err == nil {
+		err = driver.Ping(ctx)
+	}
+	if err != nil {
+		s.markFailed(node, err)
+		return
+	}
+	now := time.Now()
+	node.Status, node.LastError, node.LastSeenAt = models.NodeStatusOnline, "", &now
+	if node.ID == 0 {
+		return
+	}
+	if err := s.Repo.UpdateStatus(node.ID, node.Status, "", &now); err != nil {
+		log.Printf("Failed to store status of node %s: %v", node.Name, err)
+	}
+}
+
+func (s *NodeService) markFailed(node *models.Node, cause error) {
+	log.Printf("Node %s failed: %v", node.Name, cause)
+	node.Status, node.LastError = models.NodeStatusOffline, cause.Error()
+	// У неявной локальной ноды нет записи в базе
+	if node.ID == 0 {
+		return
+	}
+	if err := s.Repo.UpdateStatus(node.ID, node.Status, node.LastError, nil); err != nil {
+		log.Printf("Failed to store status of node %s: %v", node.Name, err)
+	}
+}
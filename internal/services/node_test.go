@@ -0,0 +1,111 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/xray"
+	"vpn-backend/internal/xray/xraytest"
+)
+
+func TestAPIDriverMirrorsLocalLayout(t *testing.T) {
+	server := xraytest.NewServer("vless-ws", "trojan-tcp")
+	defer server.Close()
+
+	client, err := xray.NewAPIClient(server.Addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	err = os.WriteFile(configPath, []byte(`{
+		"inbounds": [
+			{"tag": "vless-ws", "port": 10000, "protocol": "vless", "settings": {"clients": [], "decryption": "none"}},
+			{"tag": "trojan-tcp", "port": 10001, "protocol": "trojan", "settings": {"clients": []}}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver := &apiDriver{client: client, layout: &XrayService{ConfigPath: configPath, Controller: &countingController{}}}
+	user := &models.User{Email: "remote@example.com", UUID: "remote-uuid"}
+	user.Tariff.InboundTags = []string{"vless-ws"}
+
+	if err := driver.SyncUser(user, 1); err != nil {
+		t.Fatalf("Failed to sync user: %v", err)
+	}
+	if users := server.Users("vless-ws"); len(users) != 1 || users[0].ID != user.UUID || users[0].Level != 1 {
+		t.Fatalf("Expected user in vless-ws with level 1, got %+v", users)
+	}
+
+	// Смена тарифа переносит пользователя между inbound'ами
+	user.Tariff.InboundTags = []string{"trojan-tcp"}
+	if err := driver.SyncUser(user, 2); err != nil {
+		t.Fatalf("Failed to resync user: %v", err)
+	}
+	if users := server.Users("vless-ws"); len(users) != 0 {
+		t.Fatalf("Expected user to leave vless-ws, got %+v", users)
+	}
+	if users := server.Users("trojan-tcp"); len(users) != 1 || users[0].Level != 2 || users[0].Password == "" {
+		t.Fatalf("Expected user in trojan-tcp with level 2 and a password, got %+v", users)
+	}
+
+	if err := driver.RemoveUser(user); err != nil {
+		t.Fatalf("Failed to remove user: %v", err)
+	}
+	if err := driver.RemoveUser(user); err != nil {
+		t.Fatalf("Removing an absent user should succeed, got %v", err)
+	}
+	if users := server.Users("trojan-tcp"); len(users) != 0 {
+		t.Fatalf("Expected user to be removed, got %+v", users)
+	}
+}
+
+func TestEntitledNodes(t *testing.T) {
+	nodes := make([]models.Node, 3)
+	for i := range nodes {
+		nodes[i].ID = uint(i + 1)
+	}
+
+	if got := entitledNodes(nodes, nil); len(got) != 3 {
+		t.Fatalf("Tariff without nodes should grant all, got %+v", got)
+	}
+	// Отключенная нода (ее нет в nodes) не выдается, даже если есть в тарифе
+	granted := []models.Node{nodes[1], {}}
+	granted[1].ID = 7
+	got := entitledNodes(nodes, granted)
+	if len(got) != 1 || got[0].ID != 2 {
+		t.Fatalf("Expected only node 2, got %+v", got)
+	}
+}
+
+func TestNodePlacementCapacity(t *testing.T) {
+	full := models.Node{Capacity: 2}
+	full.ID = 1
+	open := models.Node{}
+	open.ID = 2
+	placement := &nodePlacement{
+		byTariff: map[int][]models.Node{1: {full, open}},
+		placed:   make(map[uint]int),
+	}
+
+	for i, want := range []int{2, 2, 1} {
+		user := &models.User{TariffID: 1}
+		user.ID = uint(i + 1)
+		nodes, err := placement.nodesFor(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) != want {
+			t.Fatalf("User %d: expected %d nodes, got %+v", user.ID, want, nodes)
+		}
+	}
+	// Третий пользователь не поместился на полную ноду
+	if placement.placed[full.ID] != 2 || placement.placed[open.ID] != 3 {
+		t.Errorf("Unexpected placement %+v", placement.placed)
+	}
+}
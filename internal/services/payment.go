@@ -1,7 +1,9 @@
 package services
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"time"
 	"vpn-backend/internal/models"
 	"vpn-backend/internal/repository"
@@ -21,6 +23,7 @@ type PaymentService struct {
 	UserRepo   *repository.UserRepository
 	TariffRepo *repository.TariffRepository
 	Xray       *XrayService
+	Enforcer   *QuotaEnforcer
 }
 
 func NewPaymentService(userRepo *repository.UserRepository, tariffRepo *repository.TariffRepository) *PaymentService {
@@ -42,29 +45,78 @@ func (p *PaymentService) XrayService() *XrayService {
 	return p.Xray
 }
 
-func (p *PaymentService) ChangeTariff(userID int, tariffID int) error {
+func (p *PaymentService) AttachQuotaEnforcer(e *QuotaEnforcer) {
+	p.Enforcer = e
+}
+
+// syncAccess brings the user's Xray access in line with their tariff after
+// a tariff change or payment, lifting quota restrictions that no longer apply.
+func (p *PaymentService) syncAccess(userID int) error {
+	if p.Enforcer != nil {
+		return p.Enforcer.Evaluate(userID)
+	}
+	if p.Xray == nil {
+		return nil
+	}
+	user, err := p.UserRepo.FindByID(userID)
+	if err != nil {
+		return fmt.Errorf("user not found: %w", err)
+	}
+	if !user.CanConnect() {
+		return nil
+	}
+	return p.Xray.UpdateUserTariff(user, user.Tariff.XrayLevel)
+}
+
+// ChangeTariff orders another tariff for the user: it creates a pending
+// payment at the tariff's price and changes nothing else. The tariff, its
+// limits and a new period take effect only when billing completes the
+// payment (see SetPaymentStatus); until then the user keeps their tariff
+// and access state, otherwise anyone could lift their own quota.
+func (p *PaymentService) ChangeTariff(userID int, tariffID int, paymentMethod string) (*models.Payment, error) {
 	// Проверяем, существует ли пользователь
 	_, err := p.UserRepo.FindByID(userID)
 	if err != nil {
-		return fmt.Errorf("user not found: %w", err)
+		return nil, fmt.Errorf("user not found: %w", err)
 	}
 
 	// Проверяем, существует ли тариф
-	_, err = p.TariffRepo.FindByID(tariffID)
+	tariff, err := p.TariffRepo.FindByID(tariffID)
 	if err != nil {
-		return fmt.Errorf("tariff not found: %w", err)
+		return nil, fmt.Errorf("tariff not found: %w", err)
 	}
 
-	// Обновляем тариф пользователя
+	payment := &models.Payment{
+		UserID:        userID,
+		Amount:        int(math.Round(tariff.Price)),
+		TariffID:      tariffID,
+		PaymentMethod: paymentMethod,
+		Status:        models.PaymentPending,
+		CreatedAt:     time.Now(),
+	}
+	if err := p.UserRepo.CreatePayment(payment); err != nil {
+		return nil, fmt.Errorf("failed to create payment: %w", err)
+	}
+	return payment, nil
+}
+
+// activateTariff starts a paid period: the tariff for a month with no
+// traffic used, and access restored.
+func (p *PaymentService) activateTariff(userID int, tariffID int) error {
 	if err := p.UserRepo.UpdateUserTariff(userID, tariffID); err != nil {
 		return fmt.Errorf("failed to update user tariff: %w", err)
 	}
-
-	// Обновляем дату окончания подписки
 	expiry := time.Now().AddDate(0, 1, 0)
 	if err := p.UserRepo.UpdateTariffExpiry(userID, expiry); err != nil {
 		return fmt.Errorf("failed to update tariff expiry: %w", err)
 	}
+	if err := p.UserRepo.UpdateUsedTraffic(userID, 0); err != nil {
+		return fmt.Errorf("failed to reset used traffic: %w", err)
+	}
+
+	if err := p.syncAccess(userID); err != nil {
+		return fmt.Errorf("failed to update access: %w", err)
+	}
 
 	return nil
 }
@@ -80,6 +132,10 @@ func (p *PaymentService) AutoRenewSubscription(userID int) error {
 		return fmt.Errorf("failed to update tariff expiry: %w", err)
 	}
 
+	if err := p.syncAccess(userID); err != nil {
+		return fmt.Errorf("failed to update access: %w", err)
+	}
+
 	return nil
 }
 
@@ -131,7 +187,7 @@ func (p *PaymentService) CreatePayment(userID int, amount int, tariffID int, pay
 		Amount:        amount,
 		TariffID:      tariffID,
 		PaymentMethod: paymentMethod,
-		Status:        "pending",
+		Status:        models.PaymentPending,
 		CreatedAt:     time.Now(),
 	}
 
@@ -150,6 +206,46 @@ func (p *PaymentService) GetPaymentByID(userID int, paymentID string) (*models.P
 	return p.UserRepo.GetPaymentByID(userID, paymentID)
 }
 
-func (p *PaymentService) UpdatePaymentStatus(userID int, paymentID string, status string) error {
-	return p.UserRepo.UpdatePaymentStatus(userID, paymentID, status)
+var (
+	// ErrPaymentNotPending is returned when a payment was already completed
+	// or cancelled.
+	ErrPaymentNotPending = repository.ErrPaymentNotPending
+	ErrPaymentNotFound   = repository.ErrPaymentNotFound
+)
+
+// ErrInvalidPaymentStatus is returned for statuses a payment cannot be moved to.
+var ErrInvalidPaymentStatus = errors.New("invalid payment status")
+
+// CancelPayment cancels the user's own pending payment. Users cannot set any
+// other status.
+func (p *PaymentService) CancelPayment(userID int, paymentID string) error {
+	payment, err := p.UserRepo.GetPaymentByID(userID, paymentID)
+	if err != nil {
+		return err
+	}
+	return p.UserRepo.FinishPayment(payment.ID, models.PaymentCancelled)
+}
+
+// SetPaymentStatus records the outcome of a pending payment as reported by
+// billing staff. A completed payment activates the paid tariff.
+func (p *PaymentService) SetPaymentStatus(paymentID string, status string) error {
+	switch status {
+	case models.PaymentCompleted, models.PaymentFailed, models.PaymentCancelled:
+	default:
+		return ErrInvalidPaymentStatus
+	}
+
+	payment, err := p.UserRepo.GetPayment(paymentID)
+	if err != nil {
+		return err
+	}
+	if err := p.UserRepo.FinishPayment(payment.ID, status); err != nil {
+		return err
+	}
+
+	// Оплата прошла — подключаем оплаченный тариф и снимаем ограничения
+	if status == models.PaymentCompleted {
+		return p.activateTariff(payment.UserID, payment.TariffID)
+	}
+	return nil
 }
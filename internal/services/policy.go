@@ -0,0 +1,90 @@
+package services
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/xray"
+)
+
+func boolOrTrue(value *bool) bool {
+	return value == nil || *value
+}
+
+// tariffPolicy returns the policy level of the tariff on top of base, which
+// keeps the fields the tariff doesn't manage.
+func tariffPolicy(tariff *models.Tariff, base xray.PolicyLevel) xray.PolicyLevel {
+	level := base
+	level.Handshake = tariff.HandshakeTimeout
+	level.ConnIdle = tariff.ConnIdleTimeout
+	level.BufferSize = tariff.BufferSize
+	level.StatsUserUplink = boolOrTrue(tariff.StatsUserUplink)
+	level.StatsUserDownlink = boolOrTrue(tariff.StatsUserDownlink)
+	return level
+}
+
+// CheckPolicyLevels reports tariffs that share a level but not a policy.
+func CheckPolicyLevels(tariffs []models.Tariff) error {
+	_, err := applyPolicyLevels(&xray.Config{}, tariffs)
+	return err
+}
+
+// applyPolicyLevels writes the level of every tariff into policy.levels and
+// reports whether the config changed. Levels no tariff uses, e.g. the quota
+// throttle level, are left as they are.
+func applyPolicyLevels(config *xray.Config, tariffs []models.Tariff) (bool, error) {
+	if config.Policy == nil {
+		config.Policy = &xray.Policy{}
+	}
+	if config.Policy.Levels == nil {
+		config.Policy.Levels = make(map[string]xray.PolicyLevel)
+	}
+
+	changed := false
+	owners := make(map[int]*models.Tariff)
+	for i := range tariffs {
+		tariff := &tariffs[i]
+		if tariff.XrayLevel < 0 {
+			return false, fmt.Errorf("tariff %q has negative level %d", tariff.Name, tariff.XrayLevel)
+		}
+		key := strconv.Itoa(tariff.XrayLevel)
+		current := config.Policy.Levels[key]
+		level := tariffPolicy(tariff, current)
+
+		if owner, ok := owners[tariff.XrayLevel]; ok {
+			if !reflect.DeepEqual(tariffPolicy(owner, current), level) {
+				return false, fmt.Errorf("tariffs %q and %q share level %d but not a policy", owner.Name, tariff.Name, tariff.XrayLevel)
+			}
+			continue
+		}
+		owners[tariff.XrayLevel] = tariff
+
+		if existing, ok := config.Policy.Levels[key]; !ok || !reflect.DeepEqual(existing, level) {
+			config.Policy.Levels[key] = level
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// SyncPolicyLevels brings policy.levels in line with the tariffs. Xray reads
+// policies only at start, so a change restarts it.
+func (s *XrayService) SyncPolicyLevels(tariffs []models.Tariff) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, err := s.readConfig()
+	if err != nil {
+		return err
+	}
+	changed, err := applyPolicyLevels(config, tariffs)
+	if err != nil || !changed {
+		return err
+	}
+	if err := s.marshalConfig(config, "sync tariff policy levels"); err != nil {
+		return err
+	}
+	s.ScheduleRestart()
+	return nil
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/xray"
+)
+
+func TestApplyPolicyLevels(t *testing.T) {
+	config, err := xray.ParseConfig([]byte(`{
+		"policy": {"levels": {
+			"0": {"handshake": 4, "uplinkOnly": 2, "custom": "kept"},
+			"9": {"connIdle": 30}
+		}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake, idle, buffer := 8, 600, 512
+	disabled := false
+	tariffs := []models.Tariff{
+		{Name: "Basic", XrayLevel: 0, ConnIdleTimeout: &idle},
+		{Name: "Premium", XrayLevel: 2, HandshakeTimeout: &handshake, BufferSize: &buffer, StatsUserUplink: &disabled},
+		{Name: "Basic yearly", XrayLevel: 0, ConnIdleTimeout: &idle},
+	}
+
+	changed, err := applyPolicyLevels(config, tariffs)
+	if err != nil || !changed {
+		t.Fatalf("Expected the levels to change, got %v, %v", changed, err)
+	}
+	if changed, _ := applyPolicyLevels(config, tariffs); changed {
+		t.Error("Expected no change on the second run")
+	}
+
+	encoded, err := config.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Policy struct {
+			Levels map[string]map[string]interface{} `json:"levels"`
+		} `json:"policy"`
+	}
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	basic := got.Policy.Levels["0"]
+	if basic["handshake"] != nil || basic["connIdle"] != float64(600) || basic["uplinkOnly"] != float64(2) ||
+		basic["custom"] != "kept" || basic["statsUserUplink"] != true || basic["statsUserDownlink"] != true {
+		t.Errorf("Unexpected level 0: %v", basic)
+	}
+	premium := got.Policy.Levels["2"]
+	if premium["handshake"] != float64(8) || premium["bufferSize"] != float64(512) ||
+		premium["statsUserUplink"] != nil || premium["statsUserDownlink"] != true {
+		t.Errorf("Unexpected level 2: %v", premium)
+	}
+	if got.Policy.Levels["9"]["connIdle"] != float64(30) {
+		t.Errorf("Expected a level without tariffs to be kept, got %v", got.Policy.Levels["9"])
+	}
+
+	tariffs[2].ConnIdleTimeout = nil
+	if err := CheckPolicyLevels(tariffs); err == nil {
+		t.Error("Expected tariffs sharing a level with different policies to be rejected")
+	}
+}
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"vpn-backend/internal/agent"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/repository"
+)
+
+// Причины ограничения доступа, которые видит пользователь
+const (
+	ReasonTrafficExceeded = "traffic limit exceeded"
+	ReasonTariffExpired   = "tariff expired"
+)
+
+// QuotaEnforcer restricts users who ran out of traffic or whose tariff
+// expired, and gives access back once that is no longer the case.
+type QuotaEnforcer struct {
+	UserRepo *repository.UserRepository
+	Nodes    *NodeService
+	Interval time.Duration
+	// ThrottleLevel is the Xray level over-quota users are moved to. A
+	// negative value removes them from Xray instead.
+	ThrottleLevel int
+}
+
+func NewQuotaEnforcer(userRepo *repository.UserRepository, nodes *NodeService, interval time.Duration, throttleLevel int) *QuotaEnforcer {
+	return &QuotaEnforcer{
+		UserRepo:      userRepo,
+		Nodes:         nodes,
+		Interval:      interval,
+		ThrottleLevel: throttleLevel,
+	}
+}
+
+// Start runs the enforcement loop until ctx is cancelled.
+func (e *QuotaEnforcer) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(e.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := e.EnforceAll(); err != nil {
+					log.Printf("Quota enforcement failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// violation returns why the user should not have full access, or "".
+func violation(user *models.User, now time.Time) string {
+	if user.Tariff.TrafficLimit > 0 && user.UsedTraffic > user.Tariff.TrafficLimit {
+		return ReasonTrafficExceeded
+	}
+	if !user.TariffExpiresAt.IsZero() && now.After(user.TariffExpiresAt) {
+		return ReasonTariffExpired
+	}
+	return ""
+}
+
+// EnforceAll checks every user and acts only on state transitions.
+func (e *QuotaEnforcer) EnforceAll() error {
+	users, err := e.UserRepo.GetAllUsers()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range users {
+		user := &users[i]
+		if !user.CanConnect() {
+			continue
+		}
+		reason := violation(user, now)
+		restricted := user.AccessState != "" && user.AccessState != models.AccessActive
+		if (reason != "") == restricted && reason == user.AccessReason {
+			continue
+		}
+		if err := e.apply(user, reason); err != nil {
+			log.Printf("Failed to enforce quota for user %d: %v", user.ID, err)
+		}
+	}
+	return nil
+}
+
+// Evaluate re-checks one user and brings Xray in line with the result,
+// even if the state did not change. It is called after payments and tariff
+// changes.
+func (e *QuotaEnforcer) Evaluate(userID int) error {
+	user, err := e.UserRepo.FindByID(userID)
+	if err != nil {
+		return err
+	}
+	if !user.CanConnect() {
+		return nil
+	}
+	return e.apply(user, violation(user, time.Now()))
+}
+
+// EvaluateTariff re-provisions every user of the tariff, e.g. after its
+// inbounds or nodes changed.
+func (e *QuotaEnforcer) EvaluateTariff(tariffID int) error {
+	users, err := e.UserRepo.GetUsersByTariff(tariffID)
+	if err != nil {
+		return err
+	}
+	return e.evaluateUsers(users)
+}
+
+// EvaluateAll re-provisions every user, e.g. after a node was added.
+func (e *QuotaEnforcer) EvaluateAll() error {
+	users, err := e.UserRepo.GetAllUsers()
+	if err != nil {
+		return err
+	}
+	return e.evaluateUsers(users)
+}
+
+func (e *QuotaEnforcer) evaluateUsers(users []models.User) error {
+	now := time.Now()
+	var errs []error
+	for i := range users {
+		user := &users[i]
+		if !user.CanConnect() {
+			continue
+		}
+		if err := e.apply(user, violation(user, now)); err != nil {
+			errs = append(errs, fmt.Errorf("user %d: %w", user.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// access returns the state and Xray level a user gets for a violation
+// reason. The level is meaningless for suspended users.
+func (e *QuotaEnforcer) access(user *models.User, reason string) (string, int) {
+	switch {
+	case reason == "":
+		return models.AccessActive, user.Tariff.XrayLevel
+	case e.ThrottleLevel >= 0:
+		return models.AccessThrottled, e.ThrottleLevel
+	default:
+		return models.AccessSuspended, 0
+	}
+}
+
+func (e *QuotaEnforcer) apply(user *models.User, reason string) error {
+	state, level := e.access(user, reason)
+	var err error
+	if state == models.AccessSuspended {
+		err = e.Nodes.DeprovisionUser(user)
+	} else {
+		err = e.Nodes.ProvisionUser(user, level)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update Xray: %w", err)
+	}
+
+	if state == user.AccessState && reason == user.AccessReason {
+		return nil
+	}
+	log.Printf("User %d access %s -> %s (%s)", user.ID, user.AccessState, state, reason)
+	return e.UserRepo.SetAccessState(int(user.ID), state, reason)
+}
+
+// SyncNode rewrites the node's whole config with every user that should be
+// on it, e.g. after the node was reinstalled or lost its users in a restart.
+func (e *QuotaEnforcer) SyncNode(ctx context.Context, node *models.Node) error {
+	users, err := e.UserRepo.GetAllUsers()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	placement := e.Nodes.placement() // без запросов к базе на каждого пользователя
+	var requests []agent.UserRequest
+	for i := range users {
+		user := &users[i]
+		if !user.CanConnect() {
+			continue
+		}
+		nodes, err := placement.nodesFor(user)
+		if err != nil {
+			return err
+		}
+		state, level := e.access(user, violation(user, now))
+		if state == models.AccessSuspended {
+			continue
+		}
+		for _, n := range nodes {
+			if n.ID == node.ID {
+				requests = append(requests, agentUserRequest(user, level))
+			}
+		}
+	}
+
+	return e.Nodes.SyncNode(ctx, node, requests)
+}
+
+// SyncAgentNodes pushes the local layout with its users to every node run
+// by an agent, e.g. after the policy levels changed.
+func (e *QuotaEnforcer) SyncAgentNodes(ctx context.Context) error {
+	nodes, err := e.Nodes.Nodes()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := range nodes {
+		if nodes[i].Driver != models.NodeDriverAgent {
+			continue
+		}
+		if err := e.SyncNode(ctx, &nodes[i]); err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", nodes[i].Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,28 @@
+package services
+
+import (
+	"testing"
+	"time"
+	"vpn-backend/internal/models"
+)
+
+func TestViolation(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		user models.User
+		want string
+	}{
+		{"within limit", models.User{UsedTraffic: 10, Tariff: models.Tariff{TrafficLimit: 100}}, ""},
+		{"unlimited tariff", models.User{UsedTraffic: 1 << 40}, ""},
+		{"over limit", models.User{UsedTraffic: 101, Tariff: models.Tariff{TrafficLimit: 100}}, ReasonTrafficExceeded},
+		{"expired", models.User{TariffExpiresAt: now.Add(-time.Hour)}, ReasonTariffExpired},
+		{"not expired", models.User{TariffExpiresAt: now.Add(time.Hour)}, ""},
+		{"no expiry set", models.User{}, ""},
+	}
+	for _, tt := range tests {
+		if got := violation(&tt.user, now); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/repository"
+	"vpn-backend/internal/xray"
+)
+
+// Виды расхождений между базой и конфигом Xray
+const (
+	DriftMissing   = "missing"   // пользователь должен быть в inbound'е, но его нет
+	DriftStale     = "stale"     // клиент в inbound'е, но доступа у него быть не должно
+	DriftLevel     = "level"     // клиент есть, но с другим уровнем
+	DriftDuplicate = "duplicate" // клиент записан в inbound'е несколько раз
+	DriftInbound   = "inbound"   // у тарифа пользователя есть inbound, которого нет на ноде
+)
+
+// Состояния ноды в отчете о расхождениях
+const (
+	NodeInSync      = "ok"
+	NodeDrifted     = "drift"
+	NodeError       = "error"
+	NodeUnsupported = "unsupported" // драйвер не показывает конфиг, сверять не с чем
+)
+
+// ClientDrift is one difference between the database and a node config.
+type ClientDrift struct {
+	Kind    string `json:"kind"`
+	Inbound string `json:"inbound"`
+	UUID    string `json:"uuid"`
+	Email   string `json:"email"`
+	// UserID is 0 for clients that belong to no user in the database.
+	UserID    uint `json:"user_id,omitempty"`
+	Level     int  `json:"level"`
+	WantLevel int  `json:"want_level"`
+	// Error explains a DriftInbound; such users are left as they are.
+	Error string `json:"error,omitempty"`
+}
+
+// NodeDrift lists the differences found on one node.
+type NodeDrift struct {
+	Node    string        `json:"node"`
+	NodeID  uint          `json:"node_id"`
+	Status  string        `json:"status"`
+	Error   string        `json:"error,omitempty"`
+	Clients []ClientDrift `json:"clients"`
+}
+
+// configReader is implemented by drivers that can show their node's config.
+// Nodes whose driver can't, like xray-api, are reported as unsupported.
+type configReader interface {
+	Config(ctx context.Context) (*xray.Config, error)
+}
+
+func (d localDriver) Config(ctx context.Context) (*xray.Config, error) {
+	return d.xray.loadConfig()
+}
+
+func (d *agentDriver) Config(ctx context.Context) (*xray.Config, error) {
+	data, err := d.client.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return xray.ParseConfig(data)
+}
+
+// Reconciler brings the clients in the Xray configs back in line with the
+// database: users that should have access (not banned, not suspended by
+// quota) are put into the inbounds of their tariff on their nodes, and
+// everything else is removed.
+type Reconciler struct {
+	UserRepo *repository.UserRepository
+	Nodes    *NodeService
+	Enforcer *QuotaEnforcer
+	Interval time.Duration
+}
+
+func NewReconciler(userRepo *repository.UserRepository, nodes *NodeService, enforcer *QuotaEnforcer, interval time.Duration) *Reconciler {
+	return &Reconciler{
+		UserRepo: userRepo,
+		Nodes:    nodes,
+		Enforcer: enforcer,
+		Interval: interval,
+	}
+}
+
+// Start runs Reconcile every interval until ctx is cancelled.
+func (r *Reconciler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := r.Reconcile(ctx); err != nil {
+					log.Printf("Xray reconciliation failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// desiredUser is a user that should be in Xray, with their level.
+type desiredUser struct {
+	user  *models.User
+	level int
+}
+
+// desired returns the users that should have access on each node, keyed by
+// node ID and UUID.
+func (r *Reconciler) desired() (map[uint]map[string]desiredUser, error) {
+	users, err := r.UserRepo.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result := make(map[uint]map[string]desiredUser)
+	placement := r.Nodes.placement()
+	for i := range users {
+		user := &users[i]
+		if !user.CanConnect() {
+			continue
+		}
+		// Место на ноде занимают и пользователи с ограниченным доступом
+		nodes, err := placement.nodesFor(user)
+		if err != nil {
+			return nil, err
+		}
+		state, level := r.Enforcer.access(user, violation(user, now))
+		if state == models.AccessSuspended {
+			continue
+		}
+		for _, node := range nodes {
+			if result[node.ID] == nil {
+				result[node.ID] = make(map[string]desiredUser)
+			}
+			result[node.ID][user.UUID] = desiredUser{user: user, level: level}
+		}
+	}
+	return result, nil
+}
+
+// Plan reports what Reconcile would change, without changing anything.
+func (r *Reconciler) Plan(ctx context.Context) ([]NodeDrift, error) {
+	drifts, _, _, err := r.plan(ctx)
+	return drifts, err
+}
+
+// plan returns the drift of every node along with the nodes and the desired
+// users it was computed from.
+func (r *Reconciler) plan(ctx context.Context) ([]NodeDrift, []models.Node, map[uint]map[string]desiredUser, error) {
+	desired, err := r.desired()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nodes, err := r.Nodes.Nodes()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	drifts := make([]NodeDrift, 0, len(nodes))
+	for i := range nodes {
+		node := &nodes[i]
+		drift := NodeDrift{Node: node.Name, NodeID: node.ID, Status: NodeInSync, Clients: []ClientDrift{}}
+		driver, err := r.Nodes.Driver(node)
+		if err != nil {
+			drift.Status, drift.Error = NodeError, err.Error()
+			drifts = append(drifts, drift)
+			continue
+		}
+		reader, ok := driver.(configReader)
+		if !ok {
+			drift.Status = NodeUnsupported
+			drifts = append(drifts, drift)
+			continue
+		}
+		config, err := reader.Config(ctx)
+		if err != nil {
+			drift.Status, drift.Error = NodeError, err.Error()
+		} else if drift.Clients = diffClients(config, desired[node.ID], r.Nodes.Xray.InboundTagsFor); len(drift.Clients) > 0 {
+			drift.Status = NodeDrifted
+		}
+		drifts = append(drifts, drift)
+	}
+	return drifts, nodes, desired, nil
+}
+
+// diffClients compares the clients of every client inbound with the users
+// that should be there. A user whose tariff names an inbound the node
+// doesn't have gets one DriftInbound entry and their clients are not
+// compared, so the rest of the node can still be reconciled.
+func diffClients(config *xray.Config, want map[string]desiredUser, tagsFor func(*models.User) []string) []ClientDrift {
+	drifts := []ClientDrift{}
+	// Для каждого пользователя — набор inbound'ов, где он должен быть
+	wantIn := make(map[string]map[string]bool)
+	unresolved := make(map[string]bool)
+	for uuid, d := range want {
+		targets, err := targetInbounds(config, tagsFor(d.user))
+		if err != nil {
+			unresolved[uuid] = true
+			drifts = append(drifts, ClientDrift{
+				Kind:      DriftInbound,
+				UUID:      uuid,
+				Email:     d.user.Email,
+				UserID:    d.user.ID,
+				WantLevel: d.level,
+				Error:     err.Error(),
+			})
+			continue
+		}
+		wantIn[uuid] = make(map[string]bool, len(targets))
+		for _, inbound := range targets {
+			wantIn[uuid][inbound.Tag] = true
+		}
+	}
+
+	for _, inbound := range config.ClientInbounds() {
+		seen := make(map[string]bool)
+		for _, client := range inbound.Clients() {
+			if unresolved[client.ID] {
+				continue
+			}
+			d, known := want[client.ID]
+			drift := ClientDrift{Inbound: inbound.Tag, UUID: client.ID, Email: client.Email, Level: client.Level}
+			if known {
+				drift.UserID = d.user.ID
+				drift.WantLevel = d.level
+			}
+			switch {
+			case seen[client.ID]:
+				drift.Kind = DriftDuplicate
+			case !known || !wantIn[client.ID][inbound.Tag]:
+				drift.Kind = DriftStale
+			case client.Level != d.level:
+				drift.Kind = DriftLevel
+			}
+			seen[client.ID] = true
+			if drift.Kind != "" {
+				drifts = append(drifts, drift)
+			}
+		}
+		for uuid, d := range want {
+			if wantIn[uuid][inbound.Tag] && !seen[uuid] {
+				drifts = append(drifts, ClientDrift{
+					Kind:      DriftMissing,
+					Inbound:   inbound.Tag,
+					UUID:      uuid,
+					Email:     d.user.Email,
+					UserID:    d.user.ID,
+					WantLevel: d.level,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(drifts, func(i, j int) bool {
+		if drifts[i].Inbound != drifts[j].Inbound {
+			return drifts[i].Inbound < drifts[j].Inbound
+		}
+		return drifts[i].UUID < drifts[j].UUID
+	})
+	return drifts
+}
+
+// Reconcile fixes the drift on every node and returns what it found.
+// Users with any drift are removed and, if they should have access, synced
+// again, which also drops duplicates. DriftInbound users need their tariff
+// or the node config fixed first and are only reported.
+func (r *Reconciler) Reconcile(ctx context.Context) ([]NodeDrift, error) {
+	drifts, nodes, desired, err := r.plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, drift := range drifts {
+		if drift.Status != NodeDrifted {
+			continue
+		}
+		node := &nodes[i]
+		driver, err := r.Nodes.Driver(node)
+		if err != nil {
+			continue
+		}
+
+		done := make(map[string]bool)
+		fixed := 0
+		for _, client := range drift.Clients {
+			if done[client.UUID] || client.Kind == DriftInbound {
+				continue
+			}
+			done[client.UUID] = true
+			fixed++
+
+			d, ok := desired[node.ID][client.UUID]
+			if client.Kind == DriftDuplicate || !ok {
+				stale := &models.User{UUID: client.UUID, Email: client.Email}
+				if err := driver.RemoveUser(stale); err != nil {
+					log.Printf("Reconcile: failed to remove %s from node %s: %v", client.UUID, node.Name, err)
+					continue
+				}
+			}
+			if ok {
+				if err := driver.SyncUser(d.user, d.level); err != nil {
+					log.Printf("Reconcile: failed to sync %s on node %s: %v", client.UUID, node.Name, err)
+				}
+			}
+		}
+		if fixed > 0 {
+			log.Printf("Reconcile: fixed %d users on node %s", fixed, node.Name)
+		}
+	}
+	return drifts, nil
+}
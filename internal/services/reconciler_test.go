@@ -0,0 +1,76 @@
+package services
+
+import (
+	"testing"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/xray"
+)
+
+func TestDiffClients(t *testing.T) {
+	config, err := xray.ParseConfig([]byte(`{
+		"inbounds": [
+			{"tag": "vless", "port": 10000, "protocol": "vless",
+			 "settings": {"clients": [
+				{"id": "ok-uuid", "email": "ok@example.com", "level": 1},
+				{"id": "level-uuid", "email": "level@example.com", "level": 1},
+				{"id": "deleted-uuid", "email": "deleted@example.com"},
+				{"id": "moved-uuid", "email": "moved@example.com"},
+				{"id": "ok-uuid", "email": "ok@example.com", "level": 1}
+			 ], "decryption": "none"}},
+			{"tag": "trojan", "port": 10001, "protocol": "trojan",
+			 "settings": {"clients": [{"id": "ok-uuid", "password": "ok-uuid", "email": "ok@example.com", "level": 1}]}},
+			{"tag": "bare", "port": 10002, "protocol": "vless"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := func(id uint, uuid string) *models.User {
+		u := &models.User{Email: uuid[:len(uuid)-5] + "@example.com", UUID: uuid}
+		u.ID = id
+		return u
+	}
+	want := map[string]desiredUser{
+		"ok-uuid":      {user: user(1, "ok-uuid"), level: 1},
+		"level-uuid":   {user: user(2, "level-uuid"), level: 2},
+		"missing-uuid": {user: user(3, "missing-uuid"), level: 1},
+		"moved-uuid":   {user: user(4, "moved-uuid"), level: 1},
+	}
+	// ok-uuid должен быть только в vless, а inbound'а moved-uuid на ноде нет
+	tagsFor := func(u *models.User) []string {
+		if u.UUID == "moved-uuid" {
+			return []string{"vless", "vmess"}
+		}
+		return []string{"vless"}
+	}
+
+	drifts := diffClients(config, want, tagsFor)
+
+	expected := []ClientDrift{
+		{Kind: DriftInbound, UUID: "moved-uuid", UserID: 4, WantLevel: 1},
+		{Kind: DriftStale, Inbound: "trojan", UUID: "ok-uuid", UserID: 1, Level: 1, WantLevel: 1},
+		{Kind: DriftStale, Inbound: "vless", UUID: "deleted-uuid"},
+		{Kind: DriftLevel, Inbound: "vless", UUID: "level-uuid", UserID: 2, Level: 1, WantLevel: 2},
+		{Kind: DriftMissing, Inbound: "vless", UUID: "missing-uuid", UserID: 3, WantLevel: 1},
+		{Kind: DriftDuplicate, Inbound: "vless", UUID: "ok-uuid", UserID: 1, Level: 1, WantLevel: 1},
+	}
+	if len(drifts) != len(expected) {
+		t.Fatalf("Expected %d differences, got %+v", len(expected), drifts)
+	}
+	for i, e := range expected {
+		d := drifts[i]
+		if d.Kind != e.Kind || d.Inbound != e.Inbound || d.UUID != e.UUID || d.UserID != e.UserID ||
+			d.Level != e.Level || d.WantLevel != e.WantLevel {
+			t.Errorf("Difference %d: expected %+v, got %+v", i, e, d)
+		}
+	}
+
+	if drifts[0].Error == "" {
+		t.Error("Expected the missing inbound to be explained")
+	}
+
+	if drifts := diffClients(config, nil, tagsFor); len(drifts) != 6 {
+		t.Errorf("Expected every client to be stale without users, got %+v", drifts)
+	}
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// RestartStatus is what the scheduler knows about Xray restarts.
+type RestartStatus struct {
+	// Pending is the number of restart requests waiting to be served.
+	Pending       int        `json:"pending"`
+	Running       bool       `json:"running"`
+	NextAt        *time.Time `json:"next_at,omitempty"`
+	LastStartedAt *time.Time `json:"last_started_at,omitempty"`
+	LastEndedAt   *time.Time `json:"last_ended_at,omitempty"`
+	LastSuccess   bool       `json:"last_success"`
+	LastError     string     `json:"last_error,omitempty"`
+	// Failures counts failed restarts in a row; it drives the backoff.
+	Failures int `json:"failures"`
+}
+
+// restartTimeout bounds one Xray restart, so a hung controller does not
+// block every later restart.
+const restartTimeout = 2 * time.Minute
+
+// RestartScheduler coalesces restart requests: requests that arrive within
+// Window of the first one are served by a single restart, restarts never
+// overlap, and a failed restart is retried with exponential backoff.
+type RestartScheduler struct {
+	Restart    func(ctx context.Context) error
+	Window     time.Duration
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Timeout cancels a restart that takes longer; it counts as failed.
+	// Zero means restartTimeout.
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	status   RestartStatus
+	timerSet bool
+	// runMu держится на время самого перезапуска
+	runMu sync.Mutex
+}
+
+func NewRestartScheduler(restart func(ctx context.Context) error, window time.Duration) *RestartScheduler {
+	return &RestartScheduler{
+		Restart:    restart,
+		Window:     window,
+		MinBackoff: 5 * time.Second,
+		MaxBackoff: 5 * time.Minute,
+		Timeout:    restartTimeout,
+	}
+}
+
+// Request asks for a restart within Window.
+func (s *RestartScheduler) Request() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Pending++
+	// Во время перезапуска только копим запросы: их обслужит следующий
+	if !s.status.Running {
+		s.scheduleLocked(s.Window)
+	}
+}
+
+func (s *RestartScheduler) scheduleLocked(delay time.Duration) {
+	if s.timerSet {
+		return
+	}
+	s.timerSet = true
+	next := time.Now().Add(delay)
+	s.status.NextAt = &next
+	time.AfterFunc(delay, s.fire)
+}
+
+func (s *RestartScheduler) fire() {
+	s.mu.Lock()
+	s.timerSet = false
+	s.status.NextAt = nil
+	s.mu.Unlock()
+
+	if err := s.run(false); err != nil {
+		log.Printf("Scheduled Xray restart failed: %v", err)
+	}
+}
+
+// RestartNow restarts right away, after any restart in progress, and
+// serves every pending request.
+func (s *RestartScheduler) RestartNow() error {
+	return s.run(true)
+}
+
+func (s *RestartScheduler) run(force bool) error {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	s.mu.Lock()
+	served := s.status.Pending
+	if served == 0 && !force {
+		s.mu.Unlock()
+		return nil // уже обслужены RestartNow
+	}
+	s.status.Pending = 0
+	s.status.Running = true
+	started := time.Now()
+	s.status.LastStartedAt = &started
+	s.mu.Unlock()
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = restartTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err := s.Restart(ctx)
+	cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ended := time.Now()
+	s.status.Running = false
+	s.status.LastEndedAt = &ended
+	s.status.LastSuccess = err == nil
+	if err != nil {
+		s.status.LastError = err.Error()
+		s.status.Failures++
+		// Запросы, ради которых был перезапуск, повторяются с паузой
+		s.status.Pending += served
+		if s.status.Pending > 0 {
+			s.scheduleLocked(s.backoff())
+		}
+		return err
+	}
+
+	s.status.LastError = ""
+	s.status.Failures = 0
+	if s.status.Pending > 0 {
+		s.scheduleLocked(s.Window)
+	}
+	return nil
+}
+
+// backoff doubles MinBackoff for every failure in a row, up to MaxBackoff.
+func (s *RestartScheduler) backoff() time.Duration {
+	delay := s.MinBackoff
+	for i := 1; i < s.status.Failures && delay < s.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxBackoff {
+		delay = s.MaxBackoff
+	}
+	return delay
+}
+
+func (s *RestartScheduler) Status() RestartStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
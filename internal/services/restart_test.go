@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a second passes.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the restart scheduler")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRestartSchedulerCoalescesBurst(t *testing.T) {
+	var restarts, running, overlaps int32
+	scheduler := NewRestartScheduler(func(ctx context.Context) error {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&restarts, 1)
+		return nil
+	}, 30*time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scheduler.Request()
+		}()
+	}
+	wg.Wait()
+	if status := scheduler.Status(); status.Pending != 20 || status.NextAt == nil {
+		t.Fatalf("Expected 20 pending requests, got %+v", status)
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&restarts) == 1 })
+	// Запрос во время ручного перезапуска обслуживается ещё одним, не параллельным
+	done := make(chan error)
+	go func() { done <- scheduler.RestartNow() }()
+	waitFor(t, func() bool { return scheduler.Status().Running })
+	scheduler.Request()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&restarts) == 3 })
+
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&restarts); n != 3 {
+		t.Errorf("Expected 3 restarts, got %d", n)
+	}
+	if atomic.LoadInt32(&overlaps) != 0 {
+		t.Error("Restarts overlapped")
+	}
+	if status := scheduler.Status(); !status.LastSuccess || status.Pending != 0 || status.LastEndedAt == nil {
+		t.Errorf("Unexpected final status %+v", status)
+	}
+}
+
+func TestRestartSchedulerRetriesWithBackoff(t *testing.T) {
+	var attempts int32
+	scheduler := NewRestartScheduler(func(ctx context.Context) error {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return errors.New("unit xray not found")
+		}
+		return nil
+	}, time.Millisecond)
+	scheduler.MinBackoff = 10 * time.Millisecond
+	scheduler.MaxBackoff = 15 * time.Millisecond
+
+	scheduler.Request()
+	waitFor(t, func() bool { return scheduler.Status().Failures == 1 })
+	if status := scheduler.Status(); status.LastSuccess || status.LastError != "unit xray not found" || status.Pending != 1 {
+		t.Fatalf("Expected the failure to be reported and retried, got %+v", status)
+	}
+
+	waitFor(t, func() bool { return scheduler.Status().LastSuccess })
+	if status := scheduler.Status(); atomic.LoadInt32(&attempts) != 3 || status.Failures != 0 || status.LastError != "" {
+		t.Errorf("Expected success on the third attempt, got %+v after %d attempts", status, attempts)
+	}
+}
+
+func TestRestartSchedulerBackoff(t *testing.T) {
+	scheduler := NewRestartScheduler(nil, time.Second)
+	for failures, want := range map[int]time.Duration{
+		1: 5 * time.Second,
+		2: 10 * time.Second,
+		4: 40 * time.Second,
+		9: 5 * time.Minute,
+	} {
+		scheduler.status.Failures = failures
+		if got := scheduler.backoff(); got != want {
+			t.Errorf("After %d failures expected %s, got %s", failures, want, got)
+		}
+	}
+}
+
+func TestRestartSchedulerTimesOutHungRestart(t *testing.T) {
+	scheduler := NewRestartScheduler(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, time.Millisecond)
+	scheduler.Timeout = 20 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() { done <- scheduler.RestartNow() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected the restart to time out, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Hung restart was not cancelled")
+	}
+	if status := scheduler.Status(); status.Running || status.Failures != 1 {
+		t.Errorf("Expected a failed restart that is no longer running, got %+v", status)
+	}
+}
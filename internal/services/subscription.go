@@ -0,0 +1,325 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/repository"
+	"vpn-backend/internal/subscription"
+	"vpn-backend/internal/xray"
+)
+
+// SubscriptionService manages the per-user subscription links that VPN
+// clients poll without a JWT.
+type SubscriptionService struct {
+	UserRepo *repository.UserRepository
+	Hosts    *repository.HostRepository
+	Nodes    *NodeService
+	Xray     *XrayService
+	// BaseURL is the public address of the backend, used to build links.
+	BaseURL string
+	// DefaultHost is dialed for inbounds that have no hosts registered. If
+	// empty, such inbounds are left out of subscriptions.
+	DefaultHost string
+	// Title, UpdateInterval and SupportURL go into the profile headers
+	// clients read; empty or zero values are not sent.
+	Title          string
+	UpdateInterval time.Duration
+	SupportURL     string
+}
+
+func NewSubscriptionService(userRepo *repository.UserRepository, hosts *repository.HostRepository, nodes *NodeService, baseURL string) *SubscriptionService {
+	return &SubscriptionService{
+		UserRepo: userRepo,
+		Hosts:    hosts,
+		Nodes:    nodes,
+		Xray:     nodes.Xray,
+		BaseURL:  strings.TrimRight(baseURL, "/"),
+	}
+}
+
+func newSubscriptionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// URL returns the public subscription link for a token.
+func (s *SubscriptionService) URL(token string) string {
+	return s.BaseURL + "/sub/" + token
+}
+
+// RotateToken issues a new token for the user; the old link stops working.
+func (s *SubscriptionService) RotateToken(userID int) (string, error) {
+	token, err := newSubscriptionToken()
+	if err != nil {
+		return "", err
+	}
+	if err := s.UserRepo.UpdateSubscriptionToken(userID, &token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeToken disables the user's subscription link until it is rotated.
+func (s *SubscriptionService) RevokeToken(userID int) error {
+	return s.UserRepo.UpdateSubscriptionToken(userID, nil)
+}
+
+// UserByToken finds the owner of a subscription token. Banned users are
+// treated as unknown.
+func (s *SubscriptionService) UserByToken(token string) (*models.User, error) {
+	if token == "" {
+		return nil, fmt.Errorf("empty subscription token")
+	}
+	user, err := s.UserRepo.GetUserBySubscriptionToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if user.IsBanned {
+		return nil, fmt.Errorf("user is banned")
+	}
+	return user, nil
+}
+
+// Endpoints lists every way the user can connect: one entry per registered
+// host of each inbound of their tariff, on every node they are entitled to.
+func (s *SubscriptionService) Endpoints(user *models.User) ([]subscription.Endpoint, error) {
+	if user.AccessState == models.AccessSuspended || !user.CanConnect() {
+		return nil, nil
+	}
+	config, err := s.Xray.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	inbounds, err := targetInbounds(config, s.Xray.InboundTagsFor(user))
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := s.Hosts.GetEnabled()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := s.Nodes.NodesFor(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []subscription.Endpoint
+	for _, node := range nodes {
+		endpoints = append(endpoints, nodeEndpoints(inbounds, user, node, hosts, s.DefaultHost)...)
+	}
+	return endpoints, nil
+}
+
+// nodeEndpoints builds the endpoints of one node. Hosts without a node
+// belong to the local Xray. Inbounds without hosts are reached at the node
+// address, or at defaultHost on the local node; if there is none they are
+// left out. So are REALITY endpoints whose public key is unknown.
+func nodeEndpoints(inbounds []*xray.Inbound, user *models.User, node models.Node, hosts []models.Host, defaultHost string) []subscription.Endpoint {
+	local := node.Driver == models.NodeDriverLocal || node.Driver == ""
+	byTag := make(map[string][]models.Host)
+	for _, host := range hosts {
+		if host.NodeID == nil && !local || host.NodeID != nil && *host.NodeID != node.ID {
+			continue
+		}
+		byTag[host.InboundTag] = append(byTag[host.InboundTag], host)
+	}
+
+	fallback := models.Host{Address: node.Address}
+	if fallback.Address == "" {
+		fallback.Address = defaultHost
+	} else if !local {
+		fallback.Remark = node.Name
+	}
+
+	var endpoints []subscription.Endpoint
+	for _, inbound := range inbounds {
+		client := inbound.Client(user.UUID)
+		if client == nil {
+			newClient := inbound.NewClient(user.UUID, user.Email, 0)
+			client = &newClient
+		}
+		base := inboundEndpoint(inbound, client)
+
+		inboundHosts := byTag[inbound.Tag]
+		if len(inboundHosts) == 0 && fallback.Address != "" {
+			inboundHosts = []models.Host{fallback}
+		}
+		for _, host := range inboundHosts {
+			endpoint := withHost(base, host)
+			// Без публичного ключа клиент к REALITY не подключится
+			if endpoint.Security == "reality" && endpoint.PublicKey == "" {
+				continue
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// inboundEndpoint describes inbound with client's credentials, as far as the
+// inbound settings alone tell. The address comes from a host.
+func inboundEndpoint(inbound *xray.Inbound, client *xray.Client) subscription.Endpoint {
+	endpoint := subscription.Endpoint{
+		Remark:   inbound.Tag,
+		Protocol: inbound.Protocol,
+		Port:     inbound.Port.First(),
+		ID:       client.ID,
+		Password: client.Password,
+		Flow:     client.Flow,
+	}
+	if inbound.Protocol == "shadowsocks" {
+		// Метод задается либо у клиента, либо на весь inbound
+		endpoint.Method = extraString(client.Extra, "method")
+		if endpoint.Method == "" {
+			endpoint.Method = inbound.Method()
+		}
+		// В многопользовательском Shadowsocks 2022 клиенту нужны оба ключа
+		if strings.HasPrefix(endpoint.Method, "2022-") && inbound.Settings != nil {
+			if server := extraString(inbound.Settings.Extra, "password"); server != "" {
+				endpoint.Password = server + ":" + client.Password
+			}
+		}
+	}
+
+	if stream := inbound.StreamSettings; stream != nil {
+		endpoint.Network = stream.Network
+		endpoint.Security = stream.Security
+		if tls := stream.TLSSettings; tls != nil {
+			endpoint.SNI = tls.ServerName
+			endpoint.ALPN = tls.ALPN
+			endpoint.Fingerprint = tls.Fingerprint
+		}
+		if ws := stream.WSSettings; ws != nil {
+			endpoint.Path = ws.Path
+			endpoint.Host = ws.Host
+			if endpoint.Host == "" {
+				endpoint.Host = ws.Headers["Host"]
+			}
+		}
+		if grpc := stream.GRPCSettings; grpc != nil {
+			endpoint.ServiceName = grpc.ServiceName
+		}
+		if reality := stream.RealitySettings; reality != nil && stream.Security == "reality" {
+			if len(reality.ServerNames) > 0 {
+				endpoint.SNI = reality.ServerNames[0]
+			}
+			if len(reality.ShortIDs) > 0 {
+				endpoint.ShortID = reality.ShortIDs[0]
+			}
+			if key, err := reality.PublicKey(); err == nil {
+				endpoint.PublicKey = key
+			}
+			// REALITY работает только с uTLS
+			endpoint.Fingerprint = "chrome"
+		}
+	}
+	return endpoint
+}
+
+// withHost overrides the inbound settings with the non-empty host fields.
+func withHost(endpoint subscription.Endpoint, host models.Host) subscription.Endpoint {
+	endpoint.Address = host.Address
+	if host.Remark != "" {
+		endpoint.Remark = host.Remark
+	}
+	if host.Port != 0 {
+		endpoint.Port = host.Port
+	}
+	if host.Security != "" {
+		endpoint.Security = host.Security
+	}
+	if host.SNI != "" {
+		endpoint.SNI = host.SNI
+	}
+	if host.HostHeader != "" {
+		endpoint.Host = host.HostHeader
+	}
+	if host.Path != "" {
+		endpoint.Path = host.Path
+	}
+	if len(host.ALPN) > 0 {
+		endpoint.ALPN = host.ALPN
+	}
+	if host.Fingerprint != "" {
+		endpoint.Fingerprint = host.Fingerprint
+	}
+	if host.PublicKey != "" {
+		endpoint.PublicKey = host.PublicKey
+	}
+	if host.ShortID != "" {
+		endpoint.ShortID = host.ShortID
+	}
+	if endpoint.Remark == "" {
+		endpoint.Remark = endpoint.Address
+	}
+	return endpoint
+}
+
+func extraString(extra xray.Extra, key string) string {
+	var value string
+	if raw, ok := extra[key]; ok {
+		_ = json.Unmarshal(raw, &value)
+	}
+	return value
+}
+
+// Render builds the user's subscription in the given format.
+func (s *SubscriptionService) Render(user *models.User, format subscription.Format) (subscription.Document, error) {
+	endpoints, err := s.Endpoints(user)
+	if err != nil {
+		return subscription.Document{}, err
+	}
+	title := s.Title
+	if title == "" {
+		title = "VPNClient"
+	}
+	return subscription.Render(format, title, endpoints)
+}
+
+// usageInfo splits the user's used traffic into upload and download. Traffic
+// not counted per direction, like the registration allowance, is reported
+// as download so that the two add up to what the quota is checked against.
+func usageInfo(user *models.User) subscription.Userinfo {
+	download := user.UsedDownlink
+	if rest := user.UsedTraffic - user.UsedUplink - user.UsedDownlink; rest > 0 {
+		download += rest
+	}
+	return subscription.Userinfo{
+		Upload:   user.UsedUplink,
+		Download: download,
+		Total:    user.Tariff.TrafficLimit,
+		Expire:   user.TariffExpiresAt,
+	}
+}
+
+// Headers returns the quota and profile headers for the user's
+// subscription response.
+func (s *SubscriptionService) Headers(user *models.User) map[string]string {
+	headers := map[string]string{
+		"Subscription-Userinfo": usageInfo(user).String(),
+	}
+	if s.Title != "" {
+		headers["Profile-Title"] = subscription.ProfileTitle(s.Title)
+	}
+	if s.UpdateInterval > 0 {
+		// Клиенты ждут интервал в целых часах
+		hours := int(s.UpdateInterval.Hours())
+		if hours < 1 {
+			hours = 1
+		}
+		headers["Profile-Update-Interval"] = strconv.Itoa(hours)
+	}
+	if s.SupportURL != "" {
+		headers["Support-Url"] = s.SupportURL
+	}
+	return headers
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"testing"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/xray"
+)
+
+func TestNodeEndpointsUsesHosts(t *testing.T) {
+	config, err := xray.ParseConfig([]byte(`{
+		"inbounds": [
+			{"tag": "vless-ws", "port": 10000, "protocol": "vless",
+			 "settings": {"clients": [{"id": "test-uuid", "email": "test@example.com"}], "decryption": "none"},
+			 "streamSettings": {"network": "ws", "security": "tls", "wsSettings": {"path": "/"}}},
+			{"tag": "trojan-tcp", "port": 10001, "protocol": "trojan",
+			 "settings": {"clients": [{"id": "test-uuid", "password": "test-uuid", "email": "test@example.com"}]}},
+			{"tag": "vmess", "port": 10002, "protocol": "vmess",
+			 "settings": {"clients": [{"id": "other-uuid", "email": "other@example.com"}]}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbounds, err := targetInbounds(config, []string{"vless-ws", "trojan-tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Email: "test@example.com", UUID: "test-uuid"}
+	remoteID := uint(2)
+	remote := models.Node{Name: "Frankfurt", Driver: models.NodeDriverXrayAPI, Address: "de.example.com"}
+	remote.ID = remoteID
+	hosts := []models.Host{
+		{InboundTag: "vless-ws", Address: "vpn.example.com", Remark: "Direct"},
+		{InboundTag: "vless-ws", Address: "cdn.example.com", Port: 443, SNI: "cdn.example.com", HostHeader: "vpn.example.com", Path: "/cdn"},
+		{InboundTag: "vless-ws", NodeID: &remoteID, Address: "de-cdn.example.com"},
+	}
+
+	endpoints := nodeEndpoints(inbounds, user, localNode, hosts, "")
+	if len(endpoints) != 2 {
+		t.Fatalf("Expected only the local vless hosts without a default host, got %+v", endpoints)
+	}
+	direct, cdn := endpoints[0], endpoints[1]
+	if direct.Address != "vpn.example.com" || direct.Port != 10000 || direct.Path != "/" || direct.Remark != "Direct" {
+		t.Errorf("Unexpected direct endpoint %+v", direct)
+	}
+	if cdn.Port != 443 || cdn.SNI != "cdn.example.com" || cdn.Host != "vpn.example.com" || cdn.Path != "/cdn" ||
+		cdn.Security != "tls" || cdn.Remark != "vless-ws" {
+		t.Errorf("Unexpected CDN endpoint %+v", cdn)
+	}
+
+	endpoints = nodeEndpoints(inbounds, user, localNode, hosts, "1.2.3.4")
+	if len(endpoints) != 3 {
+		t.Fatalf("Expected trojan through the default host, got %+v", endpoints)
+	}
+	if trojan := endpoints[2]; trojan.Protocol != "trojan" || trojan.Address != "1.2.3.4" || trojan.Password != "test-uuid" {
+		t.Errorf("Unexpected trojan endpoint %+v", trojan)
+	}
+
+	endpoints = nodeEndpoints(inbounds, user, remote, hosts, "1.2.3.4")
+	if len(endpoints) != 2 {
+		t.Fatalf("Expected the remote host and node address, got %+v", endpoints)
+	}
+	if endpoints[0].Address != "de-cdn.example.com" || endpoints[1].Address != "de.example.com" || endpoints[1].Remark != "Frankfurt" {
+		t.Errorf("Unexpected remote endpoints %+v", endpoints)
+	}
+}
+
+func TestNodeEndpointsReality(t *testing.T) {
+	config, err := xray.ParseConfig([]byte(`{
+		"inbounds": [
+			{"tag": "reality", "port": 443, "protocol": "vless",
+			 "settings": {"clients": [{"id": "test-uuid", "flow": "xtls-rprx-vision"}], "decryption": "none"},
+			 "streamSettings": {"network": "tcp", "security": "reality", "realitySettings": {
+				"dest": "www.microsoft.com:443", "serverNames": ["www.microsoft.com"],
+				"privateKey": "dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo", "shortIds": ["6ba85179e30d4fc2"]}}},
+			{"tag": "reality-nokey", "port": 8443, "protocol": "vless",
+			 "settings": {"clients": [{"id": "test-uuid"}], "decryption": "none"},
+			 "streamSettings": {"security": "reality", "realitySettings": {"serverNames": ["www.apple.com"]}}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbounds, err := targetInbounds(config, []string{"reality", "reality-nokey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Email: "test@example.com", UUID: "test-uuid"}
+
+	endpoints := nodeEndpoints(inbounds, user, localNode, nil, "1.2.3.4")
+	if len(endpoints) != 1 {
+		t.Fatalf("Expected the inbound without a public key to be skipped, got %+v", endpoints)
+	}
+	if e := endpoints[0]; e.PublicKey != "hSDwCYkwp1R0i33ctD73Wg2_Og0mOBr066SpjqqbTmo" || e.ShortID != "6ba85179e30d4fc2" ||
+		e.SNI != "www.microsoft.com" || e.Fingerprint != "chrome" {
+		t.Errorf("Unexpected reality endpoint %+v", e)
+	}
+
+	// Ключ, записанный в хосте, делает inbound доступным
+	hosts := []models.Host{{InboundTag: "reality-nokey", Address: "vpn.example.com", PublicKey: "node-public-key", ShortID: "ab"}}
+	endpoints = nodeEndpoints(inbounds, user, localNode, hosts, "1.2.3.4")
+	if len(endpoints) != 2 || endpoints[1].PublicKey != "node-public-key" || endpoints[1].ShortID != "ab" || endpoints[1].SNI != "www.apple.com" {
+		t.Errorf("Expected the host to supply the public key, got %+v", endpoints)
+	}
+}
+
+func TestHeadersSplitUsage(t *testing.T) {
+	service := &SubscriptionService{Title: "Мой VPN"}
+	user := &models.User{UsedTraffic: 10 + 300 + 700, UsedUplink: 300, UsedDownlink: 700}
+	user.Tariff.TrafficLimit = 5000
+
+	headers := service.Headers(user)
+	// Трафик без направления (бонус при регистрации) считается загрузкой
+	if got, want := headers["Subscription-Userinfo"], "upload=300; download=710; total=5000; expire=0"; got != want {
+		t.Errorf("Subscription-Userinfo = %q, want %q", got, want)
+	}
+	if headers["Profile-Title"] == "" {
+		t.Error("Expected a profile title")
+	}
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/repository"
+	"vpn-backend/internal/telegram"
+)
+
+var (
+	// ErrTelegramDisabled is returned for Telegram logins when no bot token is configured.
+	ErrTelegramDisabled = errors.New("telegram login is not configured")
+	// ErrLastSignInMethod is returned when unlinking would leave an account
+	// without a way to log in.
+	ErrLastSignInMethod = errors.New("cannot unlink the only sign-in method")
+	// ErrTelegramLinked is returned when the Telegram account belongs to another user.
+	ErrTelegramLinked    = repository.ErrTelegramLinked
+	ErrTelegramNotLinked = repository.ErrTelegramNotLinked
+)
+
+// placeholderEmailDomain is used for accounts created with Telegram only;
+// .invalid is reserved and never receives mail.
+const placeholderEmailDomain = "telegram.invalid"
+
+// VerifyTelegram checks Telegram login data: the fields of the Login Widget,
+// or {"init_data": ...} from a Mini App.
+func (a *AuthService) VerifyTelegram(fields map[string]string) (*telegram.User, error) {
+	if a.TelegramBotToken == "" {
+		return nil, ErrTelegramDisabled
+	}
+	if initData, ok := fields["init_data"]; ok {
+		return telegram.VerifyInitData(a.TelegramBotToken, initData, a.TelegramAuthMaxAge, time.Now())
+	}
+	return telegram.VerifyLoginWidget(a.TelegramBotToken, fields, a.TelegramAuthMaxAge, time.Now())
+}
+
+// AuthenticateTelegram issues a token for the user a verified Telegram
+// account is linked to.
+func (a *AuthService) AuthenticateTelegram(tgUser *telegram.User) (string, error) {
+	user, err := a.TelegramRepo.FindUser(tgUser.ID)
+	if err != nil {
+		return "", fmt.Errorf("invalid credentials")
+	}
+	token, err := a.GenerateJWT(user)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	return token, nil
+}
+
+func telegramIdentity(tgUser *telegram.User) *models.TelegramIdentity {
+	return &models.TelegramIdentity{
+		TelegramID: tgUser.ID,
+		Username:   tgUser.Username,
+		FirstName:  tgUser.FirstName,
+		LastName:   tgUser.LastName,
+		PhotoURL:   tgUser.PhotoURL,
+	}
+}
+
+// RegisterTelegram creates an account for a verified Telegram user who has
+// none. It gets a placeholder email and no password, so Telegram is its only
+// sign-in method.
+func (a *AuthService) RegisterTelegram(tgUser *telegram.User, uuid string, tariffID int) (*models.User, error) {
+	user := &models.User{
+		Email:       uuid + "@" + placeholderEmailDomain,
+		UUID:        uuid,
+		TariffID:    tariffID,
+		EmailStatus: models.EmailNone,
+	}
+	if err := a.TelegramRepo.CreateUser(user, telegramIdentity(tgUser)); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// LinkTelegram links a verified Telegram account to the user.
+func (a *AuthService) LinkTelegram(userID int, tgUser *telegram.User) (*models.TelegramIdentity, error) {
+	identity := telegramIdentity(tgUser)
+	identity.UserID = userID
+	if err := a.TelegramRepo.Link(identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+func (a *AuthService) TelegramIdentities(userID int) ([]models.TelegramIdentity, error) {
+	return a.TelegramRepo.ListByUser(userID)
+}
+
+// UnlinkTelegram removes a linked Telegram account, unless it is the last
+// way a Telegram-only user can log in.
+func (a *AuthService) UnlinkTelegram(userID int, telegramID int64) error {
+	user, err := a.UserRepo.FindByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.EmailStatus == models.EmailNone {
+		identities, err := a.TelegramRepo.ListByUser(userID)
+		if err != nil {
+			return err
+		}
+		if len(identities) <= 1 {
+			return ErrLastSignInMethod
+		}
+	}
+	return a.TelegramRepo.Unlink(userID, telegramID)
+}
@@ -1,14 +1,22 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os/exec"
+	"log"
+	"time"
+	"vpn-backend/internal/models"
 	"vpn-backend/internal/repository"
+	"vpn-backend/internal/xray"
 )
 
 type TrafficService struct {
 	UserRepo       *repository.UserRepository
 	PaymentService *PaymentService
+	TrafficRepo    *repository.TrafficRepository
+	// Stats reads counters from Xray, summed over all nodes.
+	Stats StatsQuerier
 }
 
 func NewTrafficService(userRepo *repository.UserRepository, paymentService *PaymentService) *TrafficService {
@@ -18,61 +26,47 @@ func NewTrafficService(userRepo *repository.UserRepository, paymentService *Paym
 	}
 }
 
-// GetUserTraffic returns the total traffic used by a user.
-func (s *TrafficService) GetUserTraffic(userUUID string) (int64, error) {
-	// Формируем JSON-запрос для uplink
-	uplinkRequest := fmt.Sprintf(`{"jsonrpc":"2.0","method":"StatsService.QueryStats","params":{"pattern":"user>>>%s>>>traffic>>>uplink","reset":false},"id":1}`, userUUID)
-
-	// Отправляем запрос к Xray API
-	cmd := exec.Command("curl", "--http0.9", "--silent", "--output", "-", "-X", "POST", "http://127.0.0.1:10085/stats/query", "-H", "Content-Type: application/json", "-d", uplinkRequest)
-	output, err := cmd.Output()
-	if err != nil {
-		return 0, fmt.Errorf("failed to execute curl command: %w", err)
-	}
-
-	// Парсим бинарный ответ
-	uplinkTraffic, err := parseTrafficResponse(output)
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse uplink traffic: %w", err)
+// GetUserTraffic returns the stored traffic of a user plus what Xray has
+// counted since the last collector run. Xray keys user counters by the
+// client email. If Xray can't be reached, only the stored part is returned.
+func (s *TrafficService) GetUserTraffic(user *models.User) (xray.Traffic, error) {
+	var traffic xray.Traffic
+	if s.TrafficRepo != nil {
+		uplink, downlink, err := s.TrafficRepo.UserTotals(int(user.ID))
+		if err != nil {
+			return xray.Traffic{}, err
+		}
+		traffic = xray.Traffic{Uplink: uplink, Downlink: downlink}
 	}
 
-	// Аналогично для downlink
-	downlinkRequest := fmt.Sprintf(`{"jsonrpc":"2.0","method":"StatsService.QueryStats","params":{"pattern":"user>>>%s>>>traffic>>>downlink","reset":false},"id":1}`, userUUID)
-	cmd = exec.Command("curl", "--http0.9", "--silent", "--output", "-", "-X", "POST", "http://127.0.0.1:10085/stats/query", "-H", "Content-Type: application/json", "-d", downlinkRequest)
-	output, err = cmd.Output()
-	if err != nil {
-		return 0, fmt.Errorf("failed to execute curl command: %w", err)
+	if s.Stats == nil {
+		return traffic, nil
 	}
-
-	downlinkTraffic, err := parseTrafficResponse(output)
+	stats, err := s.Stats.QueryStats(context.Background(), xray.StatsQuery{
+		Patterns: []string{"user>>>" + user.Email + ">>>traffic>>>"},
+	})
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse downlink traffic: %w", err)
+		log.Printf("Failed to query live traffic of %s: %v", user.Email, err)
+		return traffic, nil
 	}
-
-	// Возвращаем суммарный трафик
-	return uplinkTraffic + downlinkTraffic, nil
-}
-
-// parseTrafficResponse парсит бинарный ответ от Xray API
-func parseTrafficResponse(response []byte) (int64, error) {
-	// Проверяем длину ответа
-	if len(response) < 8 {
-		return 0, fmt.Errorf("invalid binary response length")
-	}
-
-	// Извлекаем значение трафика (например, 8 байт для int64)
-	traffic := int64(response[4])<<24 | int64(response[5])<<16 | int64(response[6])<<8 | int64(response[7])
-
+	live := userTraffic(stats)[user.Email]
+	traffic.Uplink += live.Uplink
+	traffic.Downlink += live.Downlink
 	return traffic, nil
 }
 
-// TrackTrafficUsage records the traffic usage for a user.
-func (s *TrafficService) TrackTrafficUsage(userUUID string, bytes int64) error {
-	// TODO: Implement the logic to track traffic usage.
-	// This might involve updating a traffic tracking service or database.
-	_ = userUUID
-	_ = bytes
-	return nil
+// TrackTrafficUsage records traffic of a user and adds it to their used
+// traffic.
+func (s *TrafficService) TrackTrafficUsage(userID int, traffic xray.Traffic) error {
+	if s.TrafficRepo == nil {
+		return fmt.Errorf("traffic repository is not configured")
+	}
+	return s.TrafficRepo.RecordUsage([]models.TrafficLog{{
+		UserID:    userID,
+		Uplink:    traffic.Uplink,
+		Downlink:  traffic.Downlink,
+		Timestamp: time.Now(),
+	}})
 }
 
 // CheckTrafficLimits checks if the user has exceeded the traffic limits of their current tariff.
@@ -84,3 +78,50 @@ func (s *TrafficService) CheckTrafficLimits(userID int) (bool, error) {
 	}
 	return exceeded, nil
 }
+
+var ErrInvalidHistoryQuery = errors.New("invalid traffic history query")
+
+// historyRanges holds, per bucket, the default range when "from" is not
+// given and the longest range allowed, so one request can't ask for
+// millions of points.
+var historyRanges = map[string]struct{ def, max time.Duration }{
+	"hour":  {24 * time.Hour, 31 * 24 * time.Hour},
+	"day":   {30 * 24 * time.Hour, 366 * 24 * time.Hour},
+	"month": {365 * 24 * time.Hour, 10 * 366 * 24 * time.Hour},
+}
+
+// History returns the traffic of one user, or of the whole server when
+// userID is nil, in [from, to) grouped by bucket. Zero times and an empty
+// bucket select defaults.
+func (s *TrafficService) History(userID *int, from, to time.Time, bucket string) ([]models.TrafficPoint, error) {
+	from, to, bucket, err := historyQuery(from, to, bucket, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return s.TrafficRepo.History(userID, from, to, bucket)
+}
+
+// historyQuery fills in the defaults of a history query and checks it.
+// to is exclusive and defaults to now.
+func historyQuery(from, to time.Time, bucket string, now time.Time) (time.Time, time.Time, string, error) {
+	if bucket == "" {
+		bucket = "day"
+	}
+	ranges, ok := historyRanges[bucket]
+	if !ok {
+		return from, to, bucket, fmt.Errorf("%w: bucket must be hour, day or month", ErrInvalidHistoryQuery)
+	}
+	if to.IsZero() {
+		to = now
+	}
+	if from.IsZero() {
+		from = to.Add(-ranges.def)
+	}
+	if !from.Before(to) {
+		return from, to, bucket, fmt.Errorf("%w: from must be before to", ErrInvalidHistoryQuery)
+	}
+	if to.Sub(from) > ranges.max {
+		return from, to, bucket, fmt.Errorf("%w: range is too long for %s buckets", ErrInvalidHistoryQuery, bucket)
+	}
+	return from, to, bucket, nil
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"vpn-backend/internal/models"
+	"vpn-backend/internal/repository"
+	"vpn-backend/internal/xray"
+)
+
+// StatsQuerier is the part of the Xray StatsService the collector needs.
+type StatsQuerier interface {
+	QueryStats(ctx context.Context, query xray.StatsQuery) ([]xray.Stat, error)
+}
+
+// TrafficCollector periodically moves per-user counters out of Xray into
+// traffic_logs and users.used_traffic.
+//
+// Counters are read with reset, so every read is already a delta and
+// nothing is ever subtracted. When Xray restarts its counters start again
+// from zero, which only means the next read is smaller; traffic between the
+// last read and the restart is lost, never double counted.
+type TrafficCollector struct {
+	Stats       StatsQuerier
+	UserRepo    *repository.UserRepository
+	TrafficRepo *repository.TrafficRepository
+	Interval    time.Duration
+
+	mu sync.Mutex
+	// pending holds deltas that were already reset in Xray but not yet
+	// stored, so a failed DB write does not lose them.
+	pending map[string]xray.Traffic
+}
+
+func NewTrafficCollector(stats StatsQuerier, userRepo *repository.UserRepository, trafficRepo *repository.TrafficRepository, interval time.Duration) *TrafficCollector {
+	return &TrafficCollector{
+		Stats:       stats,
+		UserRepo:    userRepo,
+		TrafficRepo: trafficRepo,
+		Interval:    interval,
+		pending:     make(map[string]xray.Traffic),
+	}
+}
+
+// Start runs the collector until ctx is cancelled.
+func (c *TrafficCollector) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.Collect(ctx); err != nil {
+					log.Printf("Traffic collection failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Collect runs one collection pass.
+func (c *TrafficCollector) Collect(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.drain(ctx); err != nil {
+		return err
+	}
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	users, err := c.UserRepo.GetAllUsers()
+	if err != nil {
+		return fmt.Errorf("failed to load users: %w", err)
+	}
+	byEmail := make(map[string]int, len(users))
+	for _, user := range users {
+		byEmail[user.Email] = int(user.ID)
+	}
+
+	now := time.Now()
+	logs := make([]models.TrafficLog, 0, len(c.pending))
+	for email, traffic := range c.pending {
+		userID, ok := byEmail[email]
+		if !ok {
+			log.Printf("Dropping traffic of unknown Xray user %s: %+v", email, traffic)
+			delete(c.pending, email)
+			continue
+		}
+		logs = append(logs, models.TrafficLog{
+			UserID:    userID,
+			Uplink:    traffic.Uplink,
+			Downlink:  traffic.Downlink,
+			Timestamp: now,
+		})
+	}
+
+	if err := c.TrafficRepo.RecordUsage(logs); err != nil {
+		return fmt.Errorf("failed to store traffic: %w", err)
+	}
+	c.pending = make(map[string]xray.Traffic)
+	return nil
+}
+
+// drain reads and resets all user counters in one query and adds them to
+// the pending deltas.
+func (c *TrafficCollector) drain(ctx context.Context) error {
+	stats, err := c.Stats.QueryStats(ctx, xray.StatsQuery{Patterns: []string{"user>>>"}, Reset: true})
+	if err != nil {
+		return fmt.Errorf("failed to query user stats: %w", err)
+	}
+
+	for email, traffic := range userTraffic(stats) {
+		pending := c.pending[email]
+		pending.Uplink += traffic.Uplink
+		pending.Downlink += traffic.Downlink
+		c.pending[email] = pending
+	}
+	return nil
+}
+
+// userTraffic groups user counters by email.
+func userTraffic(stats []xray.Stat) map[string]xray.Traffic {
+	result := make(map[string]xray.Traffic)
+	for _, stat := range stats {
+		email, direction, ok := xray.ParseUserStatName(stat.Name)
+		if !ok || stat.Value <= 0 {
+			continue
+		}
+		traffic := result[email]
+		switch direction {
+		case "uplink":
+			traffic.Uplink += stat.Value
+		case "downlink":
+			traffic.Downlink += stat.Value
+		default:
+			continue
+		}
+		result[email] = traffic
+	}
+	return result
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+	"vpn-backend/internal/xray"
+	"vpn-backend/internal/xray/xraytest"
+)
+
+func TestTrafficCollectorDrainSurvivesXrayRestart(t *testing.T) {
+	server := xraytest.NewServer()
+	defer server.Close()
+
+	api, err := xray.NewAPIClient(server.Addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+
+	collector := NewTrafficCollector(api, nil, nil, time.Minute)
+	ctx := context.Background()
+
+	server.AddTraffic("a@example.com", 100, 1000)
+	if err := collector.drain(ctx); err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+
+	// Xray перезапустился: счётчики обнулились, затем пошёл новый трафик
+	server.ResetStats()
+	server.AddTraffic("a@example.com", 5, 50)
+	if err := collector.drain(ctx); err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+
+	// Повторное чтение без нового трафика ничего не добавляет
+	if err := collector.drain(ctx); err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+
+	got := collector.pending["a@example.com"]
+	want := xray.Traffic{Uplink: 105, Downlink: 1050}
+	if got != want {
+		t.Fatalf("Expected pending %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHistoryQuery(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC) }
+
+	cases := []struct {
+		name             string
+		from, to         time.Time
+		bucket           string
+		wantFrom, wantTo time.Time
+		wantBucket       string
+		wantErr          bool
+	}{
+		{name: "defaults", wantFrom: now.Add(-30 * 24 * time.Hour), wantTo: now, wantBucket: "day"},
+		{name: "hour default range", bucket: "hour", wantFrom: now.Add(-24 * time.Hour), wantTo: now, wantBucket: "hour"},
+		{name: "month default range", bucket: "month", wantFrom: now.Add(-365 * 24 * time.Hour), wantTo: now, wantBucket: "month"},
+		{name: "from without to", from: day(1), wantFrom: day(1), wantTo: now, wantBucket: "day"},
+		{name: "to without from", to: day(31), bucket: "hour", wantFrom: day(30), wantTo: day(31), wantBucket: "hour"},
+		// to не включается: 2024-05-02 — это ровно сутки от 2024-05-01
+		{name: "plain date to is exclusive", from: day(1), to: day(2), bucket: "hour", wantFrom: day(1), wantTo: day(2), wantBucket: "hour"},
+		{name: "longest hour range", from: day(1), to: day(1).Add(31 * 24 * time.Hour), bucket: "hour",
+			wantFrom: day(1), wantTo: day(1).Add(31 * 24 * time.Hour), wantBucket: "hour"},
+		{name: "unknown bucket", bucket: "week", wantErr: true},
+		{name: "from after to", from: day(10), to: day(1), wantErr: true},
+		{name: "from equals to", from: day(10), to: day(10), wantErr: true},
+		{name: "hour range too long", from: day(1), to: day(1).Add(32 * 24 * time.Hour), bucket: "hour", wantErr: true},
+		{name: "day range too long", from: day(1).AddDate(-2, 0, 0), to: day(1), bucket: "day", wantErr: true},
+		{name: "month range too long", from: day(1).AddDate(-11, 0, 0), to: day(1), bucket: "month", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			from, to, bucket, err := historyQuery(tc.from, tc.to, tc.bucket, now)
+			if tc.wantErr {
+				if !errors.Is(err, ErrInvalidHistoryQuery) {
+					t.Fatalf("Expected ErrInvalidHistoryQuery, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !from.Equal(tc.wantFrom) || !to.Equal(tc.wantTo) || bucket != tc.wantBucket {
+				t.Errorf("historyQuery() = %s, %s, %s; want %s, %s, %s", from, to, bucket, tc.wantFrom, tc.wantTo, tc.wantBucket)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"vpn-backend/internal/mail"
+	"vpn-backend/internal/models"
+)
+
+// ErrInvalidVerifyToken covers forged, malformed and expired email
+// confirmation links.
+var ErrInvalidVerifyToken = errors.New("invalid or expired verification link")
+
+// verificationCooldown limits how often the confirmation email is resent.
+const verificationCooldown = time.Minute
+
+// Ссылка подтверждения не хранится в базе: подпись HMAC покрывает ID
+// пользователя, адрес и срок, поэтому после смены адреса ссылка не работает.
+func signEmailToken(secret []byte, userID int, email string, expires time.Time) string {
+	payload := fmt.Sprintf("%d.%d", userID, expires.Unix())
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("email-verify." + payload + "." + email))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// emailTokenUser returns the user ID a token was issued for, without
+// checking the signature.
+func emailTokenUser(token string) (int, error) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, ErrInvalidVerifyToken
+	}
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, ErrInvalidVerifyToken
+	}
+	return userID, nil
+}
+
+// checkEmailToken verifies the token's signature for the address and its expiry.
+func checkEmailToken(secret []byte, token string, email string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidVerifyToken
+	}
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return ErrInvalidVerifyToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ErrInvalidVerifyToken
+	}
+	expected := signEmailToken(secret, userID, email, time.Unix(expires, 0))
+	if !hmac.Equal([]byte(expected), []byte(token)) {
+		return ErrInvalidVerifyToken
+	}
+	if !now.Before(time.Unix(expires, 0)) {
+		return ErrInvalidVerifyToken
+	}
+	return nil
+}
+
+// SendVerification emails the user a link that confirms their address.
+func (a *AuthService) SendVerification(user *models.User) error {
+	now := time.Now()
+	token := signEmailToken(a.VerifySecret, int(user.ID), user.Email, now.Add(a.VerifyTTL))
+	if err := a.UserRepo.UpdateVerificationSentAt(int(user.ID), now); err != nil {
+		return err
+	}
+
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf("To activate your VPN account, confirm your email by opening the link below. It is valid for %s.\n\n%s\n\n"+
+			"If you did not register, ignore this email.\n", a.VerifyTTL, tokenLink(a.VerifyURL, token)),
+	}
+	go func() {
+		if err := a.Mailer.Send(msg); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		}
+	}()
+	return nil
+}
+
+// ResendVerification sends a new confirmation link to a pending account.
+// Unknown and already verified addresses are silently ignored, as are
+// requests within a minute of the previous email.
+func (a *AuthService) ResendVerification(email string) error {
+	user, err := a.UserRepo.GetUserByEmail(email)
+	if err != nil || user.EmailStatus != models.EmailPending {
+		return nil
+	}
+	if user.VerificationSentAt != nil && time.Since(*user.VerificationSentAt) < verificationCooldown {
+		return nil
+	}
+	return a.SendVerification(user)
+}
+
+// VerifyEmail confirms the address a link was sent to and returns the user
+// with their tariff loaded. Confirming twice is not an error.
+func (a *AuthService) VerifyEmail(token string) (*models.User, error) {
+	userID, err := emailTokenUser(token)
+	if err != nil {
+		return nil, err
+	}
+	user, err := a.UserRepo.FindByID(userID)
+	if err != nil {
+		return nil, ErrInvalidVerifyToken
+	}
+	if err := checkEmailToken(a.VerifySecret, token, user.Email, time.Now()); err != nil {
+		return nil, err
+	}
+	if user.EmailStatus != models.EmailPending {
+		return user, nil
+	}
+
+	now := time.Now()
+	if err := a.UserRepo.MarkEmailVerified(userID, now); err != nil {
+		return nil, err
+	}
+	user.EmailStatus = models.EmailVerified
+	user.EmailVerifiedAt = &now
+	return user, nil
+}
+
+// PurgeUnverified deletes accounts that did not confirm their email within
+// UnverifiedTTL.
+func (a *AuthService) PurgeUnverified() error {
+	deleted, err := a.UserRepo.DeleteUnverified(time.Now().Add(-a.UnverifiedTTL))
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Printf("Purged %d unverified accounts", deleted)
+	}
+	return nil
+}
+
+// StartPurge runs PurgeUnverified every interval until ctx is done.
+func (a *AuthService) StartPurge(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := a.PurgeUnverified(); err != nil {
+					log.Printf("Unverified account purge failed: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -2,34 +2,69 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"sync"
 	"text/template"
 	"time"
 	"vpn-backend/internal/models"
 	"vpn-backend/internal/repository"
+	"vpn-backend/internal/xray"
 )
 
 type XrayService struct {
 	Repo         *repository.UserRepository
 	ConfigPath   string
 	TemplatePath string
-	mu           sync.Mutex
+	// DefaultInboundTags is used for users whose tariff has no inbound set.
+	// Empty means every inbound that accepts clients.
+	DefaultInboundTags []string
+	// API applies user changes to the running Xray. When nil, every change
+	// falls back to a restart.
+	API *xray.APIClient
+	// History keeps the previous versions of the config file. When nil, the
+	// file is overwritten without a trace.
+	History *xray.History
+	// Validator checks every config before it is written, after the
+	// backend's own checks. When nil, only those run.
+	Validator xray.Validator
+	// Controller restarts Xray after config changes that can't be applied
+	// through the API.
+	Controller xray.Controller
+	// Restarts coalesces restart requests; NewXrayService creates it.
+	Restarts *RestartScheduler
+	mu       sync.Mutex
+	// applyTurn is closed when the live update of the last saved change is
+	// done; the next one waits for it. Guarded by mu.
+	applyTurn chan struct{}
 }
 
+// AuthorSystem marks config writes made by the backend itself rather than
+// by an administrator.
+const AuthorSystem = "system"
+
 func NewXrayService(repo *repository.UserRepository, configPath string, templatePath string) *XrayService {
-	return &XrayService{
+	s := &XrayService{
 		Repo:         repo,
 		ConfigPath:   configPath,
 		TemplatePath: templatePath,
+		Controller:   xray.NewSystemdController("xray"),
 	}
+	s.Restarts = NewRestartScheduler(s.restartXray, time.Second)
+	return s
 }
 
-func (s *XrayService) RegenerateConfig() error {
+// RegenerateConfig rebuilds the config file from the template. The lock is
+// held from reading the users to writing the file, so a user added to the
+// config meanwhile is added on top of the new file rather than lost.
+func (s *XrayService) RegenerateConfig(author string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	users, err := s.Repo.GetAllUsers()
 	if err != nil {
 		return fmt.Errorf("failed to get all users: %w", err)
@@ -37,7 +72,7 @@ func (s *XrayService) RegenerateConfig() error {
 
 	activeUsers := make([]models.User, 0)
 	for _, user := range users {
-		if !user.IsBanned {
+		if user.CanConnect() {
 			activeUsers = append(activeUsers, user)
 		}
 	}
@@ -57,37 +92,28 @@ func (s *XrayService) RegenerateConfig() error {
 		return fmt.Errorf("failed to execute template: %w", err)
 	}
 
-	if !json.Valid(buf.Bytes()) {
-		return fmt.Errorf("invalid JSON generated")
-	}
-
-	if err := os.Rename(s.ConfigPath, s.ConfigPath+".bak"); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to backup config file: %w", err)
-	}
-
-	if err := os.WriteFile(s.ConfigPath, buf.Bytes(), 0644); err != nil {
-		_ = os.Rename(s.ConfigPath+".bak", s.ConfigPath)
-		return fmt.Errorf("failed to write config file: %w", err)
-	}
-
-	return nil
+	return s.writeConfig(buf.Bytes(), author, "regenerate from template")
 }
 
-func (s *XrayService) loadConfig() (map[string]interface{}, error) {
+// loadConfig reads the config for inspection. Changes must go through
+// mutateConfig instead, or they can overwrite a concurrent change.
+func (s *XrayService) loadConfig() (*xray.Config, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.readConfig()
+}
 
-	configBytes, err := os.ReadFile(s.ConfigPath)
+// readConfig reads the config file. The caller holds s.mu.
+func (s *XrayService) readConfig() (*xray.Config, error) {
+	config, err := xray.LoadConfig(s.ConfigPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return map[string]interface{}{
-				"inbounds": []interface{}{
-					map[string]interface{}{
-						"port":     1080,
-						"protocol": "vmess",
-						"settings": map[string]interface{}{
-							"clients": []interface{}{},
-						},
+			return &xray.Config{
+				Inbounds: []xray.Inbound{
+					{
+						Port:     xray.PortNumber(1080),
+						Protocol: "vmess",
+						Settings: &xray.InboundSettings{Clients: []xray.Client{}},
 					},
 				},
 			}, nil
@@ -95,130 +121,407 @@ func (s *XrayService) loadConfig() (map[string]interface{}, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	var config map[string]interface{}
-	if err := json.Unmarshal(configBytes, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
-	}
-
 	return config, nil
 }
 
-func (s *XrayService) saveConfig(config map[string]interface{}) error {
+// saveConfig replaces the whole config, e.g. with one built from scratch.
+func (s *XrayService) saveConfig(config *xray.Config, reason string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.marshalConfig(config, reason)
+}
 
-	configBytes, err := json.MarshalIndent(config, "", "  ")
+func (s *XrayService) marshalConfig(config *xray.Config, reason string) error {
+	configBytes, err := config.Marshal()
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
+	return s.writeConfig(configBytes, AuthorSystem, reason)
+}
 
-	if err := os.WriteFile(s.ConfigPath, configBytes, 0644); err != nil {
-		return fmt.Errorf("failed to write config file: %w", err)
+// mutateConfig runs edit on the current config and writes the result. The
+// lock is held across load, edit and save, so concurrent mutations run one
+// after another and none of them is lost. Nothing is written when edit
+// reports no client changes.
+//
+// The live update runs after the lock is released, so a slow Xray API does
+// not hold up other writes; live updates still run in the order the
+// changes were saved.
+func (s *XrayService) mutateConfig(reason string, edit func(config *xray.Config) ([]clientChange, error)) error {
+	changes, prev, done, err := s.saveMutation(reason, edit)
+	if err != nil || len(changes) == 0 {
+		return err
 	}
+	defer close(done)
 
+	if prev != nil {
+		<-prev
+	}
+	s.applyLive(changes)
 	return nil
 }
 
-func (s *XrayService) AddUserToConfig(user *models.User) error {
-	config, err := s.loadConfig()
+// saveMutation is the locked part of mutateConfig. It returns the changes
+// to apply live with the turn to wait for and the one to close after.
+func (s *XrayService) saveMutation(reason string, edit func(config *xray.Config) ([]clientChange, error)) ([]clientChange, chan struct{}, chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, err := s.readConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	changes, err := edit(config)
 	if err != nil {
-		log.Printf("Error loading Xray config: %v", err)
-		return fmt.Errorf("failed to load Xray config: %w", err)
+		return nil, nil, nil, err
+	}
+	if len(changes) == 0 {
+		return nil, nil, nil, nil
+	}
+	if err := s.marshalConfig(config, reason); err != nil {
+		return nil, nil, nil, err
 	}
 
-	// Проверяем, существует ли пользователь
-	inbounds := config["inbounds"].([]interface{})
-	firstInbound := inbounds[0].(map[string]interface{})
-	settings := firstInbound["settings"].(map[string]interface{})
-	clients := settings["clients"].([]interface{})
+	prev, done := s.applyTurn, make(chan struct{})
+	s.applyTurn = done
+	return changes, prev, done, nil
+}
 
-	for _, client := range clients {
-		if client.(map[string]interface{})["id"] == user.UUID {
-			log.Printf("User with UUID %s already exists in Xray config", user.UUID)
-			return fmt.Errorf("user already exists in config")
-		}
+// validate checks a candidate config. A failure wraps xray.ErrInvalidConfig
+// with the reason, e.g. the output of Xray.
+func (s *XrayService) validate(data []byte) error {
+	config, err := xray.ParseConfig(data)
+	if err != nil {
+		return fmt.Errorf("%w: %w", xray.ErrInvalidConfig, err)
+	}
+	if err := config.Check(); err != nil {
+		return err
 	}
+	if s.Validator != nil {
+		return s.Validator.Validate(context.Background(), data)
+	}
+	return nil
+}
 
-	// Добавляем нового пользователя
-	newClient := map[string]interface{}{
-		"id":      user.UUID,
-		"email":   user.Email,
-		"level":   0,
-		"alterId": 0,
+// writeConfig validates data, atomically replaces the config file with it
+// and records the new version in the history. An invalid config leaves the
+// current file in place. The caller holds s.mu.
+func (s *XrayService) writeConfig(data []byte, author, reason string) error {
+	if err := s.validate(data); err != nil {
+		return err
 	}
-	clients = append(clients, newClient)
-	settings["clients"] = clients
 
-	if err := s.saveConfig(config); err != nil {
-		log.Printf("Error saving Xray config: %v", err)
-		return fmt.Errorf("failed to save Xray config: %w", err)
+	if s.History != nil {
+		// Первая запись: сохраняем и то, что было до неё, чтобы к нему можно было откатиться
+		if n, err := s.History.Len(); err == nil && n == 0 {
+			if current, err := os.ReadFile(s.ConfigPath); err == nil {
+				if _, err := s.History.Record(current, AuthorSystem, "config before history"); err != nil {
+					log.Printf("Failed to record the initial Xray config: %v", err)
+				}
+			}
+		}
 	}
 
+	if err := xray.WriteFileAtomic(s.ConfigPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+
+	if s.History != nil {
+		// Конфиг уже записан; без снимка теряется только история
+		if _, err := s.History.Record(data, author, reason); err != nil {
+			log.Printf("Failed to record Xray config version: %v", err)
+		}
+	}
 	return nil
 }
 
-func (s *XrayService) RemoveUserFromConfig(userUUID string) error {
-	config, err := s.loadConfig()
+// ConfigVersions lists the saved versions of the config, newest first.
+func (s *XrayService) ConfigVersions() ([]xray.Snapshot, error) {
+	if s.History == nil {
+		return nil, fmt.Errorf("config history is disabled")
+	}
+	return s.History.List()
+}
+
+// ConfigVersion returns one saved version with its config.
+func (s *XrayService) ConfigVersion(version int) (*xray.Snapshot, error) {
+	if s.History == nil {
+		return nil, fmt.Errorf("config history is disabled")
+	}
+	return s.History.Get(version)
+}
+
+// DiffConfigVersions compares two saved versions.
+func (s *XrayService) DiffConfigVersions(from, to int) ([]xray.DiffEntry, error) {
+	oldVersion, err := s.ConfigVersion(from)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	newVersion, err := s.ConfigVersion(to)
+	if err != nil {
+		return nil, err
+	}
+	return xray.Diff(oldVersion.Config, newVersion.Config)
+}
+
+// Rollback writes a saved version back as the current config and restarts
+// Xray to load it. Clients changed since then are put back in line with the
+// database by the reconciler.
+func (s *XrayService) Rollback(version int, author string) (*xray.Snapshot, error) {
+	snapshot, err := s.ConfigVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	err = s.writeConfig(snapshot.Config, author, fmt.Sprintf("rollback to version %d", version))
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
 	}
 
-	inbounds := config["inbounds"].([]interface{})
-	firstInbound := inbounds[0].(map[string]interface{})
-	settings := firstInbound["settings"].(map[string]interface{})
-	clients := settings["clients"].([]interface{})
+	if err := s.RestartXray(); err != nil {
+		return snapshot, err
+	}
+	return snapshot, nil
+}
 
-	newClients := []interface{}{}
-	for _, client := range clients {
-		if client.(map[string]interface{})["id"] != userUUID {
-			newClients = append(newClients, client)
+// InboundTagsFor returns the inbound tags the user should be provisioned in.
+func (s *XrayService) InboundTagsFor(user *models.User) []string {
+	if len(user.Tariff.InboundTags) > 0 {
+		return user.Tariff.InboundTags
+	}
+	return s.DefaultInboundTags
+}
+
+// targetInbounds resolves tags against the config. No tags selects every
+// inbound that accepts clients.
+func targetInbounds(config *xray.Config, tags []string) ([]*xray.Inbound, error) {
+	if len(tags) == 0 {
+		inbounds := config.ClientInbounds()
+		if len(inbounds) == 0 {
+			return nil, xray.ErrNoClientInbound
 		}
+		return inbounds, nil
 	}
-	settings["clients"] = newClients
 
-	return s.saveConfig(config)
+	inbounds := make([]*xray.Inbound, 0, len(tags))
+	for _, tag := range tags {
+		inbound, err := config.Inbound(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !inbound.AcceptsClients() {
+			return nil, fmt.Errorf("inbound %q (%s) does not accept clients", tag, inbound.Protocol)
+		}
+		inbounds = append(inbounds, inbound)
+	}
+	return inbounds, nil
 }
 
-func (s *XrayService) UpdateUserTariff(userUUID string, level int) error {
+// ValidateInboundTags checks that every tag names a client inbound in the
+// current config.
+func (s *XrayService) ValidateInboundTags(tags []string) error {
 	config, err := s.loadConfig()
 	if err != nil {
 		return err
 	}
+	_, err = targetInbounds(config, tags)
+	return err
+}
 
-	inbounds := config["inbounds"].([]interface{})
-	firstInbound := inbounds[0].(map[string]interface{})
-	settings := firstInbound["settings"].(map[string]interface{})
-	clients := settings["clients"].([]interface{})
+// clientChange is one client added to or removed from an inbound. Changes
+// are collected while editing the config file and then replayed against the
+// running Xray through its API.
+type clientChange struct {
+	inbound *xray.Inbound
+	client  xray.Client
+	removed bool
+}
 
-	for _, client := range clients {
-		clientMap := client.(map[string]interface{})
-		if clientMap["id"] == userUUID {
-			clientMap["level"] = level
-			break
-		}
+func removeClient(inbound *xray.Inbound, userUUID string, changes []clientChange) []clientChange {
+	if client := inbound.Client(userUUID); client != nil {
+		changes = append(changes, clientChange{inbound: inbound, client: *client, removed: true})
+		inbound.RemoveClient(userUUID)
 	}
+	return changes
+}
 
-	return s.saveConfig(config)
+func addClient(inbound *xray.Inbound, client xray.Client, changes []clientChange) ([]clientChange, error) {
+	if err := inbound.AddClient(client); err != nil {
+		return changes, err
+	}
+	return append(changes, clientChange{inbound: inbound, client: client}), nil
 }
 
-func (s *XrayService) RestartXray() error {
-	cmd := exec.Command("systemctl", "restart", "xray")
-	output, err := cmd.CombinedOutput()
+// syncClient makes the user present with the given level in exactly the
+// target inbounds and absent from every other client inbound.
+func syncClient(config *xray.Config, user *models.User, tags []string, level int) ([]clientChange, error) {
+	targets, err := targetInbounds(config, tags)
 	if err != nil {
-		log.Printf("Failed to restart Xray: %v, output: %s", err, string(output))
+		return nil, err
+	}
+	wanted := make(map[*xray.Inbound]bool, len(targets))
+	for _, inbound := range targets {
+		wanted[inbound] = true
+	}
+
+	var changes []clientChange
+	for _, inbound := range config.ClientInbounds() {
+		client := inbound.Client(user.UUID)
+		if !wanted[inbound] {
+			changes = removeClient(inbound, user.UUID, changes)
+			continue
+		}
+		newClient := inbound.NewClient(user.UUID, user.Email, level)
+		if client != nil {
+			if client.Level == level && (client.Password != "" || newClient.Password == "") {
+				continue
+			}
+			// Xray can't change a live user's level, so it is re-added.
+			// Clients written before passwords were set get one now.
+			password := newClient.Password
+			newClient = *client
+			newClient.Level = level
+			if newClient.Password == "" {
+				newClient.Password = password
+			}
+			changes = removeClient(inbound, user.UUID, changes)
+		}
+		if changes, err = addClient(inbound, newClient, changes); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// applyLive replays config changes on the running Xray so that nobody gets
+// disconnected. If the API is not configured or a call fails, it falls back
+// to restarting Xray, which picks the changes up from the file.
+func (s *XrayService) applyLive(changes []clientChange) {
+	if len(changes) == 0 {
+		return
+	}
+	if s.API == nil {
+		s.ScheduleRestart()
+		return
+	}
+
+	for _, change := range changes {
+		var err error
+		switch {
+		case change.inbound.Tag == "" || change.client.Email == "":
+			err = fmt.Errorf("inbound tag and client email are required for live changes")
+		case change.removed:
+			err = s.API.RemoveUser(context.Background(), change.inbound.Tag, change.client.Email)
+			if errors.Is(err, xray.ErrClientNotFound) {
+				err = nil
+			}
+		default:
+			err = s.API.AddUser(context.Background(), change.inbound.Tag, xray.NewUser(change.inbound, change.client))
+			if errors.Is(err, xray.ErrClientExists) {
+				err = nil
+			}
+		}
+		if err != nil {
+			log.Printf("Live Xray update failed, falling back to restart: %v", err)
+			s.ScheduleRestart()
+			return
+		}
+	}
+}
+
+// AddUserToConfig adds the user to every inbound of their tariff at the
+// tariff's Xray level, writes the config file and applies the change to the
+// running Xray.
+func (s *XrayService) AddUserToConfig(user *models.User) error {
+	err := s.mutateConfig("add user "+user.Email, func(config *xray.Config) ([]clientChange, error) {
+		inbounds, err := targetInbounds(config, s.InboundTagsFor(user))
+		if err != nil {
+			return nil, err
+		}
+
+		// Добавляем пользователя во все inbound'ы тарифа, где его ещё нет
+		var changes []clientChange
+		for _, inbound := range inbounds {
+			if inbound.Client(user.UUID) != nil {
+				continue
+			}
+			if changes, err = addClient(inbound, inbound.NewClient(user.UUID, user.Email, user.Tariff.XrayLevel), changes); err != nil {
+				return nil, err
+			}
+		}
+		if len(changes) == 0 {
+			log.Printf("User with UUID %s already exists in Xray config", user.UUID)
+			return nil, fmt.Errorf("%w: %s", xray.ErrClientExists, user.UUID)
+		}
+		return changes, nil
+	})
+	if err != nil && !errors.Is(err, xray.ErrClientExists) {
+		log.Printf("Error adding user to Xray config: %v", err)
+	}
+	return err
+}
+
+// RemoveUserFromConfig drops the user from every inbound.
+func (s *XrayService) RemoveUserFromConfig(userUUID string) error {
+	return s.mutateConfig("remove user "+userUUID, func(config *xray.Config) ([]clientChange, error) {
+		var changes []clientChange
+		for _, inbound := range config.ClientInbounds() {
+			changes = removeClient(inbound, userUUID, changes)
+		}
+		return changes, nil
+	})
+}
+
+// UpdateUserTariff moves the user to the inbound set of their current tariff
+// and sets the client level.
+func (s *XrayService) UpdateUserTariff(user *models.User, level int) error {
+	reason := fmt.Sprintf("sync user %s at level %d", user.Email, level)
+	return s.mutateConfig(reason, func(config *xray.Config) ([]clientChange, error) {
+		return syncClient(config, user, s.InboundTagsFor(user), level)
+	})
+}
+
+func (s *XrayService) controller() xray.Controller {
+	if s.Controller == nil {
+		return xray.NewSystemdController("xray")
+	}
+	return s.Controller
+}
+
+func (s *XrayService) restartXray(ctx context.Context) error {
+	if err := s.controller().Restart(ctx); err != nil {
+		log.Printf("Failed to restart Xray: %v", err)
 		return fmt.Errorf("failed to restart Xray: %w", err)
 	}
-	log.Printf("Xray restarted successfully, output: %s", string(output))
+	log.Printf("Xray restarted successfully")
 	return nil
 }
 
+// RestartXray restarts Xray right away, after a restart already in
+// progress, and serves the pending scheduled requests too.
+func (s *XrayService) RestartXray() error {
+	if s.Restarts == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), restartTimeout)
+		defer cancel()
+		return s.restartXray(ctx)
+	}
+	return s.Restarts.RestartNow()
+}
+
+// XrayStatus reports whether Xray runs and for how long.
+func (s *XrayService) XrayStatus(ctx context.Context) (xray.ProcessStatus, error) {
+	return s.controller().Status(ctx)
+}
+
+// ScheduleRestart asks for a restart; requests in a burst share one.
 func (s *XrayService) ScheduleRestart() {
-	go func() {
-		time.Sleep(1 * time.Second)
-		if err := s.RestartXray(); err != nil {
-			log.Printf("Error restarting Xray: %v", err)
-		}
-	}()
+	if s.Restarts == nil {
+		go s.RestartXray()
+		return
+	}
+	s.Restarts.Request()
 }
 
 func (s *XrayService) GenerateUserConfig(user *models.User) ([]byte, error) {
@@ -253,39 +556,23 @@ func (s *XrayService) GetUserConfigFromFile(user *models.User) ([]byte, error) {
 		return nil, err
 	}
 
-	inbounds, ok := config["inbounds"].([]interface{})
-	if !ok || len(inbounds) == 0 {
-		return nil, fmt.Errorf("no inbounds found in config")
-	}
-	firstInbound := inbounds[0].(map[string]interface{})
-	settings := firstInbound["settings"].(map[string]interface{})
-	clients := settings["clients"].([]interface{})
-
-	// Найти клиента по UUID
-	var userClient map[string]interface{}
-	for _, c := range clients {
-		client := c.(map[string]interface{})
-		if client["id"] == user.UUID {
-			userClient = client
-			break
+	// Собрать минимальный конфиг из всех inbound'ов, где есть пользователь
+	userConfig := &xray.Config{}
+	for _, inbound := range config.ClientInbounds() {
+		client := inbound.Client(user.UUID)
+		if client == nil {
+			continue
 		}
+		userConfig.Inbounds = append(userConfig.Inbounds, xray.Inbound{
+			Tag:      inbound.Tag,
+			Port:     inbound.Port,
+			Protocol: inbound.Protocol,
+			Settings: &xray.InboundSettings{Clients: []xray.Client{*client}},
+		})
 	}
-	if userClient == nil {
-		return nil, fmt.Errorf("user not found in xray config")
-	}
-
-	// Собрать минимальный конфиг для пользователя
-	userConfig := map[string]interface{}{
-		"inbounds": []interface{}{
-			map[string]interface{}{
-				"port":     firstInbound["port"],
-				"protocol": firstInbound["protocol"],
-				"settings": map[string]interface{}{
-					"clients": []interface{}{userClient},
-				},
-			},
-		},
+	if len(userConfig.Inbounds) == 0 {
+		return nil, fmt.Errorf("%w: %s", xray.ErrClientNotFound, user.UUID)
 	}
 
-	return json.MarshalIndent(userConfig, "", "  ")
+	return userConfig.Marshal()
 }
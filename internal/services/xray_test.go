@@ -1,9 +1,21 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 	"vpn-backend/internal/models"
+	"vpn-backend/internal/xray"
+	"vpn-backend/internal/xray/xraytest"
 )
 
 func TestGenerateUserConfig(t *testing.T) {
@@ -46,3 +58,308 @@ func TestGenerateUserConfig(t *testing.T) {
 		t.Fatalf("Expected UUID %s, got %s", user.UUID, client["id"])
 	}
 }
+
+func TestUpdateUserTariffMovesUserBetweenInbounds(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(configPath, []byte(`{
+		"inbounds": [
+			{"tag": "vless-ws", "port": 10000, "protocol": "vless", "settings": {"clients": [], "decryption": "none"}},
+			{"type": "tun", "tag": "tun-in"},
+			{"tag": "trojan-tcp", "port": 10001, "protocol": "trojan", "settings": {"clients": []}},
+			{"tag": "api", "port": 10085, "protocol": "dokodemo-door", "settings": {"address": "127.0.0.1"}}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := &XrayService{ConfigPath: configPath, Controller: &countingController{}}
+	user := &models.User{Email: "test@example.com", UUID: "test-uuid"}
+	user.Tariff.InboundTags = []string{"vless-ws", "trojan-tcp"}
+	user.Tariff.XrayLevel = 3
+
+	if err := service.AddUserToConfig(user); err != nil {
+		t.Fatalf("Failed to add user: %v", err)
+	}
+	added, err := xray.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inbound := range added.ClientInbounds() {
+		if client := inbound.Client(user.UUID); client == nil || client.Level != 3 {
+			t.Fatalf("Expected the user in %s at the tariff level 3, got %+v", inbound.Tag, client)
+		}
+	}
+	if err := service.AddUserToConfig(user); !errors.Is(err, xray.ErrClientExists) {
+		t.Fatalf("Expected ErrClientExists on second add, got %v", err)
+	}
+
+	user.Tariff.InboundTags = []string{"trojan-tcp"}
+	if err := service.UpdateUserTariff(user, 2); err != nil {
+		t.Fatalf("Failed to update tariff: %v", err)
+	}
+
+	config, err := xray.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vless, _ := config.Inbound("vless-ws")
+	if vless.Client(user.UUID) != nil {
+		t.Fatal("Expected user to be removed from vless-ws")
+	}
+	trojan, _ := config.Inbound("trojan-tcp")
+	client := trojan.Client(user.UUID)
+	if client == nil || client.Level != 2 {
+		t.Fatalf("Expected user in trojan-tcp with level 2, got %+v", client)
+	}
+
+	user.Tariff.InboundTags = []string{"api"}
+	if err := service.UpdateUserTariff(user, 0); err == nil {
+		t.Fatal("Expected error when targeting an inbound without clients")
+	}
+}
+
+func TestAddUserToConfigAppliesLive(t *testing.T) {
+	server := xraytest.NewServer("vless-ws", "ss")
+	defer server.Close()
+
+	api, err := xray.NewAPIClient(server.Addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	err = os.WriteFile(configPath, []byte(`{
+		"inbounds": [
+			{"tag": "vless-ws", "port": 10000, "protocol": "vless", "settings": {"clients": [], "decryption": "none"}},
+			{"tag": "ss", "port": 10001, "protocol": "shadowsocks", "settings": {"method": "aes-256-gcm", "clients": []}}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller := &countingController{}
+	service := &XrayService{ConfigPath: configPath, API: api, Controller: controller}
+	user := &models.User{Email: "live@example.com", UUID: "live-uuid"}
+	if err := service.AddUserToConfig(user); err != nil {
+		t.Fatalf("Failed to add user: %v", err)
+	}
+
+	users := server.Users("vless-ws")
+	if len(users) != 1 || users[0].ID != user.UUID || users[0].Email != user.Email {
+		t.Fatalf("Expected user to be added live, got %+v", users)
+	}
+	if users := server.Users("ss"); len(users) != 1 || users[0].Password != user.UUID || users[0].Method != "aes-256-gcm" {
+		t.Fatalf("Expected the shadowsocks user to be added live, got %+v", users)
+	}
+
+	// Смена уровня переустанавливает пользователя в Xray
+	if err := service.UpdateUserTariff(user, 3); err != nil {
+		t.Fatalf("Failed to update tariff: %v", err)
+	}
+	users = server.Users("vless-ws")
+	if len(users) != 1 || users[0].Level != 3 {
+		t.Fatalf("Expected live user at level 3, got %+v", users)
+	}
+
+	if err := service.RemoveUserFromConfig(user.UUID); err != nil {
+		t.Fatalf("Failed to remove user: %v", err)
+	}
+	if users := server.Users("vless-ws"); len(users) != 0 {
+		t.Fatalf("Expected user to be removed live, got %+v", users)
+	}
+	if n := atomic.LoadInt32(&controller.restarts); n != 0 {
+		t.Errorf("Expected no restarts for client changes, got %d", n)
+	}
+}
+
+func TestSlowLiveUpdateDoesNotBlockWrites(t *testing.T) {
+	// Xray API, который принимает соединение и молчит
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	api, err := xray.NewAPIClient(listener.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	err = os.WriteFile(configPath, []byte(`{
+		"inbounds": [
+			{"tag": "vless-ws", "port": 10000, "protocol": "vless", "settings": {"clients": [], "decryption": "none"}}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &XrayService{ConfigPath: configPath, API: api, Controller: &countingController{}}
+
+	added := make(chan error, 1)
+	go func() {
+		added <- service.AddUserToConfig(&models.User{Email: "slow@example.com", UUID: "slow-uuid"})
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		config, err := xray.LoadConfig(configPath)
+		if err == nil && config.Inbounds[0].Client("slow-uuid") != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the config to be saved before the live update")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Пока первый пользователь ждет API, остальные записи не стоят
+	start := time.Now()
+	if err := service.SyncPolicyLevels([]models.Tariff{{Name: "base", XrayLevel: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Config write waited %s for the live update", elapsed)
+	}
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rejectingValidator fails every candidate like `xray run -test` would.
+type rejectingValidator struct{}
+
+func (rejectingValidator) Validate(ctx context.Context, data []byte) error {
+	return fmt.Errorf("%w: Failed to start: test rejection", xray.ErrInvalidConfig)
+}
+
+func TestInvalidConfigKeepsCurrentFile(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	original := []byte(`{"inbounds": [{"tag": "vless-ws", "port": 10000, "protocol": "vless", "settings": {"clients": []}}]}`)
+	if err := os.WriteFile(configPath, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &XrayService{
+		ConfigPath: configPath,
+		History:    xray.NewHistory(filepath.Join(dir, "history"), 5),
+		Controller: &countingController{},
+	}
+	service.Validator = rejectingValidator{}
+	user := &models.User{Email: "test@example.com", UUID: "test-uuid"}
+
+	err := service.AddUserToConfig(user)
+	if !errors.Is(err, xray.ErrInvalidConfig) || !strings.Contains(err.Error(), "test rejection") {
+		t.Fatalf("Expected the validator error, got %v", err)
+	}
+	if data, _ := os.ReadFile(configPath); string(data) != string(original) {
+		t.Fatalf("Expected the config to stay in place, got %s", data)
+	}
+
+	service.Validator = nil
+	if err := service.AddUserToConfig(user); err != nil {
+		t.Fatalf("Failed to add user: %v", err)
+	}
+	versions, err := service.ConfigVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Reason != "add user test@example.com" || versions[1].Reason != "config before history" {
+		t.Fatalf("Expected the original and the new version, got %+v", versions)
+	}
+	diff, err := service.DiffConfigVersions(versions[1].Version, versions[0].Version)
+	if err != nil || len(diff) != 3 {
+		t.Fatalf("Expected the added client id, email and level in the diff, got %+v, %v", diff, err)
+	}
+}
+
+// countingController counts restarts instead of running systemctl.
+type countingController struct {
+	restarts int32
+}
+
+func (c *countingController) Restart(ctx context.Context) error {
+	atomic.AddInt32(&c.restarts, 1)
+	return nil
+}
+
+func (c *countingController) Status(ctx context.Context) (xray.ProcessStatus, error) {
+	return xray.ProcessStatus{Controller: "test", Running: true}, nil
+}
+
+func TestConcurrentRegistrationsKeepEveryUser(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	err := os.WriteFile(configPath, []byte(`{
+		"inbounds": [
+			{"tag": "vless-ws", "port": 10000, "protocol": "vless", "settings": {"clients": [], "decryption": "none"}},
+			{"tag": "trojan-tcp", "port": 10001, "protocol": "trojan", "settings": {"clients": []}}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := NewXrayService(nil, configPath, "")
+	controller := &countingController{}
+	service.Controller = controller
+	service.Restarts.Window = time.Hour
+	service.History = xray.NewHistory(filepath.Join(dir, "history"), 5)
+
+	const users = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, users)
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := &models.User{Email: fmt.Sprintf("user%d@example.com", i), UUID: fmt.Sprintf("uuid-%d", i)}
+			// Половина приходит через регистрацию, половина — через смену тарифа
+			if i%2 == 0 {
+				errs <- service.AddUserToConfig(user)
+			} else {
+				errs <- service.UpdateUserTariff(user, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Concurrent update failed: %v", err)
+		}
+	}
+
+	config, err := xray.LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inbound := range config.ClientInbounds() {
+		if len(inbound.Settings.Clients) != users {
+			t.Fatalf("Expected %d clients in %s, got %d", users, inbound.Tag, len(inbound.Settings.Clients))
+		}
+	}
+
+	// Без API каждая правка просит перезапуск, и все они ждут одного
+	if status := service.Restarts.Status(); status.Pending != users {
+		t.Fatalf("Expected %d pending restart requests, got %+v", users, status)
+	}
+	if err := service.RestartXray(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&controller.restarts); n != 1 || service.Restarts.Status().Pending != 0 {
+		t.Errorf("Expected one restart to serve every request, got %d restarts", n)
+	}
+}
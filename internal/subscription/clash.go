@@ -0,0 +1,152 @@
+package subscription
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// clashProtocols are the protocols Clash Meta (mihomo) can dial.
+var clashProtocols = map[string]string{
+	"vless":       "vless",
+	"vmess":       "vmess",
+	"trojan":      "trojan",
+	"shadowsocks": "ss",
+}
+
+// proxyNames returns a unique, non-empty name for every endpoint, as Clash
+// and sing-box refer to proxies by name.
+func proxyNames(endpoints []Endpoint) []string {
+	names := make([]string, len(endpoints))
+	seen := make(map[string]int)
+	for i, e := range endpoints {
+		name := e.Remark
+		if name == "" {
+			name = e.Protocol + "-" + e.Address + ":" + strconv.Itoa(e.Port)
+		}
+		seen[name]++
+		if n := seen[name]; n > 1 {
+			name = fmt.Sprintf("%s %d", name, n)
+		}
+		names[i] = name
+	}
+	return names
+}
+
+// yamlString quotes s for YAML. A JSON string is a valid YAML flow scalar,
+// which saves us from YAML's own escaping rules.
+func yamlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// Clash renders a Clash Meta profile with one selector group over all
+// endpoints.
+func Clash(name string, endpoints []Endpoint) []byte {
+	if name == "" {
+		name = "proxy"
+	}
+	names := proxyNames(endpoints)
+
+	var b bytes.Buffer
+	b.WriteString("mixed-port: 7890\n")
+	b.WriteString("allow-lan: false\n")
+	b.WriteString("mode: rule\n")
+	b.WriteString("log-level: info\n")
+	b.WriteString("\nproxies:\n")
+
+	var included []string
+	for i, e := range endpoints {
+		typ, ok := clashProtocols[e.Protocol]
+		if !ok {
+			continue
+		}
+		included = append(included, names[i])
+
+		fmt.Fprintf(&b, "  - name: %s\n", yamlString(names[i]))
+		fmt.Fprintf(&b, "    type: %s\n", typ)
+		fmt.Fprintf(&b, "    server: %s\n", yamlString(e.Address))
+		fmt.Fprintf(&b, "    port: %d\n", e.Port)
+		fmt.Fprintf(&b, "    udp: true\n")
+		switch e.Protocol {
+		case "vless":
+			fmt.Fprintf(&b, "    uuid: %s\n", yamlString(e.ID))
+			if e.Flow != "" {
+				fmt.Fprintf(&b, "    flow: %s\n", yamlString(e.Flow))
+			}
+		case "vmess":
+			fmt.Fprintf(&b, "    uuid: %s\n", yamlString(e.ID))
+			fmt.Fprintf(&b, "    alterId: 0\n")
+			fmt.Fprintf(&b, "    cipher: auto\n")
+		case "trojan":
+			fmt.Fprintf(&b, "    password: %s\n", yamlString(e.Password))
+		case "shadowsocks":
+			fmt.Fprintf(&b, "    cipher: %s\n", yamlString(e.Method))
+			fmt.Fprintf(&b, "    password: %s\n", yamlString(e.Password))
+			continue
+		}
+
+		if e.TLS() {
+			// У trojan TLS включен всегда, отдельный ключ не нужен
+			if e.Protocol != "trojan" {
+				fmt.Fprintf(&b, "    tls: true\n")
+			}
+			if e.SNI != "" {
+				key := "servername"
+				if e.Protocol == "trojan" {
+					key = "sni"
+				}
+				fmt.Fprintf(&b, "    %s: %s\n", key, yamlString(e.SNI))
+			}
+			if e.Fingerprint != "" {
+				fmt.Fprintf(&b, "    client-fingerprint: %s\n", yamlString(e.Fingerprint))
+			}
+			if e.Security == "reality" {
+				fmt.Fprintf(&b, "    reality-opts:\n")
+				fmt.Fprintf(&b, "      public-key: %s\n", yamlString(e.PublicKey))
+				if e.ShortID != "" {
+					fmt.Fprintf(&b, "      short-id: %s\n", yamlString(e.ShortID))
+				}
+			}
+			if len(e.ALPN) > 0 {
+				fmt.Fprintf(&b, "    alpn:\n")
+				for _, alpn := range e.ALPN {
+					fmt.Fprintf(&b, "      - %s\n", yamlString(alpn))
+				}
+			}
+		}
+
+		switch e.Network {
+		case "ws":
+			fmt.Fprintf(&b, "    network: ws\n")
+			fmt.Fprintf(&b, "    ws-opts:\n")
+			fmt.Fprintf(&b, "      path: %s\n", yamlString(pathOrRoot(e.Path)))
+			if e.Host != "" {
+				fmt.Fprintf(&b, "      headers:\n")
+				fmt.Fprintf(&b, "        Host: %s\n", yamlString(e.Host))
+			}
+		case "grpc":
+			fmt.Fprintf(&b, "    network: grpc\n")
+			fmt.Fprintf(&b, "    grpc-opts:\n")
+			fmt.Fprintf(&b, "      grpc-service-name: %s\n", yamlString(e.ServiceName))
+		}
+	}
+	if len(included) == 0 {
+		// Пустой список proxies Clash считает ошибкой
+		b.WriteString("  []\n")
+	}
+
+	b.WriteString("\nproxy-groups:\n")
+	fmt.Fprintf(&b, "  - name: %s\n", yamlString(name))
+	b.WriteString("    type: select\n")
+	b.WriteString("    proxies:\n")
+	for _, n := range included {
+		fmt.Fprintf(&b, "      - %s\n", yamlString(n))
+	}
+	b.WriteString("      - DIRECT\n")
+
+	b.WriteString("\nrules:\n")
+	fmt.Fprintf(&b, "  - %s\n", yamlString("MATCH,"+name))
+	return b.Bytes()
+}
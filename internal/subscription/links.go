@@ -0,0 +1,140 @@
+package subscription
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Links returns the share links of the endpoints, skipping protocols that
+// have no link form.
+func Links(endpoints []Endpoint) []string {
+	links := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		if link := Link(e); link != "" {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// Link returns the share link of one endpoint, or "" if the protocol has none.
+func Link(e Endpoint) string {
+	switch e.Protocol {
+	case "vless":
+		q := transportQuery(e)
+		q.Set("encryption", "none")
+		if e.Flow != "" {
+			q.Set("flow", e.Flow)
+		}
+		return shareURL("vless", e.ID, e, q)
+	case "trojan":
+		return shareURL("trojan", e.Password, e, transportQuery(e))
+	case "shadowsocks":
+		userinfo := base64.RawURLEncoding.EncodeToString([]byte(e.Method + ":" + e.Password))
+		return "ss://" + userinfo + "@" + hostPort(e) + "#" + url.PathEscape(e.Remark)
+	case "vmess":
+		return vmessLink(e)
+	}
+	return ""
+}
+
+func hostPort(e Endpoint) string {
+	return net.JoinHostPort(e.Address, strconv.Itoa(e.Port))
+}
+
+// shareURL builds the scheme://credential@host:port?query#remark form used by
+// vless and trojan.
+func shareURL(scheme, credential string, e Endpoint, q url.Values) string {
+	u := url.URL{
+		Scheme:   scheme,
+		User:     url.User(credential),
+		Host:     hostPort(e),
+		RawQuery: q.Encode(),
+		Fragment: e.Remark,
+	}
+	return u.String()
+}
+
+func transportQuery(e Endpoint) url.Values {
+	q := url.Values{}
+	network := e.Network
+	if network == "" {
+		network = "tcp"
+	}
+	q.Set("type", network)
+	security := e.Security
+	if security == "" {
+		security = "none"
+	}
+	q.Set("security", security)
+	if e.SNI != "" {
+		q.Set("sni", e.SNI)
+	}
+	if e.Fingerprint != "" {
+		q.Set("fp", e.Fingerprint)
+	}
+	if security == "reality" {
+		q.Set("pbk", e.PublicKey)
+		if e.ShortID != "" {
+			q.Set("sid", e.ShortID)
+		}
+	}
+	if len(e.ALPN) > 0 {
+		q.Set("alpn", strings.Join(e.ALPN, ","))
+	}
+	if e.Host != "" {
+		q.Set("host", e.Host)
+	}
+	switch network {
+	case "ws", "httpupgrade", "xhttp", "splithttp":
+		q.Set("path", pathOrRoot(e.Path))
+	case "grpc":
+		q.Set("serviceName", e.ServiceName)
+	}
+	return q
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// vmessLink builds the base64 JSON link format from v2rayN.
+func vmessLink(e Endpoint) string {
+	tls := ""
+	if e.TLS() {
+		tls = e.Security
+	}
+	network := e.Network
+	if network == "" {
+		network = "tcp"
+	}
+	path := e.Path
+	if network == "grpc" {
+		path = e.ServiceName
+	}
+	data, _ := json.Marshal(map[string]string{
+		"v":    "2",
+		"ps":   e.Remark,
+		"add":  e.Address,
+		"port": strconv.Itoa(e.Port),
+		"id":   e.ID,
+		"aid":  "0",
+		"scy":  "auto",
+		"net":  network,
+		"type": "none",
+		"host": e.Host,
+		"path": path,
+		"tls":  tls,
+		"sni":  e.SNI,
+		"alpn": strings.Join(e.ALPN, ","),
+		"fp":   e.Fingerprint,
+	})
+	return "vmess://" + base64.StdEncoding.EncodeToString(data)
+}
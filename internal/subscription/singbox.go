@@ -0,0 +1,143 @@
+package subscription
+
+import "encoding/json"
+
+type singBoxTLS struct {
+	Enabled    bool            `json:"enabled"`
+	ServerName string          `json:"server_name,omitempty"`
+	ALPN       []string        `json:"alpn,omitempty"`
+	UTLS       *singBoxUTLS    `json:"utls,omitempty"`
+	Reality    *singBoxReality `json:"reality,omitempty"`
+}
+
+type singBoxReality struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"public_key"`
+	ShortID   string `json:"short_id,omitempty"`
+}
+
+type singBoxUTLS struct {
+	Enabled     bool   `json:"enabled"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type singBoxTransport struct {
+	Type        string            `json:"type"`
+	Path        string            `json:"path,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+	Host        string            `json:"host,omitempty"`
+}
+
+type singBoxOutbound struct {
+	Type       string            `json:"type"`
+	Tag        string            `json:"tag"`
+	Server     string            `json:"server,omitempty"`
+	ServerPort int               `json:"server_port,omitempty"`
+	UUID       string            `json:"uuid,omitempty"`
+	Password   string            `json:"password,omitempty"`
+	Method     string            `json:"method,omitempty"`
+	Flow       string            `json:"flow,omitempty"`
+	Security   string            `json:"security,omitempty"`
+	TLS        *singBoxTLS       `json:"tls,omitempty"`
+	Transport  *singBoxTransport `json:"transport,omitempty"`
+	Outbounds  []string          `json:"outbounds,omitempty"`
+}
+
+// SingBox renders a sing-box client profile: a selector named name over all
+// endpoints, plus a direct outbound.
+func SingBox(name string, endpoints []Endpoint) ([]byte, error) {
+	if name == "" {
+		name = "proxy"
+	}
+	names := proxyNames(endpoints)
+
+	var proxies []singBoxOutbound
+	var tags []string
+	for i, e := range endpoints {
+		out := singBoxOutbound{
+			Tag:        names[i],
+			Server:     e.Address,
+			ServerPort: e.Port,
+		}
+		switch e.Protocol {
+		case "vless":
+			out.Type = "vless"
+			out.UUID = e.ID
+			out.Flow = e.Flow
+		case "vmess":
+			out.Type = "vmess"
+			out.UUID = e.ID
+			out.Security = "auto"
+		case "trojan":
+			out.Type = "trojan"
+			out.Password = e.Password
+		case "shadowsocks":
+			out.Type = "shadowsocks"
+			out.Method = e.Method
+			out.Password = e.Password
+		default:
+			continue
+		}
+		if e.Protocol != "shadowsocks" {
+			out.TLS = singBoxTLSFor(e)
+			out.Transport = singBoxTransportFor(e)
+		}
+		proxies = append(proxies, out)
+		tags = append(tags, out.Tag)
+	}
+
+	outbounds := []singBoxOutbound{{
+		Type:      "selector",
+		Tag:       name,
+		Outbounds: append(tags, "direct"),
+	}}
+	outbounds = append(outbounds, proxies...)
+	outbounds = append(outbounds, singBoxOutbound{Type: "direct", Tag: "direct"})
+
+	profile := map[string]interface{}{
+		"log": map[string]string{"level": "info"},
+		"inbounds": []map[string]interface{}{{
+			"type":        "mixed",
+			"tag":         "mixed-in",
+			"listen":      "127.0.0.1",
+			"listen_port": 2080,
+		}},
+		"outbounds": outbounds,
+		"route": map[string]interface{}{
+			"final":                 name,
+			"auto_detect_interface": true,
+		},
+	}
+	return json.MarshalIndent(profile, "", "  ")
+}
+
+func singBoxTLSFor(e Endpoint) *singBoxTLS {
+	if !e.TLS() {
+		return nil
+	}
+	tls := &singBoxTLS{Enabled: true, ServerName: e.SNI, ALPN: e.ALPN}
+	if e.Fingerprint != "" {
+		tls.UTLS = &singBoxUTLS{Enabled: true, Fingerprint: e.Fingerprint}
+	}
+	if e.Security == "reality" {
+		tls.Reality = &singBoxReality{Enabled: true, PublicKey: e.PublicKey, ShortID: e.ShortID}
+	}
+	return tls
+}
+
+func singBoxTransportFor(e Endpoint) *singBoxTransport {
+	switch e.Network {
+	case "ws":
+		t := &singBoxTransport{Type: "ws", Path: pathOrRoot(e.Path)}
+		if e.Host != "" {
+			t.Headers = map[string]string{"Host": e.Host}
+		}
+		return t
+	case "httpupgrade":
+		return &singBoxTransport{Type: "httpupgrade", Path: pathOrRoot(e.Path), Host: e.Host}
+	case "grpc":
+		return &singBoxTransport{Type: "grpc", ServiceName: e.ServiceName}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Package subscription renders the proxy endpoints of a user in the formats
+// VPN clients understand: base64 encoded share links (v2rayNG, v2rayN,
+// Streisand, Shadowrocket), Clash Meta YAML, sing-box JSON and plain links.
+package subscription
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Endpoint is one way for a user to reach a server: an inbound, the client
+// credentials in it, and the address clients should dial. Every format is
+// rendered from the same list of endpoints.
+type Endpoint struct {
+	Remark   string
+	Protocol string
+	Address  string
+	Port     int
+
+	// Credentials: ID for vless/vmess, Password for trojan/shadowsocks.
+	ID       string
+	Password string
+	Flow     string
+	// Method is the shadowsocks cipher.
+	Method string
+
+	// Transport
+	Network     string
+	Security    string
+	SNI         string
+	Host        string
+	Path        string
+	ServiceName string
+	ALPN        []string
+	Fingerprint string
+	// PublicKey and ShortID are the REALITY parameters.
+	PublicKey string
+	ShortID   string
+}
+
+// TLS reports whether the endpoint is wrapped in TLS.
+func (e Endpoint) TLS() bool {
+	return e.Security == "tls" || e.Security == "reality"
+}
+
+// Format is a subscription output format.
+type Format string
+
+const (
+	FormatBase64  Format = "base64"
+	FormatClash   Format = "clash"
+	FormatSingBox Format = "singbox"
+	FormatPlain   Format = "plain"
+)
+
+// ParseFormat accepts a ?format= value, including a few common aliases.
+func ParseFormat(s string) (Format, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "base64", "v2ray", "v2rayng", "links":
+		return FormatBase64, true
+	case "clash", "clash-meta", "clashmeta", "mihomo", "yaml":
+		return FormatClash, true
+	case "singbox", "sing-box", "sing_box", "json":
+		return FormatSingBox, true
+	case "plain", "raw", "text":
+		return FormatPlain, true
+	}
+	return "", false
+}
+
+// DetectFormat picks a format from the client's User-Agent. Unknown clients
+// get base64 links, which nearly every client can import.
+func DetectFormat(userAgent string) Format {
+	ua := strings.ToLower(userAgent)
+	switch {
+	// Hiddify пишет в User-Agent еще и "ClashMeta", поэтому проверяется первым
+	case strings.Contains(ua, "hiddify"), strings.Contains(ua, "sing-box"), strings.Contains(ua, "singbox"),
+		strings.HasPrefix(ua, "sfa/"), strings.HasPrefix(ua, "sfi/"), strings.HasPrefix(ua, "sfm/"):
+		return FormatSingBox
+	case strings.Contains(ua, "clash"), strings.Contains(ua, "mihomo"), strings.Contains(ua, "stash"):
+		return FormatClash
+	}
+	// v2rayNG, v2rayN, Streisand, Shadowrocket и все остальные
+	return FormatBase64
+}
+
+// Negotiate chooses the format from an explicit ?format= value, falling
+// back to the User-Agent. An unknown explicit value is an error.
+func Negotiate(format, userAgent string) (Format, error) {
+	if format == "" {
+		return DetectFormat(userAgent), nil
+	}
+	f, ok := ParseFormat(format)
+	if !ok {
+		return "", fmt.Errorf("unknown subscription format %q", format)
+	}
+	return f, nil
+}
+
+// Document is a rendered subscription.
+type Document struct {
+	ContentType string
+	Body        []byte
+}
+
+// Render builds the subscription in the given format. name is used where a
+// format wants a profile or group name.
+func Render(format Format, name string, endpoints []Endpoint) (Document, error) {
+	switch format {
+	case FormatBase64:
+		links := Links(endpoints)
+		body := base64.StdEncoding.EncodeToString([]byte(strings.Join(links, "\n")))
+		return Document{ContentType: "text/plain; charset=utf-8", Body: []byte(body)}, nil
+	case FormatPlain:
+		links := Links(endpoints)
+		return Document{ContentType: "text/plain; charset=utf-8", Body: []byte(strings.Join(links, "\n"))}, nil
+	case FormatClash:
+		return Document{ContentType: "text/yaml; charset=utf-8", Body: Clash(name, endpoints)}, nil
+	case FormatSingBox:
+		body, err := SingBox(name, endpoints)
+		if err != nil {
+			return Document{}, err
+		}
+		return Document{ContentType: "application/json; charset=utf-8", Body: body}, nil
+	}
+	return Document{}, fmt.Errorf("unknown subscription format %q", format)
+}
+
+// Userinfo is the Subscription-Userinfo header clients use to show quota
+// and expiry. Zero Total means unlimited, zero Expire means never.
+type Userinfo struct {
+	Upload   int64
+	Download int64
+	Total    int64
+	Expire   time.Time
+}
+
+func (u Userinfo) String() string {
+	var expire int64
+	if !u.Expire.IsZero() {
+		expire = u.Expire.Unix()
+	}
+	return fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", u.Upload, u.Download, u.Total, expire)
+}
+
+// ProfileTitle encodes a title for the profile-title header. Non-ASCII
+// titles go in the "base64:" form that Hiddify and Clash Verge accept.
+func ProfileTitle(title string) string {
+	for i := 0; i < len(title); i++ {
+		if title[i] < 0x20 || title[i] > 0x7e {
+			return "base64:" + base64.StdEncoding.EncodeToString([]byte(title))
+		}
+	}
+	return title
+}
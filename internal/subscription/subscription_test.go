@@ -0,0 +1,220 @@
+package subscription
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEndpoints = []Endpoint{
+	{
+		Remark:   "vless-ws",
+		Protocol: "vless",
+		Address:  "vpn.example.com",
+		Port:     443,
+		ID:       "a9956e12-2365-4fcb-95f3-d7b1a5cea860",
+		Network:  "ws",
+		Security: "tls",
+		SNI:      "vpn.example.com",
+		Path:     "/ws",
+	},
+	{
+		Remark:   "trojan",
+		Protocol: "trojan",
+		Address:  "vpn.example.com",
+		Port:     8443,
+		Password: "secret",
+		Security: "tls",
+	},
+	{
+		Remark:   "unsupported",
+		Protocol: "dokodemo-door",
+		Address:  "vpn.example.com",
+		Port:     1,
+	},
+}
+
+func TestDetectFormat(t *testing.T) {
+	cases := map[string]Format{
+		"v2rayNG/1.8.5":                   FormatBase64,
+		"Streisand/1.5":                   FormatBase64,
+		"ClashMetaForAndroid/2.10.1.Meta": FormatClash,
+		"clash-verge/v1.5.11":             FormatClash,
+		"mihomo/1.18":                     FormatClash,
+		"SFA/1.8.0 (sing-box 1.8.0)":      FormatSingBox,
+		"HiddifyNext/2.0.5 (android) like ClashMeta v2ray sing-box": FormatSingBox,
+		"": FormatBase64,
+	}
+	for ua, want := range cases {
+		if got := DetectFormat(ua); got != want {
+			t.Errorf("DetectFormat(%q) = %s, want %s", ua, got, want)
+		}
+	}
+}
+
+func TestNegotiatePrefersQuery(t *testing.T) {
+	format, err := Negotiate("sing-box", "v2rayNG/1.8.5")
+	if err != nil || format != FormatSingBox {
+		t.Fatalf("Negotiate() = %s, %v; want singbox", format, err)
+	}
+	if _, err := Negotiate("xml", ""); err == nil {
+		t.Fatal("Expected error for unknown format")
+	}
+}
+
+func TestRenderBase64(t *testing.T) {
+	doc, err := Render(FormatBase64, "VPN", testEndpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(doc.Body))
+	if err != nil {
+		t.Fatalf("Body is not base64: %v", err)
+	}
+	links := strings.Split(string(decoded), "\n")
+	if len(links) != 2 {
+		t.Fatalf("Expected 2 links, got %q", links)
+	}
+	if !strings.HasPrefix(links[0], "vless://a9956e12-2365-4fcb-95f3-d7b1a5cea860@vpn.example.com:443?") ||
+		!strings.Contains(links[0], "path=%2Fws") || !strings.HasSuffix(links[0], "#vless-ws") {
+		t.Errorf("Unexpected vless link %q", links[0])
+	}
+	if !strings.HasPrefix(links[1], "trojan://secret@vpn.example.com:8443?") {
+		t.Errorf("Unexpected trojan link %q", links[1])
+	}
+}
+
+func TestRenderClash(t *testing.T) {
+	doc, err := Render(FormatClash, "VPN", testEndpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(doc.Body)
+	for _, want := range []string{
+		`  - name: "vless-ws"`,
+		`    type: vless`,
+		`    servername: "vpn.example.com"`,
+		`      path: "/ws"`,
+		`    type: trojan`,
+		`      - "trojan"`,
+		`  - "MATCH,VPN"`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("Clash profile misses %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "unsupported") {
+		t.Errorf("Clash profile contains unsupported endpoint:\n%s", body)
+	}
+}
+
+func TestRenderSingBox(t *testing.T) {
+	doc, err := Render(FormatSingBox, "VPN", testEndpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var profile struct {
+		Outbounds []struct {
+			Type      string   `json:"type"`
+			Tag       string   `json:"tag"`
+			Outbounds []string `json:"outbounds"`
+			Transport *struct {
+				Type string `json:"type"`
+				Path string `json:"path"`
+			} `json:"transport"`
+		} `json:"outbounds"`
+	}
+	if err := json.Unmarshal(doc.Body, &profile); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if len(profile.Outbounds) != 4 {
+		t.Fatalf("Expected selector, 2 proxies and direct, got %+v", profile.Outbounds)
+	}
+	selector := profile.Outbounds[0]
+	if selector.Type != "selector" || strings.Join(selector.Outbounds, ",") != "vless-ws,trojan,direct" {
+		t.Errorf("Unexpected selector %+v", selector)
+	}
+	vless := profile.Outbounds[1]
+	if vless.Type != "vless" || vless.Transport == nil || vless.Transport.Path != "/ws" {
+		t.Errorf("Unexpected vless outbound %+v", vless)
+	}
+}
+
+func TestRenderReality(t *testing.T) {
+	reality := []Endpoint{{
+		Remark:      "reality",
+		Protocol:    "vless",
+		Address:     "vpn.example.com",
+		Port:        443,
+		ID:          "a9956e12-2365-4fcb-95f3-d7b1a5cea860",
+		Flow:        "xtls-rprx-vision",
+		Security:    "reality",
+		SNI:         "www.microsoft.com",
+		Fingerprint: "chrome",
+		PublicKey:   "hSDwCYkwp1R0i33ctD73Wg2_Og0mOBr066SpjqqbTmo",
+		ShortID:     "6ba85179e30d4fc2",
+	}}
+
+	doc, err := Render(FormatPlain, "VPN", reality)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"security=reality", "pbk=hSDwCYkwp1R0i33ctD73Wg2_Og0mOBr066SpjqqbTmo",
+		"sid=6ba85179e30d4fc2", "sni=www.microsoft.com", "fp=chrome"} {
+		if !strings.Contains(string(doc.Body), want) {
+			t.Errorf("Link %q misses %s", doc.Body, want)
+		}
+	}
+
+	doc, err = Render(FormatClash, "VPN", reality)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`    reality-opts:`,
+		`      public-key: "hSDwCYkwp1R0i33ctD73Wg2_Og0mOBr066SpjqqbTmo"`,
+		`      short-id: "6ba85179e30d4fc2"`,
+	} {
+		if !strings.Contains(string(doc.Body), want+"\n") {
+			t.Errorf("Clash profile misses %q:\n%s", want, doc.Body)
+		}
+	}
+
+	doc, err = Render(FormatSingBox, "VPN", reality)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var profile struct {
+		Outbounds []struct {
+			TLS *singBoxTLS `json:"tls"`
+		} `json:"outbounds"`
+	}
+	if err := json.Unmarshal(doc.Body, &profile); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if tls := profile.Outbounds[1].TLS; tls == nil || tls.Reality == nil || tls.UTLS == nil ||
+		tls.Reality.PublicKey != reality[0].PublicKey || tls.Reality.ShortID != reality[0].ShortID {
+		t.Errorf("Unexpected sing-box TLS %+v", tls)
+	}
+}
+
+func TestUserinfo(t *testing.T) {
+	info := Userinfo{Download: 1024, Total: 10240, Expire: time.Unix(1700000000, 0)}
+	if got, want := info.String(), "upload=0; download=1024; total=10240; expire=1700000000"; got != want {
+		t.Errorf("Userinfo = %q, want %q", got, want)
+	}
+	if got := (Userinfo{}).String(); got != "upload=0; download=0; total=0; expire=0" {
+		t.Errorf("Empty Userinfo = %q", got)
+	}
+}
+
+func TestProfileTitle(t *testing.T) {
+	if got := ProfileTitle("VPNClient"); got != "VPNClient" {
+		t.Errorf("ASCII title changed: %q", got)
+	}
+	if got := ProfileTitle("Мой VPN"); got != "base64:"+base64.StdEncoding.EncodeToString([]byte("Мой VPN")) {
+		t.Errorf("Non-ASCII title not encoded: %q", got)
+	}
+}
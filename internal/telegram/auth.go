@@ -0,0 +1,153 @@
+package telegram
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidAuth is returned for data without a valid hash.
+	ErrInvalidAuth = errors.New("telegram: invalid auth data")
+	// ErrAuthExpired is returned for correctly signed data whose auth_date
+	// is too old.
+	ErrAuthExpired = errors.New("telegram: auth data expired")
+)
+
+// User is a Telegram account confirmed by the login widget or a Mini App.
+type User struct {
+	ID        int64     `json:"id"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	PhotoURL  string    `json:"photo_url,omitempty"`
+	AuthDate  time.Time `json:"auth_date"`
+}
+
+// dataCheckString joins every field except hash as sorted key=value lines.
+func dataCheckString(fields map[string]string) string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if key != "hash" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, key := range keys {
+		lines[i] = key + "=" + fields[key]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func sign(secret []byte, fields map[string]string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(dataCheckString(fields)))
+	return mac.Sum(nil)
+}
+
+// check compares the hash field with the signature and checks auth_date.
+func check(secret []byte, fields map[string]string, maxAge time.Duration, now time.Time) (time.Time, error) {
+	hash, err := hex.DecodeString(fields["hash"])
+	if err != nil || len(hash) == 0 || !hmac.Equal(hash, sign(secret, fields)) {
+		return time.Time{}, ErrInvalidAuth
+	}
+	seconds, err := strconv.ParseInt(fields["auth_date"], 10, 64)
+	if err != nil {
+		return time.Time{}, ErrInvalidAuth
+	}
+	authDate := time.Unix(seconds, 0)
+	// Небольшой допуск на расхождение часов с серверами Telegram
+	if now.Sub(authDate) > maxAge || authDate.Sub(now) > time.Minute {
+		return time.Time{}, ErrAuthExpired
+	}
+	return authDate, nil
+}
+
+// WidgetFields converts the JSON object the login widget returns, e.g.
+// {"id": 1, "first_name": "A", "auth_date": 1700000000, "hash": "..."},
+// into the string fields that are signed.
+func WidgetFields(data []byte) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber() // id и auth_date должны остаться в исходном виде
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAuth, err)
+	}
+	fields := make(map[string]string, len(raw))
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			fields[key] = v
+		case json.Number:
+			fields[key] = v.String()
+		default:
+			return nil, fmt.Errorf("%w: unexpected field %s", ErrInvalidAuth, key)
+		}
+	}
+	return fields, nil
+}
+
+// VerifyLoginWidget checks the fields the Telegram Login Widget passes to
+// its callback: the hash is HMAC-SHA256 keyed with SHA256(bot token).
+func VerifyLoginWidget(botToken string, fields map[string]string, maxAge time.Duration, now time.Time) (*User, error) {
+	secret := sha256.Sum256([]byte(botToken))
+	authDate, err := check(secret[:], fields, maxAge, now)
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.ParseInt(fields["id"], 10, 64)
+	if err != nil || id <= 0 {
+		return nil, ErrInvalidAuth
+	}
+	return &User{
+		ID:        id,
+		FirstName: fields["first_name"],
+		LastName:  fields["last_name"],
+		Username:  fields["username"],
+		PhotoURL:  fields["photo_url"],
+		AuthDate:  authDate,
+	}, nil
+}
+
+// VerifyInitData checks Telegram.WebApp.initData of a Mini App: the hash is
+// HMAC-SHA256 keyed with HMAC-SHA256("WebAppData", bot token).
+func VerifyInitData(botToken string, initData string, maxAge time.Duration, now time.Time) (*User, error) {
+	values, err := url.ParseQuery(initData)
+	if err != nil {
+		return nil, ErrInvalidAuth
+	}
+	fields := make(map[string]string, len(values))
+	for key, value := range values {
+		if len(value) != 1 {
+			return nil, ErrInvalidAuth
+		}
+		fields[key] = value[0]
+	}
+
+	mac := hmac.New(sha256.New, []byte("WebAppData"))
+	mac.Write([]byte(botToken))
+	authDate, err := check(mac.Sum(nil), fields, maxAge, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	if err := json.Unmarshal([]byte(fields["user"]), &user); err != nil {
+		return nil, fmt.Errorf("%w: no user", ErrInvalidAuth)
+	}
+	if user.ID <= 0 {
+		return nil, ErrInvalidAuth
+	}
+	user.AuthDate = authDate
+	return &user, nil
+}
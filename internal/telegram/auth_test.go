@@ -0,0 +1,88 @@
+package telegram
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const botToken = "123456:test-bot-token"
+
+func TestVerifyLoginWidget(t *testing.T) {
+	now := time.Now()
+	authDate := strconv.FormatInt(now.Add(-time.Minute).Unix(), 10)
+	fields, err := WidgetFields([]byte(`{"id": 987654321, "first_name": "Ivan", "username": "ivan", "auth_date": ` + authDate + `}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := sha256.Sum256([]byte(botToken))
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte("auth_date=" + authDate + "\nfirst_name=Ivan\nid=987654321\nusername=ivan"))
+	fields["hash"] = hex.EncodeToString(mac.Sum(nil))
+
+	user, err := VerifyLoginWidget(botToken, fields, time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 987654321 || user.Username != "ivan" || user.FirstName != "Ivan" {
+		t.Errorf("Unexpected user %+v", user)
+	}
+
+	if _, err := VerifyLoginWidget("other-token", fields, time.Hour, now); !errors.Is(err, ErrInvalidAuth) {
+		t.Errorf("Expected another bot's token to fail, got %v", err)
+	}
+	if _, err := VerifyLoginWidget(botToken, fields, time.Hour, now.Add(2*time.Hour)); !errors.Is(err, ErrAuthExpired) {
+		t.Errorf("Expected old data to expire, got %v", err)
+	}
+
+	forged := map[string]string{}
+	for key, value := range fields {
+		forged[key] = value
+	}
+	forged["id"] = "1"
+	if _, err := VerifyLoginWidget(botToken, forged, time.Hour, now); !errors.Is(err, ErrInvalidAuth) {
+		t.Errorf("Expected a changed id to fail, got %v", err)
+	}
+	delete(forged, "hash")
+	if _, err := VerifyLoginWidget(botToken, forged, time.Hour, now); !errors.Is(err, ErrInvalidAuth) {
+		t.Errorf("Expected data without a hash to fail, got %v", err)
+	}
+}
+
+func TestVerifyInitData(t *testing.T) {
+	now := time.Now()
+	authDate := strconv.FormatInt(now.Unix(), 10)
+	userJSON := `{"id":42,"first_name":"Anna","username":"anna"}`
+	values := url.Values{
+		"auth_date": {authDate},
+		"query_id":  {"AAH"},
+		"user":      {userJSON},
+	}
+
+	key := hmac.New(sha256.New, []byte("WebAppData"))
+	key.Write([]byte(botToken))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte("auth_date=" + authDate + "\nquery_id=AAH\nuser=" + userJSON))
+	values.Set("hash", hex.EncodeToString(mac.Sum(nil)))
+
+	user, err := VerifyInitData(botToken, values.Encode(), time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 42 || user.Username != "anna" {
+		t.Errorf("Unexpected user %+v", user)
+	}
+
+	// Виджетная схема подписи для Mini App не подходит
+	widgetSecret := sha256.Sum256([]byte(botToken))
+	fields := map[string]string{"auth_date": authDate, "query_id": "AAH", "user": userJSON}
+	values.Set("hash", hex.EncodeToString(sign(widgetSecret[:], fields)))
+	if _, err := VerifyInitData(botToken, values.Encode(), time.Hour, now); !errors.Is(err, ErrInvalidAuth) {
+		t.Errorf("Expected a widget signature to fail, got %v", err)
+	}
+}
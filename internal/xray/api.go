@@ -0,0 +1,118 @@
+package xray
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const handlerServiceName = "xray.app.proxyman.command.HandlerService"
+
+// APIClient talks to the gRPC API of a running Xray instance (the "api"
+// dokodemo-door inbound).
+type APIClient struct {
+	conn    *grpc.ClientConn
+	Timeout time.Duration
+}
+
+// NewAPIClient prepares a client for addr. The connection is established
+// lazily, so this does not fail when Xray is down.
+func NewAPIClient(addr string, timeout time.Duration) (*APIClient, error) {
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create xray api client: %w", err)
+	}
+	return &APIClient{conn: conn, Timeout: timeout}, nil
+}
+
+func (c *APIClient) Close() error {
+	return c.conn.Close()
+}
+
+// call invokes method with the client timeout applied.
+func (c *APIClient) call(ctx context.Context, method string, req, resp message) error {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	return c.conn.Invoke(ctx, method, req, resp)
+}
+
+// AddUser adds a user to the inbound with the given tag without a restart.
+// A user that is already there yields ErrClientExists.
+func (c *APIClient) AddUser(ctx context.Context, inboundTag string, user User) error {
+	op, err := addUserOperation(user)
+	if err != nil {
+		return err
+	}
+	req := &alterInboundRequest{Tag: inboundTag, Operation: op}
+	return apiError(c.call(ctx, "/"+handlerServiceName+"/AlterInbound", req, &emptyMessage{}))
+}
+
+// RemoveUser removes the user with the given email from the inbound. A user
+// that is not there yields ErrClientNotFound.
+func (c *APIClient) RemoveUser(ctx context.Context, inboundTag, email string) error {
+	req := &alterInboundRequest{Tag: inboundTag, Operation: removeUserOperation(email)}
+	return apiError(c.call(ctx, "/"+handlerServiceName+"/AlterInbound", req, &emptyMessage{}))
+}
+
+// apiError maps the plain-text errors Xray returns onto the package errors.
+func apiError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := strings.ToLower(status.Convert(err).Message())
+	switch {
+	case strings.Contains(msg, "already exists"):
+		return fmt.Errorf("%w: %v", ErrClientExists, err)
+	case strings.Contains(msg, "not found"):
+		return fmt.Errorf("%w: %v", ErrClientNotFound, err)
+	}
+	return fmt.Errorf("xray api: %w", err)
+}
+
+// HandlerServer is the server side of HandlerService.AlterInbound. It lets
+// tests and the node agent serve the same API the backend calls.
+type HandlerServer interface {
+	AlterInbound(ctx context.Context, tag string, op InboundOperation) error
+}
+
+// NewServer returns a gRPC server that understands the Xray API messages.
+func NewServer(opts ...grpc.ServerOption) *grpc.Server {
+	return grpc.NewServer(append(opts, grpc.ForceServerCodec(codec{}))...)
+}
+
+// RegisterHandlerServer exposes h as HandlerService on s.
+func RegisterHandlerServer(s *grpc.Server, h HandlerServer) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: handlerServiceName,
+		HandlerType: (*HandlerServer)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "AlterInbound",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var req alterInboundRequest
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				op, err := decodeOperation(req.Operation)
+				if err != nil {
+					return nil, status.Error(codes.InvalidArgument, err.Error())
+				}
+				if err := srv.(HandlerServer).AlterInbound(ctx, req.Tag, op); err != nil {
+					return nil, status.Error(codes.Unknown, err.Error())
+				}
+				return &emptyMessage{}, nil
+			},
+		}},
+	}, h)
+}
@@ -0,0 +1,141 @@
+package xray_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"vpn-backend/internal/xray"
+	"vpn-backend/internal/xray/xraytest"
+)
+
+func TestAPIClientAlterInbound(t *testing.T) {
+	server := xraytest.NewServer("vless-ws")
+	defer server.Close()
+
+	client, err := xray.NewAPIClient(server.Addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	user := xray.User{Email: "a@example.com", Level: 1, Protocol: "vless", ID: "uuid-a", Flow: "xtls-rprx-vision"}
+	if err := client.AddUser(ctx, "vless-ws", user); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	if err := client.AddUser(ctx, "vless-ws", user); !errors.Is(err, xray.ErrClientExists) {
+		t.Fatalf("Expected ErrClientExists, got %v", err)
+	}
+
+	users := server.Users("vless-ws")
+	if len(users) != 1 || users[0] != user {
+		t.Fatalf("Server did not receive the user intact: %+v", users)
+	}
+
+	if err := client.RemoveUser(ctx, "vless-ws", user.Email); err != nil {
+		t.Fatalf("RemoveUser failed: %v", err)
+	}
+	if err := client.RemoveUser(ctx, "vless-ws", user.Email); !errors.Is(err, xray.ErrClientNotFound) {
+		t.Fatalf("Expected ErrClientNotFound, got %v", err)
+	}
+
+	socks := xray.User{Email: "b@example.com", Protocol: "socks"}
+	if err := client.AddUser(ctx, "vless-ws", socks); err == nil {
+		t.Fatal("Expected unsupported protocol to be rejected")
+	}
+}
+
+func TestAPIClientShadowsocks(t *testing.T) {
+	server := xraytest.NewServer("ss", "ss2022")
+	defer server.Close()
+
+	client, err := xray.NewAPIClient(server.Addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	config, err := xray.ParseConfig([]byte(`{
+		"inbounds": [
+			{"tag": "ss", "port": 10000, "protocol": "shadowsocks",
+			 "settings": {"method": "chacha20-ietf-poly1305", "clients": []}},
+			{"tag": "ss2022", "port": 10001, "protocol": "shadowsocks",
+			 "settings": {"method": "2022-blake3-aes-128-gcm", "password": "c2VydmVyLWtleS0xMjM0NQ==", "clients": []}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range config.Inbounds {
+		inbound := &config.Inbounds[i]
+		user := xray.NewUser(inbound, inbound.NewClient("uuid-a", "a@example.com", 2))
+		if err := client.AddUser(ctx, inbound.Tag, user); err != nil {
+			t.Fatalf("AddUser to %s failed: %v", inbound.Tag, err)
+		}
+	}
+
+	if users := server.Users("ss"); len(users) != 1 || users[0].Password != "uuid-a" ||
+		users[0].Method != "chacha20-poly1305" || users[0].Level != 2 {
+		t.Errorf("Unexpected shadowsocks user %+v", users)
+	}
+	want := config.Inbounds[1].ClientPassword("uuid-a")
+	if users := server.Users("ss2022"); len(users) != 1 || users[0].Protocol != "shadowsocks" || users[0].Password != want {
+		t.Errorf("Unexpected shadowsocks 2022 user %+v, want key %s", users, want)
+	}
+
+	unknown := xray.User{Email: "b@example.com", Protocol: "shadowsocks", Password: "x", Method: "rc4-md5"}
+	if err := client.AddUser(ctx, "ss", unknown); err == nil {
+		t.Error("Expected an unsupported cipher to be rejected")
+	}
+}
+
+func TestAPIClientStats(t *testing.T) {
+	server := xraytest.NewServer()
+	defer server.Close()
+
+	client, err := xray.NewAPIClient(server.Addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	const big = int64(6) << 30 // больше 4 ГБ
+	server.AddTraffic("a@example.com", big, 42)
+	server.AddTraffic("b@example.com", 1, 2)
+
+	traffic, err := client.UserTraffic(ctx, "a@example.com", false)
+	if err != nil {
+		t.Fatalf("UserTraffic failed: %v", err)
+	}
+	if traffic.Uplink != big || traffic.Downlink != 42 {
+		t.Fatalf("Unexpected traffic: %+v", traffic)
+	}
+
+	traffic, err = client.UserTraffic(ctx, "nobody@example.com", false)
+	if err != nil || traffic.Total() != 0 {
+		t.Fatalf("Expected zero traffic for unknown user, got %+v, %v", traffic, err)
+	}
+	if _, err := client.GetStats(ctx, "user>>>nobody@example.com>>>traffic>>>uplink", false); !errors.Is(err, xray.ErrStatNotFound) {
+		t.Fatalf("Expected ErrStatNotFound, got %v", err)
+	}
+
+	stats, err := client.QueryStats(ctx, xray.StatsQuery{Patterns: []string{"user>>>"}, Reset: true})
+	if err != nil {
+		t.Fatalf("QueryStats failed: %v", err)
+	}
+	if len(stats) != 4 {
+		t.Fatalf("Expected 4 user counters, got %+v", stats)
+	}
+
+	stats, err = client.QueryStats(ctx, xray.StatsQuery{Patterns: []string{`^user>>>a@.*>>>uplink$`}, Regexp: true})
+	if err != nil {
+		t.Fatalf("QueryStats failed: %v", err)
+	}
+	if len(stats) != 1 || stats[0].Value != 0 {
+		t.Fatalf("Expected uplink to be reset, got %+v", stats)
+	}
+}
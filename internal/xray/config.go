@@ -0,0 +1,341 @@
+// Package xray contains the typed model of the Xray configuration file and
+// helpers for talking to a running Xray instance.
+package xray
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	ErrInboundNotFound = errors.New("xray: inbound not found")
+	ErrNoClientInbound = errors.New("xray: config has no inbound that accepts clients")
+	ErrClientExists    = errors.New("xray: client already exists")
+	ErrClientNotFound  = errors.New("xray: client not found")
+)
+
+// clientProtocols are the inbound protocols that carry a clients list.
+var clientProtocols = map[string]bool{
+	"vless":       true,
+	"vmess":       true,
+	"trojan":      true,
+	"shadowsocks": true,
+}
+
+// passwordProtocols authenticate clients by password rather than by id.
+var passwordProtocols = map[string]bool{
+	"trojan":      true,
+	"shadowsocks": true,
+}
+
+// Config is the subset of the Xray configuration the backend edits. Sections
+// and fields it does not model are kept in Extra and written back unchanged.
+type Config struct {
+	API       *APIConfig `json:"api,omitempty"`
+	Inbounds  []Inbound  `json:"inbounds,omitempty"`
+	Outbounds []Outbound `json:"outbounds,omitempty"`
+	Routing   *Routing   `json:"routing,omitempty"`
+	Policy    *Policy    `json:"policy,omitempty"`
+	Stats     *Stats     `json:"stats,omitempty"`
+	Extra     Extra      `json:"-"`
+}
+
+type APIConfig struct {
+	Tag      string   `json:"tag,omitempty"`
+	Services []string `json:"services,omitempty"`
+	Extra    Extra    `json:"-"`
+}
+
+type Inbound struct {
+	Tag            string           `json:"tag,omitempty"`
+	Listen         string           `json:"listen,omitempty"`
+	Port           Port             `json:"port,omitempty"`
+	Protocol       string           `json:"protocol,omitempty"`
+	Settings       *InboundSettings `json:"settings,omitempty"`
+	StreamSettings *StreamSettings  `json:"streamSettings,omitempty"`
+	Extra          Extra            `json:"-"`
+}
+
+type InboundSettings struct {
+	Clients    []Client `json:"clients"`
+	Decryption string   `json:"decryption,omitempty"`
+	Extra      Extra    `json:"-"`
+}
+
+type Client struct {
+	ID       string `json:"id,omitempty"`
+	Password string `json:"password,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Level    int    `json:"level"`
+	Flow     string `json:"flow,omitempty"`
+	Extra    Extra  `json:"-"`
+}
+
+type StreamSettings struct {
+	Network         string           `json:"network,omitempty"`
+	Security        string           `json:"security,omitempty"`
+	TLSSettings     *TLSSettings     `json:"tlsSettings,omitempty"`
+	RealitySettings *RealitySettings `json:"realitySettings,omitempty"`
+	WSSettings      *WSSettings      `json:"wsSettings,omitempty"`
+	GRPCSettings    *GRPCSettings    `json:"grpcSettings,omitempty"`
+	Extra           Extra            `json:"-"`
+}
+
+type TLSSettings struct {
+	ServerName  string   `json:"serverName,omitempty"`
+	ALPN        []string `json:"alpn,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Extra       Extra    `json:"-"`
+}
+
+// RealitySettings is the server side of REALITY. Clients need the public
+// key of PrivateKey, one of ServerNames as SNI and one of ShortIDs.
+type RealitySettings struct {
+	ServerNames []string `json:"serverNames,omitempty"`
+	PrivateKey  string   `json:"privateKey,omitempty"`
+	ShortIDs    []string `json:"shortIds,omitempty"`
+	Extra       Extra    `json:"-"`
+}
+
+// PublicKey derives the X25519 public key clients pin from the private key,
+// in the same base64url form `xray x25519` prints.
+func (r *RealitySettings) PublicKey() (string, error) {
+	seed, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.PrivateKey, "="))
+	if err != nil {
+		return "", fmt.Errorf("invalid reality private key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(seed)
+	if err != nil {
+		return "", fmt.Errorf("invalid reality private key: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+type WSSettings struct {
+	Path    string            `json:"path,omitempty"`
+	Host    string            `json:"host,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Extra   Extra             `json:"-"`
+}
+
+type GRPCSettings struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	Extra       Extra  `json:"-"`
+}
+
+type Outbound struct {
+	Tag      string `json:"tag,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Extra    Extra  `json:"-"`
+}
+
+type Routing struct {
+	DomainStrategy string        `json:"domainStrategy,omitempty"`
+	Rules          []RoutingRule `json:"rules,omitempty"`
+	Extra          Extra         `json:"-"`
+}
+
+type RoutingRule struct {
+	Type        string   `json:"type,omitempty"`
+	InboundTag  []string `json:"inboundTag,omitempty"`
+	OutboundTag string   `json:"outboundTag,omitempty"`
+	Extra       Extra    `json:"-"`
+}
+
+type Policy struct {
+	Levels map[string]PolicyLevel `json:"levels,omitempty"`
+	System *SystemPolicy          `json:"system,omitempty"`
+	Extra  Extra                  `json:"-"`
+}
+
+// PolicyLevel uses pointers for the timeouts so that an explicit 0 is kept
+// apart from "not set, use the Xray default".
+type PolicyLevel struct {
+	Handshake         *int  `json:"handshake,omitempty"`
+	ConnIdle          *int  `json:"connIdle,omitempty"`
+	UplinkOnly        *int  `json:"uplinkOnly,omitempty"`
+	DownlinkOnly      *int  `json:"downlinkOnly,omitempty"`
+	BufferSize        *int  `json:"bufferSize,omitempty"`
+	StatsUserUplink   bool  `json:"statsUserUplink,omitempty"`
+	StatsUserDownlink bool  `json:"statsUserDownlink,omitempty"`
+	Extra             Extra `json:"-"`
+}
+
+type SystemPolicy struct {
+	StatsInboundUplink    bool  `json:"statsInboundUplink,omitempty"`
+	StatsInboundDownlink  bool  `json:"statsInboundDownlink,omitempty"`
+	StatsOutboundUplink   bool  `json:"statsOutboundUplink,omitempty"`
+	StatsOutboundDownlink bool  `json:"statsOutboundDownlink,omitempty"`
+	Extra                 Extra `json:"-"`
+}
+
+type Stats struct {
+	Extra Extra `json:"-"`
+}
+
+// LoadConfig reads and parses the config file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig parses a JSON encoded Xray config.
+func ParseConfig(data []byte) (*Config, error) {
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse xray config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// Marshal encodes the config in the indented form Xray config files use.
+func (c *Config) Marshal() ([]byte, error) {
+	return json.MarshalIndent(c, "", "  ")
+}
+
+// Inbound returns the inbound with the given tag.
+func (c *Config) Inbound(tag string) (*Inbound, error) {
+	for i := range c.Inbounds {
+		if c.Inbounds[i].Tag == tag {
+			return &c.Inbounds[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrInboundNotFound, tag)
+}
+
+// ClientInbounds returns every inbound whose protocol carries clients.
+func (c *Config) ClientInbounds() []*Inbound {
+	var result []*Inbound
+	for i := range c.Inbounds {
+		if c.Inbounds[i].AcceptsClients() {
+			result = append(result, &c.Inbounds[i])
+		}
+	}
+	return result
+}
+
+// PrimaryInbound returns the first inbound that accepts clients.
+func (c *Config) PrimaryInbound() (*Inbound, error) {
+	inbounds := c.ClientInbounds()
+	if len(inbounds) == 0 {
+		return nil, ErrNoClientInbound
+	}
+	return inbounds[0], nil
+}
+
+// AcceptsClients reports whether the inbound protocol has a clients list.
+func (in *Inbound) AcceptsClients() bool {
+	return clientProtocols[in.Protocol]
+}
+
+// NewClient builds the client entry of a user. Trojan and shadowsocks
+// clients also get a password derived from the user's UUID, since those
+// protocols ignore the id.
+func (in *Inbound) NewClient(uuid, email string, level int) Client {
+	client := Client{ID: uuid, Email: email, Level: level}
+	if passwordProtocols[in.Protocol] {
+		client.Password = in.ClientPassword(uuid)
+	}
+	return client
+}
+
+// ClientPassword returns the password a user gets in a password-based
+// inbound. Shadowsocks 2022 ciphers need a base64 key of the cipher's key
+// size, so the UUID is hashed into one.
+func (in *Inbound) ClientPassword(uuid string) string {
+	method := in.Method()
+	if !strings.HasPrefix(method, "2022-") {
+		return uuid
+	}
+	key := sha256.Sum256([]byte(uuid))
+	size := 32
+	if method == "2022-blake3-aes-128-gcm" {
+		size = 16
+	}
+	return base64.StdEncoding.EncodeToString(key[:size])
+}
+
+// Method returns the shadowsocks cipher set for the whole inbound.
+func (in *Inbound) Method() string {
+	var method string
+	if in.Settings != nil {
+		if raw, ok := in.Settings.Extra["method"]; ok {
+			_ = json.Unmarshal(raw, &method)
+		}
+	}
+	return method
+}
+
+// Client returns the client with the given id, or nil.
+func (in *Inbound) Client(id string) *Client {
+	if in.Settings == nil {
+		return nil
+	}
+	for i := range in.Settings.Clients {
+		if in.Settings.Clients[i].ID == id {
+			return &in.Settings.Clients[i]
+		}
+	}
+	return nil
+}
+
+// Clients returns the inbound's clients. An inbound without a settings
+// block has none.
+func (in *Inbound) Clients() []Client {
+	if in.Settings == nil {
+		return nil
+	}
+	return in.Settings.Clients
+}
+
+// ClearClients empties the clients list, adding a settings block if the
+// inbound has none.
+func (in *Inbound) ClearClients() {
+	if in.Settings == nil {
+		in.Settings = &InboundSettings{}
+	}
+	in.Settings.Clients = []Client{}
+}
+
+// AddClient appends a client, refusing duplicates by id.
+func (in *Inbound) AddClient(client Client) error {
+	if !in.AcceptsClients() {
+		return fmt.Errorf("inbound %q (%s) does not accept clients", in.Tag, in.Protocol)
+	}
+	if in.Client(client.ID) != nil {
+		return fmt.Errorf("%w: %s in inbound %q", ErrClientExists, client.ID, in.Tag)
+	}
+	if in.Settings == nil {
+		in.Settings = &InboundSettings{}
+	}
+	in.Settings.Clients = append(in.Settings.Clients, client)
+	return nil
+}
+
+// RemoveClient drops the client with the given id and reports whether it
+// was present.
+func (in *Inbound) RemoveClient(id string) bool {
+	if in.Settings == nil {
+		return false
+	}
+	clients := in.Settings.Clients[:0]
+	removed := false
+	for _, client := range in.Settings.Clients {
+		if client.ID == id {
+			removed = true
+			continue
+		}
+		clients = append(clients, client)
+	}
+	in.Settings.Clients = clients
+	return removed
+}
@@ -0,0 +1,206 @@
+package xray
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestConfigRoundTripKeepsUnknownFields(t *testing.T) {
+	original, err := os.ReadFile("testdata/config.json")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+
+	cfg, err := ParseConfig(original)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	encoded, err := cfg.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+
+	var want, got interface{}
+	if err := json.Unmarshal(original, &want); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Round trip changed the config:\n%s", encoded)
+	}
+}
+
+func TestClientMutationsSkipNonClientInbounds(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"inbounds": [
+			{"type": "tun", "tag": "tun-in"},
+			{"tag": "api", "protocol": "dokodemo-door", "settings": {"address": "127.0.0.1"}},
+			{"tag": "vless-in", "port": 443, "protocol": "vless", "settings": {"clients": []}}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	inbound, err := cfg.PrimaryInbound()
+	if err != nil {
+		t.Fatalf("Expected a client inbound: %v", err)
+	}
+	if inbound.Tag != "vless-in" {
+		t.Fatalf("Expected vless-in, got %q", inbound.Tag)
+	}
+
+	if err := inbound.AddClient(Client{ID: "u1", Email: "a@example.com"}); err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+	if err := inbound.AddClient(Client{ID: "u1"}); !errors.Is(err, ErrClientExists) {
+		t.Fatalf("Expected ErrClientExists, got %v", err)
+	}
+
+	api, err := cfg.Inbound("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddClient(Client{ID: "u2"}); err == nil {
+		t.Fatal("Expected dokodemo-door inbound to refuse clients")
+	}
+
+	if !inbound.RemoveClient("u1") {
+		t.Fatal("Expected client to be removed")
+	}
+	if inbound.RemoveClient("u1") {
+		t.Fatal("Expected second remove to report nothing removed")
+	}
+
+	if _, err := cfg.Inbound("missing"); !errors.Is(err, ErrInboundNotFound) {
+		t.Fatalf("Expected ErrInboundNotFound, got %v", err)
+	}
+}
+
+func TestNewClientSetsPasswords(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"inbounds": [
+			{"tag": "vless", "protocol": "vless", "settings": {"clients": []}},
+			{"tag": "trojan", "protocol": "trojan", "settings": {"clients": []}},
+			{"tag": "ss", "protocol": "shadowsocks", "settings": {"clients": [], "method": "aes-256-gcm"}},
+			{"tag": "ss2022", "protocol": "shadowsocks", "settings": {"clients": [], "method": "2022-blake3-aes-128-gcm"}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const uuid = "5f8a1c0e-3b7d-4e2a-9c6f-1d2e3f4a5b6c"
+	for _, test := range []struct {
+		tag     string
+		keySize int // 0 — пароль совпадает с UUID
+		none    bool
+	}{
+		{tag: "vless", none: true},
+		{tag: "trojan"},
+		{tag: "ss"},
+		{tag: "ss2022", keySize: 16},
+	} {
+		inbound, err := cfg.Inbound(test.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := inbound.NewClient(uuid, "a@example.com", 1)
+		if client.ID != uuid || client.Level != 1 {
+			t.Errorf("%s: unexpected client %+v", test.tag, client)
+		}
+		switch {
+		case test.none:
+			if client.Password != "" {
+				t.Errorf("%s: expected no password, got %q", test.tag, client.Password)
+			}
+		case test.keySize == 0:
+			if client.Password != uuid {
+				t.Errorf("%s: expected the UUID as password, got %q", test.tag, client.Password)
+			}
+		default:
+			key, err := base64.StdEncoding.DecodeString(client.Password)
+			if err != nil || len(key) != test.keySize {
+				t.Errorf("%s: expected a %d-byte base64 key, got %q", test.tag, test.keySize, client.Password)
+			}
+		}
+	}
+}
+
+func TestPortForms(t *testing.T) {
+	original := `{"inbounds":[` +
+		`{"tag":"number","port":443,"protocol":"vless","settings":{"clients":[]}},` +
+		`{"tag":"string","port":"8443","protocol":"vless","settings":{"clients":[]}},` +
+		`{"tag":"range","port":"10000-10010","protocol":"vless","settings":{"clients":[]}},` +
+		`{"tag":"list","port":"80, 2000-2002","protocol":"vless","settings":{"clients":[]}},` +
+		`{"tag":"env","port":"env:PORT","protocol":"vless","settings":{"clients":[]}},` +
+		`{"tag":"none","protocol":"vless","settings":{"clients":[]}}` +
+		`]}`
+	cfg, err := ParseConfig([]byte(original))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("Expected every port form to be valid, got %v", err)
+	}
+	encoded, err := cfg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got interface{}
+	if err := json.Unmarshal([]byte(original), &want); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Round trip changed the ports:\n%s", encoded)
+	}
+
+	for tag, first := range map[string]int{"number": 443, "string": 8443, "range": 10000, "list": 80, "env": 0, "none": 0} {
+		inbound, err := cfg.Inbound(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := inbound.Port.First(); got != first {
+			t.Errorf("%s: expected first port %d, got %d", tag, first, got)
+		}
+	}
+
+	for _, bad := range []string{`"10010-10000"`, `"abc"`, `70000`} {
+		port := Port(bad)
+		if _, err := port.Ranges(); err == nil {
+			t.Errorf("Expected %s to be invalid", bad)
+		}
+	}
+	if _, err := ParseConfig([]byte(`{"inbounds":[{"port":true}]}`)); err == nil {
+		t.Error("Expected a boolean port to be rejected")
+	}
+}
+
+func TestRealityPublicKey(t *testing.T) {
+	// Пара ключей из RFC 7748, 6.1
+	private, _ := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	public, _ := hex.DecodeString("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+
+	reality := &RealitySettings{PrivateKey: base64.RawURLEncoding.EncodeToString(private)}
+	key, err := reality.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := base64.RawURLEncoding.EncodeToString(public); key != want {
+		t.Errorf("PublicKey() = %s, want %s", key, want)
+	}
+
+	if _, err := (&RealitySettings{}).PublicKey(); err == nil {
+		t.Error("Expected an error without a private key")
+	}
+}
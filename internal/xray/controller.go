@@ -0,0 +1,261 @@
+package xray
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Способы управления процессом Xray
+const (
+	ControllerSystemd = "systemd"
+	ControllerDocker  = "docker"
+	ControllerProcess = "process"
+	ControllerSignal  = "signal"
+)
+
+// ProcessStatus describes the running Xray.
+type ProcessStatus struct {
+	Controller string     `json:"controller"`
+	Running    bool       `json:"running"`
+	PID        int        `json:"pid,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	// Uptime is in seconds, 0 when unknown.
+	Uptime int64  `json:"uptime"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (s *ProcessStatus) setStarted(startedAt time.Time) {
+	if startedAt.IsZero() {
+		return
+	}
+	s.StartedAt = &startedAt
+	s.Uptime = int64(time.Since(startedAt).Seconds())
+}
+
+// Controller restarts Xray so that it loads the config file, and reports
+// whether it runs.
+type Controller interface {
+	Restart(ctx context.Context) error
+	Status(ctx context.Context) (ProcessStatus, error)
+}
+
+// Starter is implemented by controllers that run Xray themselves and need
+// to be started with the backend.
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// ControllerConfig selects and configures a controller.
+type ControllerConfig struct {
+	Kind string
+	// systemd
+	Unit string
+	// docker
+	Container string
+	// process
+	Binary     string
+	ConfigPath string
+	// signal
+	PIDFile string
+	Signal  string
+}
+
+// NewController returns the controller named by cfg.Kind.
+func NewController(cfg ControllerConfig) (Controller, error) {
+	switch cfg.Kind {
+	case ControllerSystemd, "":
+		return NewSystemdController(cfg.Unit), nil
+	case ControllerDocker:
+		return NewDockerController(cfg.Container), nil
+	case ControllerProcess:
+		return NewProcessController(cfg.Binary, cfg.ConfigPath), nil
+	case ControllerSignal:
+		sig, err := ParseSignal(cfg.Signal)
+		if err != nil {
+			return nil, err
+		}
+		return NewSignalController(cfg.PIDFile, sig), nil
+	default:
+		return nil, fmt.Errorf("unknown xray controller %q", cfg.Kind)
+	}
+}
+
+// runCommand runs a command and returns its combined output.
+type runCommand func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+func execCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// SystemdController manages Xray as a systemd unit.
+type SystemdController struct {
+	Unit string
+	run  runCommand
+}
+
+func NewSystemdController(unit string) *SystemdController {
+	if unit == "" {
+		unit = "xray"
+	}
+	return &SystemdController{Unit: unit, run: execCommand}
+}
+
+func (c *SystemdController) Restart(ctx context.Context) error {
+	_, err := c.run(ctx, "systemctl", "restart", c.Unit)
+	return err
+}
+
+func (c *SystemdController) Status(ctx context.Context) (ProcessStatus, error) {
+	status := ProcessStatus{Controller: ControllerSystemd}
+	output, err := c.run(ctx, "systemctl", "show", c.Unit, "--timestamp=unix",
+		"--property=ActiveState,SubState,MainPID,ActiveEnterTimestamp")
+	if err != nil {
+		return status, err
+	}
+
+	properties := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			properties[key] = value
+		}
+	}
+	status.Running = properties["ActiveState"] == "active"
+	status.Detail = properties["ActiveState"] + "/" + properties["SubState"]
+	status.PID, _ = strconv.Atoi(properties["MainPID"])
+	if status.Running {
+		// --timestamp=unix выводит время как @1700000000
+		if seconds, err := strconv.ParseInt(strings.TrimPrefix(properties["ActiveEnterTimestamp"], "@"), 10, 64); err == nil {
+			status.setStarted(time.Unix(seconds, 0))
+		}
+	}
+	return status, nil
+}
+
+// DockerController manages Xray running in a Docker container.
+type DockerController struct {
+	Container string
+	run       runCommand
+}
+
+func NewDockerController(container string) *DockerController {
+	if container == "" {
+		container = "xray"
+	}
+	return &DockerController{Container: container, run: execCommand}
+}
+
+func (c *DockerController) Restart(ctx context.Context) error {
+	_, err := c.run(ctx, "docker", "restart", c.Container)
+	return err
+}
+
+func (c *DockerController) Status(ctx context.Context) (ProcessStatus, error) {
+	status := ProcessStatus{Controller: ControllerDocker}
+	output, err := c.run(ctx, "docker", "inspect", "--format",
+		"{{.State.Status}} {{.State.Pid}} {{.State.StartedAt}}", c.Container)
+	if err != nil {
+		return status, err
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) != 3 {
+		return status, fmt.Errorf("unexpected docker inspect output %q", strings.TrimSpace(string(output)))
+	}
+	status.Detail = fields[0]
+	status.Running = fields[0] == "running"
+	status.PID, _ = strconv.Atoi(fields[1])
+	if status.Running {
+		if startedAt, err := time.Parse(time.RFC3339Nano, fields[2]); err == nil {
+			status.setStarted(startedAt)
+		}
+	}
+	return status, nil
+}
+
+// SignalController sends a signal to the PID in PIDFile. Xray itself does
+// not reload its config on any signal, so PIDFile must belong to a
+// supervisor that restarts Xray when it gets Signal; pointing it at Xray
+// would only stop it, or with SIGHUP do nothing at all.
+type SignalController struct {
+	PIDFile string
+	Signal  syscall.Signal
+}
+
+func NewSignalController(pidFile string, sig syscall.Signal) *SignalController {
+	return &SignalController{PIDFile: pidFile, Signal: sig}
+}
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// ParseSignal accepts names like "HUP" or "SIGHUP". There is no default:
+// the signal depends on the supervisor (see SignalController).
+func ParseSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return 0, fmt.Errorf("the signal controller needs the signal its supervisor restarts Xray on")
+	}
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+func (c *SignalController) process() (*os.Process, error) {
+	data, err := os.ReadFile(c.PIDFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pid file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return nil, fmt.Errorf("invalid pid in %s", c.PIDFile)
+	}
+	return os.FindProcess(pid)
+}
+
+func (c *SignalController) Restart(ctx context.Context) error {
+	process, err := c.process()
+	if err != nil {
+		return err
+	}
+	if err := process.Signal(c.Signal); err != nil {
+		return fmt.Errorf("failed to signal xray (pid %d): %w", process.Pid, err)
+	}
+	return nil
+}
+
+func (c *SignalController) Status(ctx context.Context) (ProcessStatus, error) {
+	status := ProcessStatus{Controller: ControllerSignal}
+	process, err := c.process()
+	if err != nil {
+		status.Detail = err.Error()
+		return status, nil
+	}
+	status.PID = process.Pid
+	// Сигнал 0 только проверяет, что процесс существует
+	if err := process.Signal(syscall.Signal(0)); err != nil {
+		status.Detail = err.Error()
+		return status, nil
+	}
+	status.Running = true
+	// Время создания каталога в /proc — приблизительное время запуска (только Linux)
+	if info, err := os.Stat(fmt.Sprintf("/proc/%d", process.Pid)); err == nil {
+		status.setStarted(info.ModTime())
+	}
+	return status, nil
+}
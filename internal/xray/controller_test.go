@@ -0,0 +1,210 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRun records the command and answers with output.
+func fakeRun(output string, calls *[]string) runCommand {
+	return func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		*calls = append(*calls, name+" "+strings.Join(args, " "))
+		return []byte(output), nil
+	}
+}
+
+func TestSystemdControllerStatus(t *testing.T) {
+	var calls []string
+	controller := NewSystemdController("xray")
+	controller.run = fakeRun("ActiveState=active\nSubState=running\nMainPID=4242\nActiveEnterTimestamp=@1700000000\n", &calls)
+
+	status, err := controller.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Running || status.PID != 4242 || status.StartedAt == nil || status.StartedAt.Unix() != 1700000000 || status.Uptime <= 0 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+
+	if err := controller.Restart(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls[1] != "systemctl restart xray" {
+		t.Errorf("Unexpected restart command %q", calls[1])
+	}
+}
+
+func TestDockerControllerStatus(t *testing.T) {
+	var calls []string
+	controller := NewDockerController("vpn-xray")
+	controller.run = fakeRun("running 31337 2024-01-02T03:04:05.123456789Z\n", &calls)
+
+	status, err := controller.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Running || status.PID != 31337 || status.StartedAt == nil || status.StartedAt.Year() != 2024 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+
+	controller.run = fakeRun("exited 0 2024-01-02T03:04:05Z\n", &calls)
+	if status, _ := controller.Status(context.Background()); status.Running || status.Detail != "exited" {
+		t.Fatalf("Expected a stopped container, got %+v", status)
+	}
+
+	if err := controller.Restart(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if last := calls[len(calls)-1]; last != "docker restart vpn-xray" {
+		t.Errorf("Unexpected restart command %q", last)
+	}
+}
+
+func TestNewControllerRejectsUnknownKind(t *testing.T) {
+	if _, err := NewController(ControllerConfig{Kind: "launchd"}); err == nil {
+		t.Error("Expected an unknown controller to be rejected")
+	}
+	if _, err := NewController(ControllerConfig{Kind: ControllerSignal, Signal: "BOGUS"}); err == nil {
+		t.Error("Expected an unknown signal to be rejected")
+	}
+	// Xray не перечитывает конфиг по сигналу, поэтому сигнал по умолчанию нет
+	if _, err := NewController(ControllerConfig{Kind: ControllerSignal}); err == nil {
+		t.Error("Expected the signal controller to require a signal")
+	}
+	if controller, err := NewController(ControllerConfig{}); err != nil || controller.(*SystemdController).Unit != "xray" {
+		t.Errorf("Expected systemd by default, got %v, %v", controller, err)
+	}
+}
+
+func TestProcessControllerSupervisesXray(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake xray binary is a shell script")
+	}
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "xray")
+	// Фальшивый Xray работает, пока существует файл alive
+	script := "#!/bin/sh\nwhile [ -f " + filepath.Join(dir, "alive") + " ]; do sleep 0.05; done\nexit 1\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "alive"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	controller := NewProcessController(binary, filepath.Join(dir, "config.json"))
+	controller.RestartDelay = 10 * time.Millisecond
+	if err := controller.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Stop()
+
+	status, err := controller.Status(ctx)
+	if err != nil || !status.Running || status.PID == 0 {
+		t.Fatalf("Expected a running Xray, got %+v, %v", status, err)
+	}
+	firstPID := status.PID
+
+	if err := controller.Restart(ctx); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = controller.Status(ctx)
+	if !status.Running || status.PID == firstPID {
+		t.Fatalf("Expected a new process after restart, got %+v", status)
+	}
+	restartedPID := status.PID
+
+	// Падение процесса: контроллер запускает его снова
+	if err := os.Remove(filepath.Join(dir, "alive")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, _ = controller.Status(ctx)
+		if !status.Running && strings.HasPrefix(status.Detail, "exited") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the crash to be noticed, got %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "alive"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		status, _ = controller.Status(ctx)
+		if status.Running && status.PID != restartedPID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected Xray to be started again after the crash, got %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProcessControllerRestartRespectsContext(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake xray binary is a shell script")
+	}
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "xray")
+	// Фальшивый Xray, который не выходит по SIGTERM
+	ready := filepath.Join(dir, "ready")
+	script := "#!/bin/sh\ntrap '' TERM\ntouch " + ready + "\nwhile true; do sleep 0.05; done\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	controller := NewProcessController(binary, filepath.Join(dir, "config.json"))
+	controller.StopTimeout = time.Minute
+	controller.RestartDelay = 10 * time.Millisecond
+	if err := controller.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Stop()
+	status, _ := controller.Status(ctx)
+	firstPID := status.PID
+	deadline := time.Now().Add(5 * time.Second)
+	for _, err := os.Stat(ready); err != nil; _, err = os.Stat(ready) {
+		if time.Now().After(deadline) {
+			t.Fatal("Fake Xray did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	restartCtx, cancelRestart := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelRestart()
+	start := time.Now()
+	if err := controller.Restart(restartCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the restart to stop with the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Restart ignored the context for %s", elapsed)
+	}
+
+	controller.StopTimeout = 10 * time.Millisecond // для Stop в конце теста
+
+	// Прерванный перезапуск не оставляет Xray остановленным
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		status, _ = controller.Status(ctx)
+		if status.Running && status.PID != firstPID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected Xray to be started again, got %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
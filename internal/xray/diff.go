@@ -0,0 +1,157 @@
+package xray
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DiffEntry is one value that differs between two configs. Old is empty
+// for added values and New for removed ones.
+type DiffEntry struct {
+	Path string          `json:"path"`
+	Old  json.RawMessage `json:"old,omitempty"`
+	New  json.RawMessage `json:"new,omitempty"`
+}
+
+// identityKeys name the fields that identify an element of an array, so
+// that inserting an inbound or client doesn't shift every path after it.
+var identityKeys = []string{"tag", "id", "email"}
+
+// Diff compares two configs value by value. Paths look like
+// inbounds[tag=vless].settings.clients[id=...].level.
+func Diff(from, to []byte) ([]DiffEntry, error) {
+	oldValues, err := flattenJSON(from)
+	if err != nil {
+		return nil, fmt.Errorf("old config: %w", err)
+	}
+	newValues, err := flattenJSON(to)
+	if err != nil {
+		return nil, fmt.Errorf("new config: %w", err)
+	}
+
+	paths := make([]string, 0, len(oldValues)+len(newValues))
+	for path := range oldValues {
+		paths = append(paths, path)
+	}
+	for path := range newValues {
+		if _, ok := oldValues[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	changes := []DiffEntry{}
+	for _, path := range paths {
+		oldValue, inOld := oldValues[path]
+		newValue, inNew := newValues[path]
+		if inOld && inNew && reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		// Пустой список, в который добавили элементы, виден по самим элементам
+		if (inOld && !inNew && isEmpty(oldValue) && hasChildren(newValues, path)) ||
+			(inNew && !inOld && isEmpty(newValue) && hasChildren(oldValues, path)) {
+			continue
+		}
+		change := DiffEntry{Path: path}
+		if inOld {
+			change.Old, _ = json.Marshal(oldValue)
+		}
+		if inNew {
+			change.New, _ = json.Marshal(newValue)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// isEmpty reports whether a flattened value is an empty object or array.
+func isEmpty(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// hasChildren reports whether values has paths nested under path.
+func hasChildren(values map[string]interface{}, path string) bool {
+	for other := range values {
+		if strings.HasPrefix(other, path+".") || strings.HasPrefix(other, path+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+func flattenJSON(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	flatten("", value, values)
+	return values, nil
+}
+
+func flatten(path string, value interface{}, values map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			values[path] = v
+		}
+		for key, item := range v {
+			if path == "" {
+				flatten(key, item, values)
+			} else {
+				flatten(path+"."+key, item, values)
+			}
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			values[path] = v
+		}
+		key := identityKey(v)
+		for i, item := range v {
+			if key == "" {
+				flatten(fmt.Sprintf("%s[%d]", path, i), item, values)
+			} else {
+				id := item.(map[string]interface{})[key]
+				flatten(fmt.Sprintf("%s[%s=%v]", path, key, id), item, values)
+			}
+		}
+	default:
+		values[path] = v
+	}
+}
+
+// identityKey returns the first of identityKeys that every element of the
+// array has, with unique scalar values, or "" to fall back to indexes.
+func identityKey(items []interface{}) string {
+	for _, key := range identityKeys {
+		seen := make(map[string]bool, len(items))
+		for _, item := range items {
+			object, ok := item.(map[string]interface{})
+			if !ok {
+				return ""
+			}
+			id, ok := object[key].(string)
+			if !ok || id == "" || seen[id] || strings.ContainsAny(id, "[]") {
+				seen = nil
+				break
+			}
+			seen[id] = true
+		}
+		if seen != nil {
+			return key
+		}
+	}
+	return ""
+}
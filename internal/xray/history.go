@@ -0,0 +1,199 @@
+package xray
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrSnapshotNotFound = errors.New("config snapshot not found")
+
+// Snapshot is one saved version of the config file.
+type Snapshot struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Author    string    `json:"author"`
+	Reason    string    `json:"reason"`
+	// Config is left out when snapshots are listed.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// History keeps the last Keep versions of the config file in Dir, one
+// JSON file per version.
+type History struct {
+	Dir  string
+	Keep int
+	mu   sync.Mutex
+}
+
+func NewHistory(dir string, keep int) *History {
+	return &History{Dir: dir, Keep: keep}
+}
+
+func (h *History) path(version int) string {
+	return filepath.Join(h.Dir, fmt.Sprintf("%06d.json", version))
+}
+
+// versions returns the stored versions, oldest first.
+func (h *History) versions() ([]int, error) {
+	entries, err := os.ReadDir(h.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read config history: %w", err)
+	}
+
+	var versions []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if version, err := strconv.Atoi(strings.TrimSuffix(name, ".json")); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// Record stores data as the newest version and drops the oldest ones
+// beyond Keep.
+func (h *History) Record(data []byte, author, reason string) (*Snapshot, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("config snapshot is not valid JSON")
+	}
+	if err := os.MkdirAll(h.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create config history: %w", err)
+	}
+	versions, err := h.versions()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Version:   1,
+		CreatedAt: time.Now().UTC(),
+		Author:    author,
+		Reason:    reason,
+		Config:    json.RawMessage(data),
+	}
+	if len(versions) > 0 {
+		snapshot.Version = versions[len(versions)-1] + 1
+	}
+
+	encoded, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteFileAtomic(h.path(snapshot.Version), encoded, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save config snapshot: %w", err)
+	}
+
+	versions = append(versions, snapshot.Version)
+	if h.Keep > 0 && len(versions) > h.Keep {
+		for _, version := range versions[:len(versions)-h.Keep] {
+			if err := os.Remove(h.path(version)); err != nil && !os.IsNotExist(err) {
+				return snapshot, fmt.Errorf("failed to prune config history: %w", err)
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// Len returns the number of stored versions.
+func (h *History) Len() (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	versions, err := h.versions()
+	return len(versions), err
+}
+
+// Get returns one version with its config.
+func (h *History) Get(version int) (*Snapshot, error) {
+	data, err := os.ReadFile(h.path(version))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: version %d", ErrSnapshotNotFound, version)
+		}
+		return nil, fmt.Errorf("failed to read config snapshot: %w", err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse config snapshot %d: %w", version, err)
+	}
+	return &snapshot, nil
+}
+
+// List returns the stored versions without their configs, newest first.
+func (h *History) List() ([]Snapshot, error) {
+	h.mu.Lock()
+	versions, err := h.versions()
+	h.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]Snapshot, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		snapshot, err := h.Get(versions[i])
+		if errors.Is(err, ErrSnapshotNotFound) {
+			continue // удалён при очистке между чтением каталога и файла
+		}
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Config = nil
+		snapshots = append(snapshots, *snapshot)
+	}
+	return snapshots, nil
+}
+
+// WriteFileAtomic replaces path with data so that readers see either the
+// old or the new content, never a partial write: data goes to a temporary
+// file in the same directory, which is synced and renamed over path.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // после успешного rename файла уже нет
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+
+	// Синхронизируем каталог, чтобы rename пережил падение питания
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package xray
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHistoryKeepsLastVersions(t *testing.T) {
+	history := NewHistory(filepath.Join(t.TempDir(), "history"), 2)
+
+	for i, config := range []string{`{"log": 1}`, `{"log": 2}`, `{"log": 3}`} {
+		snapshot, err := history.Record([]byte(config), "system", "change")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.Version != i+1 {
+			t.Errorf("Expected version %d, got %d", i+1, snapshot.Version)
+		}
+	}
+
+	versions, err := history.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != 3 || versions[1].Version != 2 {
+		t.Fatalf("Expected versions 3 and 2, got %+v", versions)
+	}
+	if versions[0].Author != "system" || versions[0].Reason != "change" || versions[0].Config != nil {
+		t.Errorf("Unexpected listed version %+v", versions[0])
+	}
+
+	if _, err := history.Get(1); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Expected the oldest version to be pruned, got %v", err)
+	}
+	snapshot, err := history.Get(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := Diff(snapshot.Config, []byte(`{"log": 3}`))
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Expected the stored config to be unchanged, got %+v, %v", changes, err)
+	}
+
+	if _, err := history.Record([]byte(`{"log":`), "system", "broken"); err == nil {
+		t.Error("Expected invalid JSON to be rejected")
+	}
+}
+
+func TestWriteFileAtomicReplacesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFileAtomic(path, []byte("new"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "new" {
+		t.Fatalf("Expected the new content, got %q, %v", data, err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640, got %v", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected no temporary files left, got %d entries", len(entries))
+	}
+}
+
+func TestDiffMatchesClientsByID(t *testing.T) {
+	from := []byte(`{"inbounds": [{"tag": "vless", "port": 443, "settings": {"clients": [
+		{"id": "a", "email": "a@example.com"},
+		{"id": "b", "email": "b@example.com", "level": 0}
+	]}}]}`)
+	to := []byte(`{"inbounds": [{"tag": "vless", "port": 8443, "settings": {"clients": [
+		{"id": "b", "email": "b@example.com", "level": 1},
+		{"id": "c", "email": "c@example.com"}
+	]}}]}`)
+
+	changes, err := Diff(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []DiffEntry{
+		{Path: "inbounds[tag=vless].port", Old: []byte(`443`), New: []byte(`8443`)},
+		{Path: "inbounds[tag=vless].settings.clients[id=a].email", Old: []byte(`"a@example.com"`)},
+		{Path: "inbounds[tag=vless].settings.clients[id=a].id", Old: []byte(`"a"`)},
+		{Path: "inbounds[tag=vless].settings.clients[id=b].level", Old: []byte(`0`), New: []byte(`1`)},
+		{Path: "inbounds[tag=vless].settings.clients[id=c].email", New: []byte(`"c@example.com"`)},
+		{Path: "inbounds[tag=vless].settings.clients[id=c].id", New: []byte(`"c"`)},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes, got %+v", len(expected), changes)
+	}
+	for i, e := range expected {
+		c := changes[i]
+		if c.Path != e.Path || string(c.Old) != string(e.Old) || string(c.New) != string(e.New) {
+			t.Errorf("Change %d: expected %s %s -> %s, got %s %s -> %s", i, e.Path, e.Old, e.New, c.Path, c.Old, c.New)
+		}
+	}
+}
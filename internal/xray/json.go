@@ -0,0 +1,262 @@
+package xray
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Extra holds the JSON members of an object that the typed model does not
+// know about, so they survive a load/save round trip unchanged.
+type Extra map[string]json.RawMessage
+
+var knownKeysCache sync.Map // reflect.Type -> []string
+
+// knownKeys lists the JSON member names declared on struct type t.
+func knownKeys(t reflect.Type) []string {
+	if keys, ok := knownKeysCache.Load(t); ok {
+		return keys.([]string)
+	}
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("json")
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		keys = append(keys, name)
+	}
+	knownKeysCache.Store(t, keys)
+	return keys
+}
+
+// decodeObject decodes data into the plain struct v and stores every member
+// v does not declare in extra.
+func decodeObject(data []byte, v interface{}, extra *Extra) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+	for _, key := range knownKeys(reflect.TypeOf(v).Elem()) {
+		delete(members, key)
+	}
+	if len(members) == 0 {
+		*extra = nil
+	} else {
+		*extra = members
+	}
+	return nil
+}
+
+// encodeMembers encodes the plain struct v and merges extra into the result.
+// Declared fields win over extra members of the same name.
+func encodeMembers(v interface{}, extra Extra) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+	for key, value := range extra {
+		if _, ok := members[key]; !ok {
+			members[key] = value
+		}
+	}
+	return members, nil
+}
+
+func encodeObject(v interface{}, extra Extra) ([]byte, error) {
+	if len(extra) == 0 {
+		return json.Marshal(v)
+	}
+	members, err := encodeMembers(v, extra)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(members)
+}
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type plain Config
+	return decodeObject(data, (*plain)(c), &c.Extra)
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	type plain Config
+	return encodeObject(plain(c), c.Extra)
+}
+
+func (a *APIConfig) UnmarshalJSON(data []byte) error {
+	type plain APIConfig
+	return decodeObject(data, (*plain)(a), &a.Extra)
+}
+
+func (a APIConfig) MarshalJSON() ([]byte, error) {
+	type plain APIConfig
+	return encodeObject(plain(a), a.Extra)
+}
+
+func (in *Inbound) UnmarshalJSON(data []byte) error {
+	type plain Inbound
+	return decodeObject(data, (*plain)(in), &in.Extra)
+}
+
+func (in Inbound) MarshalJSON() ([]byte, error) {
+	type plain Inbound
+	return encodeObject(plain(in), in.Extra)
+}
+
+func (s *InboundSettings) UnmarshalJSON(data []byte) error {
+	type plain InboundSettings
+	return decodeObject(data, (*plain)(s), &s.Extra)
+}
+
+// MarshalJSON keeps an empty clients list as [] but leaves it out entirely
+// for inbounds that never had one, such as dokodemo-door.
+func (s InboundSettings) MarshalJSON() ([]byte, error) {
+	type plain InboundSettings
+	members, err := encodeMembers(plain(s), s.Extra)
+	if err != nil {
+		return nil, err
+	}
+	if s.Clients == nil {
+		delete(members, "clients")
+	}
+	return json.Marshal(members)
+}
+
+func (c *Client) UnmarshalJSON(data []byte) error {
+	type plain Client
+	return decodeObject(data, (*plain)(c), &c.Extra)
+}
+
+func (c Client) MarshalJSON() ([]byte, error) {
+	type plain Client
+	return encodeObject(plain(c), c.Extra)
+}
+
+func (s *StreamSettings) UnmarshalJSON(data []byte) error {
+	type plain StreamSettings
+	return decodeObject(data, (*plain)(s), &s.Extra)
+}
+
+func (s StreamSettings) MarshalJSON() ([]byte, error) {
+	type plain StreamSettings
+	return encodeObject(plain(s), s.Extra)
+}
+
+func (t *TLSSettings) UnmarshalJSON(data []byte) error {
+	type plain TLSSettings
+	return decodeObject(data, (*plain)(t), &t.Extra)
+}
+
+func (t TLSSettings) MarshalJSON() ([]byte, error) {
+	type plain TLSSettings
+	return encodeObject(plain(t), t.Extra)
+}
+
+func (r *RealitySettings) UnmarshalJSON(data []byte) error {
+	type plain RealitySettings
+	return decodeObject(data, (*plain)(r), &r.Extra)
+}
+
+func (r RealitySettings) MarshalJSON() ([]byte, error) {
+	type plain RealitySettings
+	return encodeObject(plain(r), r.Extra)
+}
+
+func (w *WSSettings) UnmarshalJSON(data []byte) error {
+	type plain WSSettings
+	return decodeObject(data, (*plain)(w), &w.Extra)
+}
+
+func (w WSSettings) MarshalJSON() ([]byte, error) {
+	type plain WSSettings
+	return encodeObject(plain(w), w.Extra)
+}
+
+func (g *GRPCSettings) UnmarshalJSON(data []byte) error {
+	type plain GRPCSettings
+	return decodeObject(data, (*plain)(g), &g.Extra)
+}
+
+func (g GRPCSettings) MarshalJSON() ([]byte, error) {
+	type plain GRPCSettings
+	return encodeObject(plain(g), g.Extra)
+}
+
+func (o *Outbound) UnmarshalJSON(data []byte) error {
+	type plain Outbound
+	return decodeObject(data, (*plain)(o), &o.Extra)
+}
+
+func (o Outbound) MarshalJSON() ([]byte, error) {
+	type plain Outbound
+	return encodeObject(plain(o), o.Extra)
+}
+
+func (r *Routing) UnmarshalJSON(data []byte) error {
+	type plain Routing
+	return decodeObject(data, (*plain)(r), &r.Extra)
+}
+
+func (r Routing) MarshalJSON() ([]byte, error) {
+	type plain Routing
+	return encodeObject(plain(r), r.Extra)
+}
+
+func (r *RoutingRule) UnmarshalJSON(data []byte) error {
+	type plain RoutingRule
+	return decodeObject(data, (*plain)(r), &r.Extra)
+}
+
+func (r RoutingRule) MarshalJSON() ([]byte, error) {
+	type plain RoutingRule
+	return encodeObject(plain(r), r.Extra)
+}
+
+func (p *Policy) UnmarshalJSON(data []byte) error {
+	type plain Policy
+	return decodeObject(data, (*plain)(p), &p.Extra)
+}
+
+func (p Policy) MarshalJSON() ([]byte, error) {
+	type plain Policy
+	return encodeObject(plain(p), p.Extra)
+}
+
+func (l *PolicyLevel) UnmarshalJSON(data []byte) error {
+	type plain PolicyLevel
+	return decodeObject(data, (*plain)(l), &l.Extra)
+}
+
+func (l PolicyLevel) MarshalJSON() ([]byte, error) {
+	type plain PolicyLevel
+	return encodeObject(plain(l), l.Extra)
+}
+
+func (s *SystemPolicy) UnmarshalJSON(data []byte) error {
+	type plain SystemPolicy
+	return decodeObject(data, (*plain)(s), &s.Extra)
+}
+
+func (s SystemPolicy) MarshalJSON() ([]byte, error) {
+	type plain SystemPolicy
+	return encodeObject(plain(s), s.Extra)
+}
+
+func (s *Stats) UnmarshalJSON(data []byte) error {
+	type plain Stats
+	return decodeObject(data, (*plain)(s), &s.Extra)
+}
+
+func (s Stats) MarshalJSON() ([]byte, error) {
+	type plain Stats
+	return encodeObject(plain(s), s.Extra)
+}
@@ -0,0 +1,103 @@
+package xray
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Port is the port of an inbound as written in the config. Xray takes a
+// number or a string: a number, a range "10000-10010", a list such as
+// "80,443,10000-10010" or "env:NAME". The raw JSON is kept, so every form
+// is written back the way it was read.
+type Port json.RawMessage
+
+// PortNumber returns a single numeric port.
+func PortNumber(port int) Port {
+	return Port(strconv.Itoa(port))
+}
+
+func (p Port) MarshalJSON() ([]byte, error) {
+	if len(p) == 0 {
+		return []byte("null"), nil
+	}
+	return p, nil
+}
+
+func (p *Port) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value.(type) {
+	case nil:
+		*p = nil
+	case float64, string:
+		*p = append((*p)[:0], data...)
+	default:
+		return fmt.Errorf("xray: port must be a number or a string, got %s", data)
+	}
+	return nil
+}
+
+// String returns the port spec without JSON quotes.
+func (p Port) String() string {
+	var spec string
+	if err := json.Unmarshal(p, &spec); err == nil {
+		return spec
+	}
+	return string(p)
+}
+
+// PortRange is an inclusive range of ports; a single port has From == To.
+type PortRange struct {
+	From, To int
+}
+
+// Ranges parses the port spec. Ports taken from the environment are not
+// known here, so "env:" specs have no ranges.
+func (p Port) Ranges() ([]PortRange, error) {
+	spec := strings.TrimSpace(p.String())
+	if spec == "" || strings.HasPrefix(spec, "env:") {
+		return nil, nil
+	}
+	var ranges []PortRange
+	for _, item := range strings.Split(spec, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		r, err := parsePortRange(from, to, isRange)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s", spec)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func parsePortRange(from, to string, isRange bool) (PortRange, error) {
+	if !isRange {
+		to = from
+	}
+	first, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return PortRange{}, err
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return PortRange{}, err
+	}
+	if first < 0 || last > 65535 || first > last {
+		return PortRange{}, fmt.Errorf("port out of range")
+	}
+	return PortRange{From: first, To: last}, nil
+}
+
+// First returns the first port of the spec, e.g. for share links, which
+// take a single port. It is 0 when the port is unknown.
+func (p Port) First() int {
+	ranges, err := p.Ranges()
+	if err != nil || len(ranges) == 0 {
+		return 0
+	}
+	return ranges[0].From
+}
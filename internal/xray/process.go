@@ -0,0 +1,209 @@
+package xray
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ProcessController runs Xray as a child of the backend and restarts it
+// when it exits on its own.
+type ProcessController struct {
+	Binary     string
+	ConfigPath string
+	// StopTimeout is how long Xray gets to exit after SIGTERM before it is
+	// killed.
+	StopTimeout time.Duration
+	// RestartDelay is the pause before a crashed Xray is started again.
+	RestartDelay time.Duration
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	done      chan struct{} // закрывается, когда текущий процесс завершился
+	startedAt time.Time
+	lastExit  string
+	ctx       context.Context
+}
+
+func NewProcessController(binary, configPath string) *ProcessController {
+	if binary == "" {
+		binary = "xray"
+	}
+	return &ProcessController{
+		Binary:       binary,
+		ConfigPath:   configPath,
+		StopTimeout:  10 * time.Second,
+		RestartDelay: 2 * time.Second,
+	}
+}
+
+// tailBuffer keeps the last bytes Xray wrote, for the status.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Write(p)
+	if over := b.buf.Len() - 4096; over > 0 {
+		b.buf.Next(over)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(bytes.TrimSpace(b.buf.Bytes()))
+}
+
+// Start runs Xray and supervises it until ctx is cancelled, when Xray is
+// stopped too.
+func (c *ProcessController) Start(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ctx = ctx
+	if err := c.startLocked(); err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		c.Stop()
+	}()
+	return nil
+}
+
+func (c *ProcessController) startLocked() error {
+	if c.ctx == nil {
+		return fmt.Errorf("xray process controller is not started")
+	}
+	if c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+
+	output := &tailBuffer{}
+	cmd := exec.Command(c.Binary, "run", "-c", c.ConfigPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", c.Binary, err)
+	}
+	log.Printf("Xray started, pid %d", cmd.Process.Pid)
+
+	done := make(chan struct{})
+	c.cmd, c.done, c.startedAt = cmd, done, time.Now()
+	go c.wait(cmd, done, output)
+	return nil
+}
+
+// wait reaps the process and restarts it if it wasn't stopped on purpose.
+func (c *ProcessController) wait(cmd *exec.Cmd, done chan struct{}, output *tailBuffer) {
+	err := cmd.Wait()
+	close(done)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cmd != cmd {
+		return // остановлен через stopLocked, перезапуск — забота вызывающего
+	}
+	c.cmd = nil
+	c.lastExit = fmt.Sprintf("exited: %v %s", err, output.String())
+	log.Printf("Xray %s, restarting in %s", c.lastExit, c.RestartDelay)
+	c.startLater()
+}
+
+// startLater starts Xray after RestartDelay unless it runs by then.
+func (c *ProcessController) startLater() {
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.RestartDelay):
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.cmd != nil {
+			return // уже перезапущен через Restart
+		}
+		if err := c.startLocked(); err != nil {
+			c.lastExit = err.Error()
+			log.Printf("Failed to restart Xray: %v", err)
+		}
+	}()
+}
+
+// stopLocked terminates the current process and waits for it to exit. If
+// ctx ends first, the process is killed and ctx's error returned without
+// waiting any longer.
+func (c *ProcessController) stopLocked(ctx context.Context) error {
+	cmd, done := c.cmd, c.done
+	if cmd == nil {
+		return nil
+	}
+	c.cmd = nil
+
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(c.StopTimeout):
+		_ = cmd.Process.Kill()
+		<-done
+	case <-ctx.Done():
+		_ = cmd.Process.Kill()
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Stop terminates Xray and waits for it to exit. It is not restarted.
+func (c *ProcessController) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.stopLocked(context.Background())
+}
+
+// Restart stops Xray and starts it again. If ctx ends before Xray is
+// started, the restart fails and Xray is brought back like after a crash.
+func (c *ProcessController) Restart(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx == nil {
+		return fmt.Errorf("xray process controller is not started")
+	}
+	err := c.stopLocked(ctx)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.lastExit = fmt.Sprintf("restart interrupted: %v", err)
+		c.startLater()
+		return err
+	}
+	return c.startLocked()
+}
+
+func (c *ProcessController) Status(ctx context.Context) (ProcessStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := ProcessStatus{Controller: ControllerProcess, Detail: c.lastExit}
+	if c.cmd == nil {
+		if c.ctx == nil {
+			return status, errors.New("xray process controller is not started")
+		}
+		return status, nil
+	}
+	status.Running = true
+	status.PID = c.cmd.Process.Pid
+	status.setStarted(c.startedAt)
+	return status, nil
+}
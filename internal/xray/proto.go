@@ -0,0 +1,480 @@
+package xray
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The Xray API speaks protobuf over gRPC. Only a handful of messages are
+// needed, so they are encoded by hand with protowire instead of pulling in
+// xray-core and its generated code.
+
+// Type names of the messages wrapped in TypedMessage, as registered in Xray.
+const (
+	addUserOperationType    = "xray.app.proxyman.command.AddUserOperation"
+	removeUserOperationType = "xray.app.proxyman.command.RemoveUserOperation"
+	vlessAccountType        = "xray.proxy.vless.Account"
+	vmessAccountType        = "xray.proxy.vmess.Account"
+	trojanAccountType       = "xray.proxy.trojan.Account"
+	shadowsocksAccountType  = "xray.proxy.shadowsocks.Account"
+	ss2022AccountType       = "xray.proxy.shadowsocks_2022.Account"
+)
+
+// shadowsocksCiphers maps config method names to xray.proxy.shadowsocks.CipherType.
+var shadowsocksCiphers = map[string]uint64{
+	"aes-128-gcm":             5,
+	"aes-256-gcm":             6,
+	"chacha20-poly1305":       7,
+	"chacha20-ietf-poly1305":  7,
+	"xchacha20-poly1305":      8,
+	"xchacha20-ietf-poly1305": 8,
+	"none":                    9,
+	"plain":                   9,
+}
+
+// message is implemented by every type sent over the API.
+type message interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+// codec replaces the default gRPC proto codec with the hand written
+// messages. It keeps the "proto" name so the wire content type matches.
+type codec struct{}
+
+func (codec) Name() string { return "proto" }
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("xray: cannot marshal %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("xray: cannot unmarshal into %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+// field is one decoded protobuf field. Only varint and length-delimited
+// values are used by the Xray API messages; other wire types are skipped.
+type field struct {
+	num    protowire.Number
+	varint uint64
+	bytes  []byte
+}
+
+func decodeFields(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := field{num: num}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarint(b, num, 1)
+}
+
+// emptyMessage stands in for responses without fields.
+type emptyMessage struct{}
+
+func (emptyMessage) marshal() []byte { return nil }
+
+func (emptyMessage) unmarshal([]byte) error { return nil }
+
+// typedMessage is xray.common.serial.TypedMessage.
+type typedMessage struct {
+	Type  string
+	Value []byte
+}
+
+func (m *typedMessage) marshal() []byte {
+	b := appendString(nil, 1, m.Type)
+	return appendBytes(b, 2, m.Value)
+}
+
+func (m *typedMessage) unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Type = string(f.bytes)
+		case 2:
+			m.Value = append([]byte(nil), f.bytes...)
+		}
+		return nil
+	})
+}
+
+// alterInboundRequest is xray.app.proxyman.command.AlterInboundRequest.
+type alterInboundRequest struct {
+	Tag       string
+	Operation typedMessage
+}
+
+func (m *alterInboundRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Tag)
+	return appendBytes(b, 2, m.Operation.marshal())
+}
+
+func (m *alterInboundRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Tag = string(f.bytes)
+		case 2:
+			return m.Operation.unmarshal(f.bytes)
+		}
+		return nil
+	})
+}
+
+// User is a client account as the Xray API sees it. Xray identifies users
+// by email, so it must be set and unique.
+type User struct {
+	Email    string
+	Level    uint32
+	Protocol string
+	ID       string // vless, vmess
+	Flow     string // vless
+	Password string // trojan, shadowsocks
+	Method   string // shadowsocks
+}
+
+// NewUser builds the API user for a config client of the given inbound.
+func NewUser(inbound *Inbound, client Client) User {
+	user := User{
+		Email:    client.Email,
+		Level:    uint32(client.Level),
+		Protocol: inbound.Protocol,
+		ID:       client.ID,
+		Flow:     client.Flow,
+		Password: client.Password,
+	}
+	if inbound.Protocol == "shadowsocks" {
+		// Метод задается либо у клиента, либо на весь inbound
+		if raw, ok := client.Extra["method"]; ok {
+			_ = json.Unmarshal(raw, &user.Method)
+		}
+		if user.Method == "" {
+			user.Method = inbound.Method()
+		}
+	}
+	return user
+}
+
+func (u User) account() (typedMessage, error) {
+	switch u.Protocol {
+	case "vless":
+		b := appendString(nil, 1, u.ID)
+		b = appendString(b, 2, u.Flow)
+		b = appendString(b, 3, "none")
+		return typedMessage{Type: vlessAccountType, Value: b}, nil
+	case "vmess":
+		return typedMessage{Type: vmessAccountType, Value: appendString(nil, 1, u.ID)}, nil
+	case "trojan":
+		return typedMessage{Type: trojanAccountType, Value: appendString(nil, 1, u.Password)}, nil
+	case "shadowsocks":
+		method := strings.ToLower(u.Method)
+		if strings.HasPrefix(method, "2022-") {
+			return typedMessage{Type: ss2022AccountType, Value: appendString(nil, 1, u.Password)}, nil
+		}
+		cipher, ok := shadowsocksCiphers[method]
+		if !ok {
+			return typedMessage{}, fmt.Errorf("xray: unsupported shadowsocks method %q", u.Method)
+		}
+		b := appendString(nil, 1, u.Password)
+		return typedMessage{Type: shadowsocksAccountType, Value: appendVarint(b, 2, cipher)}, nil
+	}
+	return typedMessage{}, fmt.Errorf("xray: live user changes are not supported for protocol %q", u.Protocol)
+}
+
+// marshal encodes xray.common.protocol.User.
+func (u User) marshal() ([]byte, error) {
+	account, err := u.account()
+	if err != nil {
+		return nil, err
+	}
+	b := appendVarint(nil, 1, uint64(u.Level))
+	b = appendString(b, 2, u.Email)
+	return appendBytes(b, 3, account.marshal()), nil
+}
+
+func (u *User) unmarshal(b []byte) error {
+	var account typedMessage
+	err := decodeFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			u.Level = uint32(f.varint)
+		case 2:
+			u.Email = string(f.bytes)
+		case 3:
+			return account.unmarshal(f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch account.Type {
+	case vlessAccountType:
+		u.Protocol = "vless"
+	case vmessAccountType:
+		u.Protocol = "vmess"
+	case trojanAccountType:
+		u.Protocol = "trojan"
+	case shadowsocksAccountType, ss2022AccountType:
+		u.Protocol = "shadowsocks"
+	default:
+		return fmt.Errorf("xray: unknown account type %q", account.Type)
+	}
+	return decodeFields(account.Value, func(f field) error {
+		switch {
+		case f.num == 1 && passwordProtocols[u.Protocol]:
+			u.Password = string(f.bytes)
+		case f.num == 2 && account.Type == shadowsocksAccountType:
+			u.Method = shadowsocksMethod(f.varint)
+		case f.num == 1:
+			u.ID = string(f.bytes)
+		case f.num == 2 && u.Protocol == "vless":
+			u.Flow = string(f.bytes)
+		}
+		return nil
+	})
+}
+
+// shadowsocksMethod returns a config method name for a CipherType.
+func shadowsocksMethod(cipher uint64) string {
+	for _, method := range []string{"aes-128-gcm", "aes-256-gcm", "chacha20-poly1305", "xchacha20-poly1305", "none"} {
+		if shadowsocksCiphers[method] == cipher {
+			return method
+		}
+	}
+	return ""
+}
+
+// InboundOperation is a decoded AlterInbound operation: either Add is set or
+// RemoveEmail names the user to drop.
+type InboundOperation struct {
+	Add         *User
+	RemoveEmail string
+}
+
+func addUserOperation(u User) (typedMessage, error) {
+	user, err := u.marshal()
+	if err != nil {
+		return typedMessage{}, err
+	}
+	return typedMessage{Type: addUserOperationType, Value: appendBytes(nil, 1, user)}, nil
+}
+
+func removeUserOperation(email string) typedMessage {
+	return typedMessage{Type: removeUserOperationType, Value: appendString(nil, 1, email)}
+}
+
+func decodeOperation(m typedMessage) (InboundOperation, error) {
+	var op InboundOperation
+	switch m.Type {
+	case addUserOperationType:
+		op.Add = &User{}
+		err := decodeFields(m.Value, func(f field) error {
+			if f.num == 1 {
+				return op.Add.unmarshal(f.bytes)
+			}
+			return nil
+		})
+		return op, err
+	case removeUserOperationType:
+		err := decodeFields(m.Value, func(f field) error {
+			if f.num == 1 {
+				op.RemoveEmail = string(f.bytes)
+			}
+			return nil
+		})
+		return op, err
+	}
+	return op, fmt.Errorf("xray: unsupported inbound operation %q", m.Type)
+}
+
+// Stat is one named counter, e.g. "user>>>a@example.com>>>traffic>>>uplink".
+type Stat struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+}
+
+func (m *Stat) marshal() []byte {
+	b := appendString(nil, 1, m.Name)
+	return appendVarint(b, 2, uint64(m.Value))
+}
+
+func (m *Stat) unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Name = string(f.bytes)
+		case 2:
+			m.Value = int64(f.varint)
+		}
+		return nil
+	})
+}
+
+// getStatsRequest is xray.app.stats.command.GetStatsRequest.
+type getStatsRequest struct {
+	Name  string
+	Reset bool
+}
+
+func (m *getStatsRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Name)
+	return appendBool(b, 2, m.Reset)
+}
+
+func (m *getStatsRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Name = string(f.bytes)
+		case 2:
+			m.Reset = f.varint != 0
+		}
+		return nil
+	})
+}
+
+// getStatsResponse is xray.app.stats.command.GetStatsResponse.
+type getStatsResponse struct {
+	Stat Stat
+}
+
+func (m *getStatsResponse) marshal() []byte {
+	return appendBytes(nil, 1, m.Stat.marshal())
+}
+
+func (m *getStatsResponse) unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		if f.num == 1 {
+			return m.Stat.unmarshal(f.bytes)
+		}
+		return nil
+	})
+}
+
+// queryStatsRequest is xray.app.stats.command.QueryStatsRequest. Pattern is
+// the only filter older Xray versions understand; Patterns and Regexp were
+// added later.
+type queryStatsRequest struct {
+	Pattern  string
+	Reset    bool
+	Patterns []string
+	Regexp   bool
+}
+
+func (m *queryStatsRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Pattern)
+	b = appendBool(b, 2, m.Reset)
+	for _, pattern := range m.Patterns {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, pattern)
+	}
+	return appendBool(b, 4, m.Regexp)
+}
+
+func (m *queryStatsRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Pattern = string(f.bytes)
+		case 2:
+			m.Reset = f.varint != 0
+		case 3:
+			m.Patterns = append(m.Patterns, string(f.bytes))
+		case 4:
+			m.Regexp = f.varint != 0
+		}
+		return nil
+	})
+}
+
+// queryStatsResponse is xray.app.stats.command.QueryStatsResponse.
+type queryStatsResponse struct {
+	Stats []Stat
+}
+
+func (m *queryStatsResponse) marshal() []byte {
+	var b []byte
+	for i := range m.Stats {
+		b = appendBytes(b, 1, m.Stats[i].marshal())
+	}
+	return b
+}
+
+func (m *queryStatsResponse) unmarshal(b []byte) error {
+	return decodeFields(b, func(f field) error {
+		if f.num == 1 {
+			var stat Stat
+			if err := stat.unmarshal(f.bytes); err != nil {
+				return err
+			}
+			m.Stats = append(m.Stats, stat)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,151 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const statsServiceName = "xray.app.stats.command.StatsService"
+
+var ErrStatNotFound = errors.New("xray: stat not found")
+
+// Traffic is the byte count of one user in both directions.
+type Traffic struct {
+	Uplink   int64 `json:"uplink"`
+	Downlink int64 `json:"downlink"`
+}
+
+func (t Traffic) Total() int64 {
+	return t.Uplink + t.Downlink
+}
+
+// StatsQuery selects counters for QueryStats. Without patterns every counter
+// matches; with Regexp the patterns are regular expressions, otherwise
+// substrings.
+type StatsQuery struct {
+	Patterns []string `json:"patterns,omitempty"`
+	Regexp   bool     `json:"regexp,omitempty"`
+	Reset    bool     `json:"reset,omitempty"`
+}
+
+// UserStatName returns the name of a per-user traffic counter; direction is
+// "uplink" or "downlink".
+func UserStatName(email, direction string) string {
+	return "user>>>" + email + ">>>traffic>>>" + direction
+}
+
+// ParseUserStatName splits a per-user traffic counter name.
+func ParseUserStatName(name string) (email, direction string, ok bool) {
+	parts := strings.Split(name, ">>>")
+	if len(parts) != 4 || parts[0] != "user" || parts[2] != "traffic" {
+		return "", "", false
+	}
+	return parts[1], parts[3], true
+}
+
+// statsError maps Xray's "... not found" for an unknown counter onto
+// ErrStatNotFound. Xray creates user counters on first traffic, so a
+// missing counter usually just means zero.
+func statsError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(strings.ToLower(status.Convert(err).Message()), "not found") {
+		return fmt.Errorf("%w: %v", ErrStatNotFound, err)
+	}
+	return fmt.Errorf("xray api: %w", err)
+}
+
+// GetStats returns a single counter, optionally resetting it to zero.
+func (c *APIClient) GetStats(ctx context.Context, name string, reset bool) (int64, error) {
+	req := &getStatsRequest{Name: name, Reset: reset}
+	var resp getStatsResponse
+	if err := c.call(ctx, "/"+statsServiceName+"/GetStats", req, &resp); err != nil {
+		return 0, statsError(err)
+	}
+	return resp.Stat.Value, nil
+}
+
+// QueryStats returns every counter matching the query.
+func (c *APIClient) QueryStats(ctx context.Context, query StatsQuery) ([]Stat, error) {
+	req := &queryStatsRequest{Reset: query.Reset, Regexp: query.Regexp}
+	if len(query.Patterns) == 1 && !query.Regexp {
+		// Понимается и старыми версиями Xray
+		req.Pattern = query.Patterns[0]
+	} else {
+		req.Patterns = query.Patterns
+	}
+	var resp queryStatsResponse
+	if err := c.call(ctx, "/"+statsServiceName+"/QueryStats", req, &resp); err != nil {
+		return nil, statsError(err)
+	}
+	return resp.Stats, nil
+}
+
+// UserTraffic returns the uplink and downlink counters of one user. Missing
+// counters count as zero.
+func (c *APIClient) UserTraffic(ctx context.Context, email string, reset bool) (Traffic, error) {
+	var traffic Traffic
+	for direction, value := range map[string]*int64{"uplink": &traffic.Uplink, "downlink": &traffic.Downlink} {
+		v, err := c.GetStats(ctx, UserStatName(email, direction), reset)
+		if err != nil && !errors.Is(err, ErrStatNotFound) {
+			return Traffic{}, fmt.Errorf("failed to get %s of %s: %w", direction, email, err)
+		}
+		*value = v
+	}
+	return traffic, nil
+}
+
+// StatsServer is the server side of StatsService.
+type StatsServer interface {
+	GetStats(ctx context.Context, name string, reset bool) (int64, error)
+	QueryStats(ctx context.Context, query StatsQuery) ([]Stat, error)
+}
+
+// RegisterStatsServer exposes st as StatsService on s.
+func RegisterStatsServer(s *grpc.Server, st StatsServer) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: statsServiceName,
+		HandlerType: (*StatsServer)(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "GetStats",
+				Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+					var req getStatsRequest
+					if err := dec(&req); err != nil {
+						return nil, err
+					}
+					value, err := srv.(StatsServer).GetStats(ctx, req.Name, req.Reset)
+					if err != nil {
+						return nil, status.Error(codes.Unknown, err.Error())
+					}
+					return &getStatsResponse{Stat: Stat{Name: req.Name, Value: value}}, nil
+				},
+			},
+			{
+				MethodName: "QueryStats",
+				Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+					var req queryStatsRequest
+					if err := dec(&req); err != nil {
+						return nil, err
+					}
+					query := StatsQuery{Patterns: req.Patterns, Regexp: req.Regexp, Reset: req.Reset}
+					if req.Pattern != "" {
+						query.Patterns = append(query.Patterns, req.Pattern)
+					}
+					stats, err := srv.(StatsServer).QueryStats(ctx, query)
+					if err != nil {
+						return nil, status.Error(codes.Unknown, err.Error())
+					}
+					return &queryStatsResponse{Stats: stats}, nil
+				},
+			},
+		},
+	}, st)
+}
@@ -0,0 +1,120 @@
+package xray
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrInvalidConfig is returned for candidate configs that fail validation;
+// the message carries the reason, e.g. the output of Xray.
+var ErrInvalidConfig = errors.New("xray: invalid config")
+
+// Validator checks a candidate config before it replaces the current one.
+type Validator interface {
+	Validate(ctx context.Context, data []byte) error
+}
+
+// CommandValidator runs the Xray binary in test mode against the candidate:
+// `xray run -test -c <file>`. The candidate is written next to ConfigPath,
+// so relative paths in it resolve as they do for the real config.
+type CommandValidator struct {
+	Binary     string
+	ConfigPath string
+	Timeout    time.Duration
+}
+
+func NewCommandValidator(binary, configPath string, timeout time.Duration) *CommandValidator {
+	return &CommandValidator{Binary: binary, ConfigPath: configPath, Timeout: timeout}
+}
+
+func (v *CommandValidator) Validate(ctx context.Context, data []byte) error {
+	dir, pattern := "", "xray-candidate-*.json"
+	if v.ConfigPath != "" {
+		dir, pattern = filepath.Dir(v.ConfigPath), "."+filepath.Base(v.ConfigPath)+".candidate-*.json"
+	}
+	// Xray определяет формат конфига по расширению, поэтому .json
+	tmp, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return fmt.Errorf("failed to create candidate config: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write candidate config: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write candidate config: %w", err)
+	}
+
+	if v.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.Timeout)
+		defer cancel()
+	}
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, v.Binary, "run", "-test", "-c", tmp.Name())
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || ctx.Err() != nil {
+			return fmt.Errorf("failed to run %s: %w", v.Binary, err)
+		}
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// Check runs the backend's own checks on a config: things that break user
+// management or that Xray rejects at start. Anything else is left to the
+// Validator.
+func (c *Config) Check() error {
+	var problems []error
+	tags := make(map[string]bool)
+	for i := range c.Inbounds {
+		inbound := &c.Inbounds[i]
+		name := inbound.Tag
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+
+		if _, err := inbound.Port.Ranges(); err != nil {
+			problems = append(problems, fmt.Errorf("inbound %s: %w", name, err))
+		}
+		if inbound.Tag != "" {
+			if tags[inbound.Tag] {
+				problems = append(problems, fmt.Errorf("inbound %s: duplicate tag", name))
+			}
+			tags[inbound.Tag] = true
+		}
+
+		if !inbound.AcceptsClients() || inbound.Settings == nil {
+			continue
+		}
+		emails := make(map[string]bool)
+		for _, client := range inbound.Settings.Clients {
+			if client.ID == "" && client.Password == "" {
+				problems = append(problems, fmt.Errorf("inbound %s: client %q has no id", name, client.Email))
+			}
+			if client.Email == "" {
+				continue
+			}
+			if emails[client.Email] {
+				problems = append(problems, fmt.Errorf("inbound %s: duplicate client email %s", name, client.Email))
+			}
+			emails[client.Email] = true
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, errors.Join(problems...))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeXray writes a script that behaves like `xray run -test -c file`:
+// it fails for configs that mention "broken", and for configs that mention
+// "cert.pem" unless that file is next to the config.
+func fakeXray(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake xray binary is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "xray")
+	script := `#!/bin/sh
+[ "$1" = run ] && [ "$2" = -test ] && [ "$3" = -c ] || { echo "unexpected args: $*"; exit 2; }
+if grep -q broken "$4"; then
+	echo "Failed to start: infra/conf: unknown protocol: broken"
+	exit 23
+fi
+if grep -q cert.pem "$4" && [ ! -f "$(dirname "$4")/cert.pem" ]; then
+	echo "Failed to start: open cert.pem: no such file or directory"
+	exit 23
+fi
+echo "Configuration OK."
+`
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCommandValidator(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	validator := NewCommandValidator(fakeXray(t), configPath, 5*time.Second)
+
+	if err := validator.Validate(context.Background(), []byte(`{"inbounds": [{"protocol": "vless"}]}`)); err != nil {
+		t.Fatalf("Expected a valid config, got %v", err)
+	}
+
+	err := validator.Validate(context.Background(), []byte(`{"inbounds": [{"protocol": "broken"}]}`))
+	if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "unknown protocol: broken") {
+		t.Fatalf("Expected the Xray error, got %v", err)
+	}
+
+	// Относительные пути считаются от каталога конфига
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := validator.Validate(context.Background(), []byte(`{"certificateFile": "cert.pem"}`)); err != nil {
+		t.Fatalf("Expected the certificate next to the config to be found, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected the candidate to be removed, found %d files", len(entries))
+	}
+
+	missing := NewCommandValidator(filepath.Join(t.TempDir(), "no-xray"), "", time.Second)
+	if err := missing.Validate(context.Background(), []byte(`{}`)); err == nil || errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Expected a missing binary to be reported as a run failure, got %v", err)
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"inbounds": [
+			{"tag": "vless", "port": 443, "protocol": "vless", "settings": {"clients": [
+				{"id": "a", "email": "a@example.com"},
+				{"id": "b", "email": "a@example.com"},
+				{"email": "c@example.com"}
+			]}},
+			{"tag": "vless", "port": 70000, "protocol": "vmess", "settings": {"clients": []}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.Check()
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Expected ErrInvalidConfig, got %v", err)
+	}
+	for _, problem := range []string{"duplicate client email a@example.com", `client "c@example.com" has no id`, "invalid port 70000", "duplicate tag"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q in %v", problem, err)
+		}
+	}
+
+	cfg.Inbounds = cfg.Inbounds[:1]
+	cfg.Inbounds[0].Settings.Clients = cfg.Inbounds[0].Settings.Clients[:1]
+	if err := cfg.Check(); err != nil {
+		t.Errorf("Expected a clean config to pass, got %v", err)
+	}
+}
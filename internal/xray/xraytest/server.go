@@ -0,0 +1,191 @@
+// Package xraytest provides an in-process fake of the Xray gRPC API for
+// tests, in the spirit of net/http/httptest.
+package xraytest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"vpn-backend/internal/xray"
+
+	"google.golang.org/grpc"
+)
+
+// Server is a fake Xray API listening on a loopback port. Inbounds are
+// created on first use; pass tags to NewServer to make only those exist.
+type Server struct {
+	Addr string
+
+	mu       sync.Mutex
+	inbounds map[string]map[string]xray.User // tag -> email -> user
+	stats    map[string]int64
+	strict   bool
+	calls    int
+
+	listener net.Listener
+	grpc     *grpc.Server
+}
+
+// NewServer starts a fake Xray API. When tags are given, operations on any
+// other inbound fail the way Xray does for an unknown handler.
+func NewServer(tags ...string) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("xraytest: failed to listen: %v", err))
+	}
+
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		inbounds: make(map[string]map[string]xray.User),
+		stats:    make(map[string]int64),
+		strict:   len(tags) > 0,
+		listener: listener,
+		grpc:     xray.NewServer(),
+	}
+	for _, tag := range tags {
+		s.inbounds[tag] = make(map[string]xray.User)
+	}
+
+	xray.RegisterHandlerServer(s.grpc, s)
+	xray.RegisterStatsServer(s.grpc, s)
+	go s.grpc.Serve(listener)
+	return s
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.grpc.Stop()
+}
+
+// AlterInbound implements xray.HandlerServer.
+func (s *Server) AlterInbound(_ context.Context, tag string, op xray.InboundOperation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+
+	users, ok := s.inbounds[tag]
+	if !ok {
+		if s.strict {
+			return fmt.Errorf("handler not found: %s", tag)
+		}
+		users = make(map[string]xray.User)
+		s.inbounds[tag] = users
+	}
+
+	if op.Add != nil {
+		// Как и Xray, не принимаем пользователя без учётных данных
+		password := op.Add.Protocol == "trojan" || op.Add.Protocol == "shadowsocks"
+		if password && op.Add.Password == "" {
+			return fmt.Errorf("%s user %s has no password", op.Add.Protocol, op.Add.Email)
+		}
+		if !password && op.Add.ID == "" {
+			return fmt.Errorf("%s user %s has no id", op.Add.Protocol, op.Add.Email)
+		}
+		if _, exists := users[op.Add.Email]; exists {
+			return fmt.Errorf("user %s already exists", op.Add.Email)
+		}
+		users[op.Add.Email] = *op.Add
+		return nil
+	}
+	if _, exists := users[op.RemoveEmail]; !exists {
+		return fmt.Errorf("user %s not found", op.RemoveEmail)
+	}
+	delete(users, op.RemoveEmail)
+	return nil
+}
+
+// Users returns the users of an inbound sorted by email.
+func (s *Server) Users(tag string) []xray.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]xray.User, 0, len(s.inbounds[tag]))
+	for _, user := range s.inbounds[tag] {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	return users
+}
+
+// Calls returns how many AlterInbound calls the server has received.
+func (s *Server) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// AddTraffic adds bytes to a user's counters the way Xray does while the
+// user is connected.
+func (s *Server) AddTraffic(email string, uplink, downlink int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats[xray.UserStatName(email, "uplink")] += uplink
+	s.stats[xray.UserStatName(email, "downlink")] += downlink
+}
+
+// ResetStats drops every counter, as an Xray restart does.
+func (s *Server) ResetStats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats = make(map[string]int64)
+}
+
+// GetStats implements xray.StatsServer.
+func (s *Server) GetStats(_ context.Context, name string, reset bool) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.stats[name]
+	if !ok {
+		return 0, fmt.Errorf("%s not found", name)
+	}
+	if reset {
+		s.stats[name] = 0
+	}
+	return value, nil
+}
+
+// QueryStats implements xray.StatsServer.
+func (s *Server) QueryStats(_ context.Context, query xray.StatsQuery) ([]xray.Stat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matchers []func(string) bool
+	for _, pattern := range query.Patterns {
+		if query.Regexp {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, re.MatchString)
+			continue
+		}
+		pattern := pattern
+		matchers = append(matchers, func(name string) bool { return strings.Contains(name, pattern) })
+	}
+
+	var stats []xray.Stat
+	for name, value := range s.stats {
+		matched := len(matchers) == 0
+		for _, match := range matchers {
+			if match(name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		stats = append(stats, xray.Stat{Name: name, Value: value})
+		if query.Reset {
+			s.stats[name] = 0
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats, nil
+}
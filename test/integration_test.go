@@ -2,15 +2,24 @@ package test
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"testing"
+	"time"
 	"vpn-backend/config"
 	"vpn-backend/internal/handlers"
+	"vpn-backend/internal/mail"
 	"vpn-backend/internal/middleware"
 	"vpn-backend/internal/models"
 	"vpn-backend/internal/repository"
@@ -23,6 +32,8 @@ import (
 	"gorm.io/gorm/logger"
 )
 
+const testBotToken = "123456:test-bot-token"
+
 var (
 	dbConn         *gorm.DB
 	cfg            *config.Config
@@ -36,15 +47,22 @@ var (
 	adminHandler   *handlers.AdminHandler
 	xrayHandler    *handlers.XrayHandler
 	trafficHandler *handlers.TrafficHandler
+	paymentHandler *handlers.PaymentHandler
 	router         *mux.Router
+	mailDir        string
 )
 
 func setup() {
 	// Load configuration
 	cfg = config.Load()
 
-	// Initialize database connection
 	var err error
+	mailDir, err = os.MkdirTemp("", "vpn-backend-mail")
+	if err != nil {
+		log.Fatalf("Failed to create mail dir: %v", err)
+	}
+
+	// Initialize database connection
 	dbConn, err = gorm.Open(postgres.Open(cfg.DbURL), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info), // Enable detailed logging
 	})
@@ -53,7 +71,7 @@ func setup() {
 	}
 
 	// Auto-migrate database schema
-	err = dbConn.AutoMigrate(&models.User{}, &models.Tariff{})
+	err = dbConn.AutoMigrate(&models.User{}, &models.Tariff{}, &models.Payment{}, &models.PasswordResetToken{}, &models.TelegramIdentity{}, &models.AccessEvent{}, &models.TrafficLog{})
 	if err != nil {
 		log.Fatalf("Failed to auto-migrate database: %v", err)
 	}
@@ -64,6 +82,12 @@ func setup() {
 
 	// Initialize services
 	authService = services.NewAuthService(userRepo, cfg.JWTSecret)
+	authService.ResetRepo = repository.NewPasswordResetRepository(dbConn)
+	authService.TelegramRepo = repository.NewTelegramIdentityRepository(dbConn)
+	authService.TelegramBotToken = testBotToken
+	authService.Mailer = mail.NewFileMailer(mailDir, "noreply@example.com")
+	authService.ResetURL = cfg.PasswordResetURL
+	authService.VerifyURL = cfg.EmailVerifyURL
 	paymentService = services.NewPaymentService(userRepo, tariffRepo)
 	xrayService = services.NewXrayService(userRepo, cfg.XrayConfigPath, cfg.XrayTemplatePath)
 	trafficService = services.NewTrafficService(userRepo, paymentService)
@@ -73,9 +97,11 @@ func setup() {
 
 	// Initialize handlers
 	userHandler = handlers.NewUserHandler(authService, paymentService, xrayService, trafficService)
+	userHandler.Nodes = services.NewNodeService(repository.NewNodeRepository(dbConn), xrayService, cfg.XrayAPITimeout)
 	adminHandler = handlers.NewAdminHandler(userRepo)
 	xrayHandler = handlers.NewXrayHandler(xrayService)
 	trafficHandler = handlers.NewTrafficHandler(trafficService)
+	paymentHandler = handlers.NewPaymentHandler(paymentService)
 
 	// Initialize router
 	router = mux.NewRouter()
@@ -87,32 +113,47 @@ func setup() {
 	// Public routes
 	router.HandleFunc("/register", userHandler.Register).Methods("POST")
 	router.HandleFunc("/login", userHandler.Login).Methods("POST")
+	router.HandleFunc("/login/telegram", userHandler.TelegramLogin).Methods("POST")
+	router.HandleFunc("/login/telegram/webapp", userHandler.TelegramLogin).Methods("POST")
+	router.HandleFunc("/register/telegram", userHandler.TelegramRegister).Methods("POST")
+	router.HandleFunc("/password-reset/request", userHandler.RequestPasswordReset).Methods("POST")
+	router.HandleFunc("/password-reset/confirm", userHandler.ConfirmPasswordReset).Methods("POST")
+	router.HandleFunc("/email/verify", userHandler.VerifyEmail).Methods("GET")
+	router.HandleFunc("/email/resend", userHandler.ResendVerification).Methods("POST")
 
 	// User routes
 	userRouter := router.PathPrefix("/user").Subrouter()
-	userRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret))
+	userRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret, authService.TokenVersion))
 	userRouter.HandleFunc("/me", userHandler.GetMe).Methods("GET")
 	userRouter.HandleFunc("/change-tariff", userHandler.ChangeTariff).Methods("POST")
 	userRouter.HandleFunc("/traffic", trafficHandler.GetTraffic).Methods("GET")
+	userRouter.HandleFunc("/telegram", userHandler.GetTelegramIdentities).Methods("GET")
+	userRouter.HandleFunc("/telegram", userHandler.LinkTelegram).Methods("POST")
+	userRouter.HandleFunc("/telegram/{telegram_id:[0-9]+}", userHandler.UnlinkTelegram).Methods("DELETE")
+	userRouter.HandleFunc("/payments", paymentHandler.CreatePayment).Methods("POST")
+	userRouter.HandleFunc("/payments", paymentHandler.GetUserPayments).Methods("GET")
+	userRouter.HandleFunc("/payments/{id}", paymentHandler.UpdatePaymentStatus).Methods("PUT")
 	userRouter.HandleFunc("/delete-account", userHandler.DeleteAccount).Methods("POST")
-	userRouter.HandleFunc("/request-password-reset", userHandler.RequestPasswordReset).Methods("POST")
 
 	// Xray config route
 	userRouter.HandleFunc("/config", handlers.NewConfigHandler(xrayService).GetConfig).Methods("GET")
 
 	// Admin routes
+	can := func(permission string, handler http.HandlerFunc) http.Handler {
+		return middleware.RequirePermission(permission)(handler)
+	}
 	adminRouter := router.PathPrefix("/admin").Subrouter()
-	adminRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret))
-	adminRouter.Use(middleware.AdminOnlyMiddleware(cfg.AdminToken))
-	adminRouter.HandleFunc("/users", adminHandler.GetAllUsers).Methods("GET")
-	adminRouter.HandleFunc("/ban/{id}", adminHandler.BanUser).Methods("POST")
+	adminRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret, authService.TokenVersion))
+	adminRouter.Handle("/users", can(models.PermUsersRead, adminHandler.GetAllUsers)).Methods("GET")
+	adminRouter.Handle("/ban/{id}", can(models.PermUsersWrite, adminHandler.BanUser)).Methods("POST")
+	adminRouter.Handle("/users/{id}/role", can(models.PermRolesWrite, adminHandler.SetRole)).Methods("PUT")
+	adminRouter.Handle("/payments/{id}/status", can(models.PermPaymentsWrite, paymentHandler.SetPaymentStatus)).Methods("PUT")
 
 	// Xray routes
 	xrayRouter := router.PathPrefix("/xray").Subrouter()
-	xrayRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret))
-	xrayRouter.Use(middleware.AdminOnlyMiddleware(cfg.AdminToken))
-	xrayRouter.HandleFunc("/reload", xrayHandler.ReloadConfig).Methods("POST")
-	xrayRouter.HandleFunc("/restart", xrayHandler.Restart).Methods("POST")
+	xrayRouter.Use(middleware.AuthMiddleware(cfg.JWTSecret, authService.TokenVersion))
+	xrayRouter.Handle("/reload", can(models.PermXrayWrite, xrayHandler.ReloadConfig)).Methods("POST")
+	xrayRouter.Handle("/restart", can(models.PermXrayWrite, xrayHandler.Restart)).Methods("POST")
 }
 
 func TestMain(m *testing.M) {
@@ -274,3 +315,446 @@ func TestTrafficEndpoint(t *testing.T) {
 
 	fmt.Printf("Traffic data: %v\n", trafficData)
 }
+
+func postJSON(path string, data interface{}) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(data)
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	return executeRequest(req)
+}
+
+func login(t *testing.T, email, password string) string {
+	resp := postJSON("/login", map[string]string{"email": email, "password": password})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	var tokenData map[string]string
+	if err := json.Unmarshal(resp.Body.Bytes(), &tokenData); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	return tokenData["token"]
+}
+
+// waitForMailToken reads the token from the email sent to the address with
+// a link to path; emails are sent in the background.
+func waitForMailToken(t *testing.T, to, path string) string {
+	tokenPattern := regexp.MustCompile(regexp.QuoteMeta(path) + `\?token=([A-Za-z0-9_.-]+)`)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		files, _ := filepath.Glob(filepath.Join(mailDir, "*.eml"))
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil || !bytes.Contains(data, []byte("To: "+to+"\r\n")) {
+				continue
+			}
+			if match := tokenPattern.FindSubmatch(data); match != nil {
+				os.Remove(file)
+				return string(match[1])
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("No email with a %s link was sent to %s", path, to)
+	return ""
+}
+
+func TestPasswordReset(t *testing.T) {
+	const email = "reset@example.com"
+	if resp := postJSON("/register", map[string]string{"email": email, "password": "old-password"}); resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+	oldSession := login(t, email, "old-password")
+
+	// Unknown addresses get the same answer
+	if resp := postJSON("/password-reset/request", map[string]string{"email": "nobody@example.com"}); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	if resp := postJSON("/password-reset/request", map[string]string{"email": email}); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	resetToken := waitForMailToken(t, email, "/reset-password")
+
+	confirm := map[string]string{"token": resetToken, "password": "new-password"}
+	if resp := postJSON("/password-reset/confirm", confirm); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	if resp := postJSON("/password-reset/confirm", confirm); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a used token to be rejected, got %d", resp.Code)
+	}
+
+	meReq, _ := http.NewRequest("GET", "/user/me", nil)
+	meReq.Header.Set("Authorization", "Bearer "+oldSession)
+	if resp := executeRequest(meReq); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the old session to be invalidated, got %d", resp.Code)
+	}
+	if resp := postJSON("/login", map[string]string{"email": email, "password": "old-password"}); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the old password to be rejected, got %d", resp.Code)
+	}
+	newSession := login(t, email, "new-password")
+
+	deleteReq, _ := http.NewRequest("POST", "/user/delete-account", nil)
+	deleteReq.Header.Set("Authorization", "Bearer "+newSession)
+	executeRequest(deleteReq)
+}
+
+func TestEmailVerification(t *testing.T) {
+	const email = "verify@example.com"
+	if resp := postJSON("/register", map[string]string{"email": "not an email", "password": "password"}); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid address to be rejected, got %d", resp.Code)
+	}
+
+	resp := postJSON("/register", map[string]string{"email": email, "password": "password"})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+	var user models.User
+	if err := json.Unmarshal(resp.Body.Bytes(), &user); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if user.EmailStatus != models.EmailPending {
+		t.Fatalf("Expected a new account to be pending, got %q", user.EmailStatus)
+	}
+	verifyToken := waitForMailToken(t, email, "/email/verify")
+
+	badReq, _ := http.NewRequest("GET", "/email/verify?token="+verifyToken+"x", nil)
+	if resp := executeRequest(badReq); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a forged link to be rejected, got %d", resp.Code)
+	}
+	verifyReq, _ := http.NewRequest("GET", "/email/verify?token="+verifyToken, nil)
+	if resp := executeRequest(verifyReq); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+
+	token := login(t, email, "password")
+	meReq, _ := http.NewRequest("GET", "/user/me", nil)
+	meReq.Header.Set("Authorization", "Bearer "+token)
+	meResp := executeRequest(meReq)
+	var meData map[string]interface{}
+	if err := json.Unmarshal(meResp.Body.Bytes(), &meData); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if meData["email_status"] != models.EmailVerified {
+		t.Fatalf("Expected the email to be verified, got %v", meData["email_status"])
+	}
+
+	deleteReq, _ := http.NewRequest("POST", "/user/delete-account", nil)
+	deleteReq.Header.Set("Authorization", "Bearer "+token)
+	executeRequest(deleteReq)
+}
+
+// telegramWidget returns Login Widget data signed with the test bot token.
+func telegramWidget(id int64, username string) map[string]string {
+	fields := map[string]string{
+		"auth_date":  strconv.FormatInt(time.Now().Unix(), 10),
+		"first_name": "Test",
+		"id":         strconv.FormatInt(id, 10),
+		"username":   username,
+	}
+	secret := sha256.Sum256([]byte(testBotToken))
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte("auth_date=" + fields["auth_date"] + "\nfirst_name=Test\nid=" + fields["id"] + "\nusername=" + username))
+	fields["hash"] = hex.EncodeToString(mac.Sum(nil))
+	return fields
+}
+
+func authorized(method, path, token string, data interface{}) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(data)
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return executeRequest(req)
+}
+
+func TestTelegramAccounts(t *testing.T) {
+	const first, second = int64(7000000001), int64(7000000002)
+
+	if resp := postJSON("/login", map[string]interface{}{"telegram_id": first}); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected login by raw telegram_id to be rejected, got %d", resp.Code)
+	}
+	forged := telegramWidget(first, "tg_user")
+	forged["id"] = strconv.FormatInt(second, 10)
+	if resp := postJSON("/register/telegram", forged); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected forged Telegram data to be rejected, got %d", resp.Code)
+	}
+
+	resp := postJSON("/register/telegram", telegramWidget(first, "tg_user"))
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+	var user models.User
+	if err := json.Unmarshal(resp.Body.Bytes(), &user); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if user.EmailStatus != models.EmailNone {
+		t.Fatalf("Expected a Telegram-only account without email, got %q", user.EmailStatus)
+	}
+	if resp := postJSON("/register/telegram", telegramWidget(first, "tg_user")); resp.Code != http.StatusConflict {
+		t.Fatalf("Expected a second signup to conflict, got %d", resp.Code)
+	}
+
+	resp = postJSON("/login/telegram", telegramWidget(first, "tg_user"))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	var tokenData map[string]string
+	if err := json.Unmarshal(resp.Body.Bytes(), &tokenData); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	token := tokenData["token"]
+
+	firstPath := "/user/telegram/" + strconv.FormatInt(first, 10)
+	if resp := authorized("DELETE", firstPath, token, nil); resp.Code != http.StatusConflict {
+		t.Fatalf("Expected unlinking the only sign-in method to conflict, got %d", resp.Code)
+	}
+	if resp := authorized("POST", "/user/telegram", token, telegramWidget(second, "tg_second")); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+
+	// Аккаунт, привязанный к другому пользователю, не перепривязывается
+	if resp := postJSON("/register", map[string]string{"email": "linker@example.com", "password": "password"}); resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+	emailToken := login(t, "linker@example.com", "password")
+	if resp := authorized("POST", "/user/telegram", emailToken, telegramWidget(first, "tg_user")); resp.Code != http.StatusConflict {
+		t.Fatalf("Expected linking another user's Telegram account to conflict, got %d", resp.Code)
+	}
+
+	if resp := authorized("DELETE", firstPath, token, nil); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	resp = authorized("GET", "/user/telegram", token, nil)
+	var identities []models.TelegramIdentity
+	if err := json.Unmarshal(resp.Body.Bytes(), &identities); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if len(identities) != 1 || identities[0].TelegramID != second {
+		t.Fatalf("Expected only the second Telegram account, got %+v", identities)
+	}
+
+	authorized("POST", "/user/delete-account", token, nil)
+	authorized("POST", "/user/delete-account", emailToken, nil)
+}
+
+func TestAdminPermissions(t *testing.T) {
+	const email = "staff@example.com"
+	resp := postJSON("/register", map[string]string{"email": email, "password": "password"})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+	var user models.User
+	if err := json.Unmarshal(resp.Body.Bytes(), &user); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+
+	token := login(t, email, "password")
+	if resp := authorized("GET", "/admin/users", token, nil); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected a regular user to be forbidden, got %d", resp.Code)
+	}
+
+	if err := userRepo.SetRole(int(user.ID), models.RoleReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	if resp := authorized("GET", "/admin/users", token, nil); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the token issued before the role change to be rejected, got %d", resp.Code)
+	}
+	token = login(t, email, "password")
+	if resp := authorized("GET", "/admin/users", token, nil); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	if resp := authorized("POST", "/xray/restart", token, nil); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected a read-only user to be forbidden to restart Xray, got %d", resp.Code)
+	}
+
+	authorized("POST", "/user/delete-account", token, nil)
+}
+
+func TestLastAdminKeepsRole(t *testing.T) {
+	register := func(email string) models.User {
+		resp := postJSON("/register", map[string]string{"email": email, "password": "password"})
+		if resp.Code != http.StatusCreated {
+			t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusCreated, resp.Code, resp.Body.String())
+		}
+		var user models.User
+		if err := json.Unmarshal(resp.Body.Bytes(), &user); err != nil {
+			t.Fatalf("Failed to parse response body: %v", err)
+		}
+		if err := userRepo.SetRole(int(user.ID), models.RoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	first := register("first-admin@example.com")
+	second := register("second-admin@example.com")
+	token := login(t, "first-admin@example.com", "password")
+
+	// Пока администраторов двое, одного можно понизить
+	path := "/admin/users/" + strconv.Itoa(int(second.ID)) + "/role"
+	if resp := authorized("PUT", path, token, map[string]string{"role": models.RoleSupport}); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	// Тестовая база не содержит других администраторов, first остался последним
+	if err := userRepo.SetRole(int(first.ID), models.RoleUser); !errors.Is(err, repository.ErrLastAdmin) {
+		t.Fatalf("Expected the last admin to keep the role, got %v", err)
+	}
+	if user, err := userRepo.FindByID(int(first.ID)); err != nil || user.Role != models.RoleAdmin {
+		t.Fatalf("Expected the last admin to stay an admin, got %+v, %v", user, err)
+	}
+
+	authorized("POST", "/user/delete-account", token, nil)
+	authorized("POST", "/user/delete-account", login(t, "second-admin@example.com", "password"), nil)
+}
+
+func TestPaymentStatus(t *testing.T) {
+	const email = "payer@example.com"
+	resp := postJSON("/register", map[string]string{"email": email, "password": "password"})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+	var user models.User
+	if err := json.Unmarshal(resp.Body.Bytes(), &user); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if err := userRepo.UpdateUsedTraffic(int(user.ID), 1<<40); err != nil {
+		t.Fatal(err)
+	}
+	token := login(t, email, "password")
+
+	payment := func() string {
+		resp := authorized("POST", "/user/payments", token, map[string]interface{}{
+			"amount": 100, "tariff_id": user.TariffID, "payment_method": "card",
+		})
+		if resp.Code != http.StatusCreated {
+			t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusCreated, resp.Code, resp.Body.String())
+		}
+		var payments []models.Payment
+		resp = authorized("GET", "/user/payments", token, nil)
+		if err := json.Unmarshal(resp.Body.Bytes(), &payments); err != nil || len(payments) == 0 {
+			t.Fatalf("Failed to list payments: %v %s", err, resp.Body.String())
+		}
+		return strconv.Itoa(payments[len(payments)-1].ID)
+	}
+
+	id := payment()
+	if resp := authorized("PUT", "/user/payments/"+id, token, map[string]string{"status": "completed"}); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected a user to be forbidden to complete their payment, got %d", resp.Code)
+	}
+	if resp := authorized("PUT", "/user/payments/"+id, token, map[string]string{"status": "cancelled"}); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	if resp := authorized("PUT", "/admin/payments/"+id+"/status", token, map[string]string{"status": "completed"}); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected a user to be forbidden to use the billing route, got %d", resp.Code)
+	}
+
+	if err := userRepo.SetRole(int(user.ID), models.RoleBilling); err != nil {
+		t.Fatal(err)
+	}
+	token = login(t, email, "password")
+	if resp := authorized("PUT", "/admin/payments/"+id+"/status", token, map[string]string{"status": "completed"}); resp.Code != http.StatusConflict {
+		t.Fatalf("Expected a cancelled payment not to be completed, got %d", resp.Code)
+	}
+	id = payment()
+	if resp := authorized("PUT", "/admin/payments/"+id+"/status", token, map[string]string{"status": "completed"}); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	paid, err := userRepo.FindByID(int(user.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paid.UsedTraffic != 0 {
+		t.Errorf("Expected a completed payment to reset used traffic, got %d", paid.UsedTraffic)
+	}
+
+	authorized("POST", "/user/delete-account", token, nil)
+}
+
+func TestChangeTariffKeepsQuotaUntilPaid(t *testing.T) {
+	const email = "overquota@example.com"
+	resp := postJSON("/register", map[string]string{"email": email, "password": "password"})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+	var user models.User
+	if err := json.Unmarshal(resp.Body.Bytes(), &user); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if err := userRepo.UpdateUsedTraffic(int(user.ID), 1<<40); err != nil {
+		t.Fatal(err)
+	}
+	if err := userRepo.SetAccessState(int(user.ID), models.AccessSuspended, "traffic quota exceeded"); err != nil {
+		t.Fatal(err)
+	}
+	bigger := &models.Tariff{Name: "unlimited", Price: 100, TrafficLimit: 1 << 50}
+	if err := tariffRepo.Create(bigger); err != nil {
+		t.Fatal(err)
+	}
+	token := login(t, email, "password")
+
+	resp = authorized("POST", "/user/change-tariff", token, map[string]interface{}{"tariff_id": bigger.ID})
+	if resp.Code != http.StatusAccepted {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusAccepted, resp.Code, resp.Body.String())
+	}
+	var payment models.Payment
+	if err := json.Unmarshal(resp.Body.Bytes(), &payment); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if payment.Status != models.PaymentPending || payment.TariffID != int(bigger.ID) || payment.Amount != 100 {
+		t.Errorf("Expected a pending payment for the new tariff, got %+v", payment)
+	}
+
+	// Пока платёж не завершён, тариф и ограничения прежние
+	after, err := userRepo.FindByID(int(user.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.TariffID != user.TariffID || after.AccessState != models.AccessSuspended || after.UsedTraffic != 1<<40 {
+		t.Errorf("Expected the user to stay restricted on their tariff, got tariff %d, state %s, used %d",
+			after.TariffID, after.AccessState, after.UsedTraffic)
+	}
+
+	authorized("POST", "/user/delete-account", token, nil)
+	tariffRepo.Delete(int(bigger.ID))
+}
+
+func TestPurgeUnverifiedDeletesDependentRows(t *testing.T) {
+	const email = "stale@example.com"
+	resp := postJSON("/register", map[string]string{"email": email, "password": "password"})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d. Body: %s", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+	var user models.User
+	if err := json.Unmarshal(resp.Body.Bytes(), &user); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	userID := int(user.ID)
+	dependents := []interface{}{
+		&models.PasswordResetToken{UserID: userID, TokenHash: "stale-token", ExpiresAt: time.Now().Add(time.Hour)},
+		&models.TelegramIdentity{UserID: userID, TelegramID: 777000111},
+		&models.AccessEvent{UserID: userID, State: models.AccessSuspended, CreatedAt: time.Now()},
+		&models.Payment{UserID: userID, Status: models.PaymentPending, CreatedAt: time.Now()},
+		&models.TrafficLog{UserID: userID, Uplink: 1, Timestamp: time.Now()},
+	}
+	for _, row := range dependents {
+		if err := dbConn.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := userRepo.DeleteUnverified(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted == 0 {
+		t.Fatal("Expected the unverified account to be purged")
+	}
+	for _, model := range []interface{}{
+		&models.PasswordResetToken{}, &models.TelegramIdentity{}, &models.AccessEvent{}, &models.Payment{}, &models.TrafficLog{},
+	} {
+		var count int64
+		if err := dbConn.Model(model).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("Expected no %T rows left for the purged user, got %d", model, count)
+		}
+	}
+}